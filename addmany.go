@@ -0,0 +1,25 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fsnotify
+
+// AddMany starts watching all the named files or directories
+// (non-recursively).
+//
+// Unlike calling Add in a loop it doesn't stop at the first error; all paths
+// are attempted, and the returned error lists every path that failed. The
+// errors for the individual paths can still be inspected with errors.Is and
+// errors.As.
+func (w *Watcher) AddMany(names ...string) error {
+	var errs multiError
+	for _, name := range names {
+		if err := w.Add(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
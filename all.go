@@ -0,0 +1,56 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23 && (darwin || dragonfly || freebsd || openbsd || linux || netbsd || solaris || windows)
+// +build go1.23
+// +build darwin dragonfly freebsd openbsd linux netbsd solaris windows
+
+package fsnotify
+
+import (
+	"context"
+	"iter"
+)
+
+// All returns an iterator over the events and errors, for use with range:
+//
+//	for e, err := range w.All(ctx) {
+//		if err != nil {
+//			log.Println(err)
+//			continue
+//		}
+//		log.Println(e)
+//	}
+//
+// Every iteration has either an event or an error. The iteration stops when
+// ctx is canceled, or when the watcher is closed and all events were received.
+//
+// This receives from the Events and Errors channels, and must not be used while
+// other goroutines are receiving from them.
+func (w *Watcher) All(ctx context.Context) iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		errs := w.Errors
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if !yield(e, nil) {
+					return
+				}
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				if !yield(Event{}, err) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23 && (darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows)
+// +build go1.23
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWatchAll(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t, tmp)
+	defer w.Close()
+
+	touch(t, tmp, "file", noWait)
+
+	var have Events
+	for e, err := range w.All(context.Background()) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		have = append(have, e)
+		break
+	}
+	cmpEvents(t, tmp, have, newEvents(t, `
+		create  /file
+	`))
+
+	// Stops when the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for range w.All(ctx) {
+	}
+
+	// Stops once the watcher is closed.
+	w.Close()
+	for e, err := range w.All(context.Background()) {
+		t.Errorf("unexpected event after Close: %v %v", e, err)
+	}
+}
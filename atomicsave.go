@@ -0,0 +1,190 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// atomicSaves holds back the events for newly created files, for
+// WithAtomicSaveDetection. If the file is renamed within the window and the
+// rename shows up as a Create in the same directory, all of it is replaced by
+// a single Write for the new path. Otherwise the events are sent as usual once
+// the window is over.
+type atomicSaves struct {
+	mu      sync.Mutex
+	pending []*atomicSave // In the order they were created.
+	timer   *time.Timer   // Set while waiting to call the schedule function.
+}
+
+type atomicSave struct {
+	name    string    // The temporary file.
+	events  []Event   // Events that are held back.
+	renamed bool      // The temporary file was renamed.
+	cookie  uint32    // Cookie of the Rename.
+	until   time.Time // When to stop waiting.
+}
+
+// update returns the events to send now, out of events.
+func (s *atomicSaves) update(events []Event, window time.Duration) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	out := s.expire(now)
+	for _, e := range events {
+		out = s.add(out, e, now.Add(window))
+	}
+	return out
+}
+
+// add holds back e, or appends it to out along with the events that can be
+// sent because of it.
+//
+// The caller must hold s.mu.
+func (s *atomicSaves) add(out []Event, e Event, until time.Time) []Event {
+	if i := s.find(e.Name); i >= 0 {
+		p := s.pending[i]
+		switch {
+		case e.Op&Remove == Remove:
+			s.delete(i)
+			return append(append(out, p.events...), e)
+		case p.renamed && e.Op&Create == Create:
+			// Created again after it was renamed: a new file.
+			s.delete(i)
+			out = append(out, p.events...)
+		default:
+			p.events = append(p.events, e)
+			if e.Op&Rename == Rename {
+				p.renamed, p.cookie = true, e.Cookie
+			}
+			return out
+		}
+	}
+
+	switch {
+	case e.Op&Create == Create:
+		if i := s.match(e); i >= 0 {
+			p := s.pending[i]
+			s.delete(i)
+			for _, h := range p.events {
+				if h.Name != p.name && h.Name != e.Name {
+					out = append(out, h)
+				}
+			}
+			return append(out, Event{Name: e.Name, Op: Write, Seq: e.Seq})
+		}
+		s.pending = append(s.pending, &atomicSave{name: e.Name, events: []Event{e}, until: until})
+		return out
+	case e.Op&Remove == Remove:
+		// The file a temporary file is renamed over can be reported as
+		// removed before the Create; keep it with the other events, so it's
+		// dropped if it's replaced.
+		dir := filepath.Dir(e.Name)
+		for _, p := range s.pending {
+			if filepath.Dir(p.name) == dir {
+				p.events = append(p.events, e)
+				return out
+			}
+		}
+	}
+	return append(out, e)
+}
+
+// find returns the index of the pending save for the temporary file name, or
+// -1 if there is none.
+func (s *atomicSaves) find(name string) int {
+	for i, p := range s.pending {
+		if p.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// match returns the index of the renamed temporary file the Create e is for,
+// or -1 if there is none. With a Cookie (inotify with WithMoveEvents) that has
+// to match; otherwise it's the first file renamed in the same directory.
+func (s *atomicSaves) match(e Event) int {
+	dir := filepath.Dir(e.Name)
+	for i, p := range s.pending {
+		if !p.renamed || filepath.Dir(p.name) != dir {
+			continue
+		}
+		if p.cookie != 0 && e.Cookie != 0 && p.cookie != e.Cookie {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+func (s *atomicSaves) delete(i int) {
+	s.pending = append(s.pending[:i], s.pending[i+1:]...)
+}
+
+// expire removes the pending saves that waited until now, and returns their
+// events.
+//
+// The caller must hold s.mu.
+func (s *atomicSaves) expire(now time.Time) []Event {
+	var out []Event
+	for len(s.pending) > 0 && !now.Before(s.pending[0].until) {
+		out = append(out, s.pending[0].events...)
+		s.pending = s.pending[1:]
+	}
+	return out
+}
+
+// expired returns the events of the pending saves that waited until now.
+func (s *atomicSaves) expired(now time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expire(now)
+}
+
+// next returns when the first pending save stops waiting, and false if there
+// are none.
+func (s *atomicSaves) next() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return time.Time{}, false
+	}
+	return s.pending[0].until, true
+}
+
+// schedule calls f from a new goroutine when the first pending save stops
+// waiting, unless that's already scheduled. f should call schedule again for
+// the saves that are still pending.
+func (s *atomicSaves) schedule(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil || len(s.pending) == 0 {
+		return
+	}
+	s.timer = time.AfterFunc(time.Until(s.pending[0].until), func() {
+		s.mu.Lock()
+		s.timer = nil
+		s.mu.Unlock()
+		f()
+	})
+}
+
+// reset drops all pending saves, for Close.
+func (s *atomicSaves) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.pending = nil
+}
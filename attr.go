@@ -0,0 +1,159 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd
+// +build darwin dragonfly freebsd openbsd linux netbsd
+
+package fsnotify
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// attrs are the attributes of a file we compare for WithAttrDetail.
+type attrs struct {
+	mode     os.FileMode
+	uid, gid uint32
+	mtime    time.Time
+}
+
+func statAttrs(name string) (attrs, bool) {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return attrs{}, false
+	}
+	a := attrs{mode: fi.Mode(), mtime: fi.ModTime()}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		a.uid, a.gid = st.Uid, st.Gid
+	}
+	return a, true
+}
+
+// fileID returns the inode and device number of name, for WithFileID.
+func fileID(name string) (ino, dev uint64) {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return 0, 0
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino), uint64(st.Dev)
+	}
+	return 0, 0
+}
+
+// attrCache remembers the attributes of all watched files, for WithAttrDetail.
+type attrCache struct {
+	mu    sync.Mutex
+	files map[string]attrs
+}
+
+// add records the attributes of name, and of all entries in it if it's a
+// directory. This is only done for the paths that are added to the watcher;
+// for the events use refresh, which doesn't read the directory.
+func (c *attrCache) add(name string) {
+	a, ok := c.refresh(name)
+	if !ok || !a.mode.IsDir() {
+		return
+	}
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		c.refresh(filepath.Join(name, e.Name()))
+	}
+}
+
+// refresh records the attributes of name only, and returns them.
+func (c *attrCache) refresh(name string) (attrs, bool) {
+	a, ok := statAttrs(name)
+	if !ok {
+		return a, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.files == nil {
+		c.files = make(map[string]attrs)
+	}
+	c.files[name] = a
+	return a, true
+}
+
+// changed records the attributes of name, and returns what changed since
+// they were last recorded.
+func (c *attrCache) changed(name string) Attr {
+	a, ok := statAttrs(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, known := c.files[name]
+	if !ok {
+		delete(c.files, name)
+		return AttrOther
+	}
+	if c.files == nil {
+		c.files = make(map[string]attrs)
+	}
+	c.files[name] = a
+	if !known {
+		return AttrOther
+	}
+
+	var attr Attr
+	if a.mode != old.mode {
+		attr |= AttrMode
+	}
+	if a.uid != old.uid || a.gid != old.gid {
+		attr |= AttrOwner
+	}
+	if !a.mtime.Equal(old.mtime) {
+		attr |= AttrTimes
+	}
+	if attr == 0 {
+		attr = AttrOther
+	}
+	return attr
+}
+
+// len returns the number of files whose attributes are kept, for MemStats.
+func (c *attrCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.files)
+}
+
+// remove forgets name, and all entries in it if it's a directory.
+func (c *attrCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, ok := c.files[name]
+	delete(c.files, name)
+	if !ok || !a.mode.IsDir() {
+		return
+	}
+	for p := range c.files {
+		if filepath.Dir(p) == name {
+			delete(c.files, p)
+		}
+	}
+}
+
+// update keeps the recorded attributes up to date for e, and sets e.Attr for
+// Chmod events.
+func (c *attrCache) update(e *Event) {
+	switch {
+	case e.Op&(Remove|Rename) != 0:
+		c.remove(e.Name)
+	case e.Op&Chmod == Chmod:
+		e.Attr = c.changed(e.Name)
+	case e.Op&(Create|Write) != 0:
+		// A write changes the modification time, which shouldn't be
+		// reported on the next Chmod. The entries of a new or changed
+		// directory get their own events, so it's not read here.
+		c.refresh(e.Name)
+	}
+}
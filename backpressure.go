@@ -0,0 +1,110 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dropQuietPeriod is how long no events need to be discarded before
+// ErrEventDropped is sent again.
+const dropQuietPeriod = time.Second
+
+// dropCounter counts the events discarded by the backpressure policy.
+type dropCounter struct {
+	mu       sync.Mutex
+	n        uint64
+	last     time.Time // When the last event was discarded.
+	reported bool      // ErrEventDropped was sent since the last quiet period.
+}
+
+// drop records a discarded event, and sends ErrEventDropped on errs if it's
+// the first one after a quiet period. It doesn't block if errs isn't ready to
+// receive, but tries again on the next discarded event.
+func (c *dropCounter) drop(errs chan<- error) {
+	c.mu.Lock()
+	now := time.Now()
+	c.n++
+	if now.Sub(c.last) > dropQuietPeriod {
+		c.reported = false
+	}
+	c.last = now
+	report := !c.reported
+	c.mu.Unlock()
+
+	if !report {
+		return
+	}
+	select {
+	case errs <- ErrEventDropped:
+		c.mu.Lock()
+		c.reported = true
+		c.mu.Unlock()
+	default:
+	}
+}
+
+// count returns the number of discarded events.
+func (c *dropCounter) count() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+// trySend delivers e on events according to the backpressure policy. It
+// returns false for Block, in which case the caller should do a blocking send
+// as usual.
+func (p Backpressure) trySend(events chan Event, errs chan<- error, drops *dropCounter, e Event) bool {
+	if p == Block {
+		return false
+	}
+	for {
+		select {
+		case events <- e:
+			return true
+		default:
+		}
+
+		if p == DropOldest && cap(events) > 0 {
+			select {
+			case <-events:
+			default:
+				// Consumer read it in the meantime; try again.
+				continue
+			}
+		}
+
+		drops.drop(errs)
+		if p == DropNewest || cap(events) == 0 {
+			return true
+		}
+	}
+}
+
+// sendTimer returns a channel that's ready when a blocking send of an event
+// should be given up for WithSendTimeout, and a function to stop it. The
+// channel is nil if there's no timeout.
+func sendTimer(d time.Duration) (<-chan time.Time, func()) {
+	if d <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTimer(d)
+	return t.C, func() { t.Stop() }
+}
+
+// trySendError sends err on errs if it can be sent without blocking, and
+// otherwise discards it and counts it in dropped, for WithDropErrors.
+func trySendError(errs chan error, dropped *uint64, err error) {
+	select {
+	case errs <- err:
+	default:
+		atomic.AddUint64(dropped, 1)
+	}
+}
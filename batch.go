@@ -0,0 +1,167 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || solaris || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd solaris windows
+
+package fsnotify
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// BatchedWatcher is a Watcher that sends the events in batches, which is
+// cheaper than receiving them one at a time when there are many events, such
+// as during a bulk copy.
+type BatchedWatcher struct {
+	// BatchEvents sends the events in the order they happened. A batch is
+	// sent once it has maxBatch events, or maxDelay after its first event,
+	// whichever is first. A batch is never empty.
+	BatchEvents chan []Event
+
+	// Errors sends any errors.
+	Errors chan error
+
+	w         *Watcher
+	maxBatch  int
+	maxDelay  time.Duration
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBatchedWatcher creates a new BatchedWatcher, which sends at most maxBatch
+// events in a batch, and waits at most maxDelay to fill one.
+//
+// The options are passed on to NewWatcher.
+func NewBatchedWatcher(maxBatch int, maxDelay time.Duration, opts ...Option) (*BatchedWatcher, error) {
+	if maxBatch < 1 {
+		return nil, errors.New("fsnotify: maxBatch must be at least 1")
+	}
+	if maxDelay <= 0 {
+		return nil, errors.New("fsnotify: maxDelay must be positive")
+	}
+
+	w, err := NewWatcher(opts...)
+	if err != nil {
+		return nil, err
+	}
+	bw := &BatchedWatcher{
+		BatchEvents: make(chan []Event),
+		Errors:      make(chan error),
+		w:           w,
+		maxBatch:    maxBatch,
+		maxDelay:    maxDelay,
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go bw.readEvents()
+	return bw, nil
+}
+
+// Add starts watching the named file or directory (non-recursively).
+func (bw *BatchedWatcher) Add(name string) error { return bw.w.Add(name) }
+
+// Remove stops watching the named file or directory.
+func (bw *BatchedWatcher) Remove(name string) error { return bw.w.Remove(name) }
+
+// Close removes all watches and closes the BatchEvents and Errors channels.
+// Events that are still waiting to be batched are dropped.
+func (bw *BatchedWatcher) Close() error {
+	bw.closeOnce.Do(func() { close(bw.done) })
+	return bw.w.Close()
+}
+
+// Done returns a channel that's closed once the BatchedWatcher and the
+// Watcher it uses have fully stopped after Close, and the BatchEvents and
+// Errors channels are closed.
+func (bw *BatchedWatcher) Done() <-chan struct{} {
+	return bw.stopped
+}
+
+func (bw *BatchedWatcher) readEvents() {
+	defer func() {
+		// Keep receiving until the Watcher is closed, so that it never
+		// blocks on sending something that's no longer forwarded.
+		for evs, errs := bw.w.Events, bw.w.Errors; evs != nil || errs != nil; {
+			select {
+			case _, ok := <-evs:
+				if !ok {
+					evs = nil
+				}
+			case _, ok := <-errs:
+				if !ok {
+					errs = nil
+				}
+			}
+		}
+		<-bw.w.Done()
+		close(bw.stopped)
+	}()
+	defer close(bw.Errors)
+	defer close(bw.BatchEvents)
+
+	var (
+		batch   []Event
+		timer   *time.Timer
+		timeout <-chan time.Time
+	)
+	// flush sends the current batch, and returns false if the BatchedWatcher
+	// was closed.
+	flush := func() bool {
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+		if len(batch) == 0 {
+			return true
+		}
+		select {
+		case bw.BatchEvents <- batch:
+			batch = nil
+			return true
+		case <-bw.done:
+			return false
+		}
+	}
+
+	errs := bw.w.Errors
+	for {
+		select {
+		case <-bw.done:
+			return
+		case <-timeout:
+			timer, timeout = nil, nil
+			if !flush() {
+				return
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case bw.Errors <- err:
+			case <-bw.done:
+				return
+			}
+		case e, ok := <-bw.w.Events:
+			if !ok {
+				flush()
+				return
+			}
+			if len(batch) == 0 {
+				batch = make([]Event, 0, bw.maxBatch)
+				timer = time.NewTimer(bw.maxDelay)
+				timeout = timer.C
+			}
+			batch = append(batch, e)
+			if len(batch) >= bw.maxBatch && !flush() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || solaris || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd solaris windows
+
+package fsnotify
+
+// OnEvent sets a function that's called for every event instead of sending it
+// on the Events channel, which avoids the latency of handing the event over to
+// another goroutine. Errors are still sent on the Errors channel. Pass nil to
+// use the Events channel again.
+//
+// The function is called from the goroutine that reads the events from the
+// kernel, one event at a time. It must return quickly: no other events are
+// read while it's running, and the kernel may discard events if it falls
+// behind. It must not call Close.
+//
+// The backpressure policy and CloseAndDrain don't apply to events passed to
+// the function.
+func (w *Watcher) OnEvent(f func(Event)) {
+	// A pointer to f is stored, as atomic.Value can't store nil. The same is
+	// done for SetLogger and SetPathNormalizer.
+	w.onEvent.Store(&f)
+}
+
+// callEvent calls the function set with OnEvent, if any. It returns false if
+// e should be sent on the Events channel as usual.
+func (w *Watcher) callEvent(e Event) bool {
+	f, _ := w.onEvent.Load().(*func(Event))
+	if f == nil || *f == nil {
+		return false
+	}
+	(*f)(e)
+	return true
+}
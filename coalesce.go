@@ -0,0 +1,188 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Coalesce receives the events from the Events channel and sends them on the
+// returned channel, with a Rename that's followed by a Create of the same file
+// within window replaced by a single Move event. The Move has the new path as
+// the Name and the old path as OldName, and takes the place of the Rename.
+//
+// A Rename and a Create are the same file if they have the same Cookie (on
+// Linux with WithMoveEvents), if they're a MovedFrom directly followed by a
+// MovedTo, or if the Create is for the same inode as the renamed path had. The
+// inodes of the files in the watched directories are read when Coalesce is
+// called, and of every file that has an event afterwards. If the Create can't
+// be matched within window, the Rename and Create are sent as usual.
+//
+// Events are held back while a Rename is waiting for its Create, to keep them
+// in order. The returned channel is closed after Events is closed; the events
+// that are still held back then are sent if they're received within window,
+// and discarded otherwise. Don't receive from Events while using it; errors
+// are still sent on Errors.
+func (w *Watcher) Coalesce(window time.Duration) <-chan Event {
+	c := &coalescer{
+		window: window,
+		root:   w.opts.relativeRoot,
+		files:  make(map[string]os.FileInfo),
+		out:    make(chan Event),
+	}
+	for _, name := range w.WatchList() {
+		if c.root != "" {
+			// Events have names relative to root, which c.path
+			// turns into absolute paths.
+			if abs, err := filepath.Abs(name); err == nil {
+				name = abs
+			}
+		}
+		c.statPath(name)
+		if entries, err := os.ReadDir(name); err == nil {
+			for _, entry := range entries {
+				c.statPath(filepath.Join(name, entry.Name()))
+			}
+		}
+	}
+	go c.run(w.Events)
+	return c.out
+}
+
+type coalescer struct {
+	window time.Duration
+	root   string                 // Set with WithRelativePaths.
+	files  map[string]os.FileInfo // Last known file for every path.
+	queue  []pendingEvent         // Events that aren't sent yet.
+	out    chan Event
+}
+
+type pendingEvent struct {
+	e     Event
+	wait  bool        // A Rename that's waiting for its Create.
+	until time.Time   // When to stop waiting.
+	fi    os.FileInfo // The file that was renamed, if known.
+}
+
+func (c *coalescer) run(events <-chan Event) {
+	defer close(c.out)
+	for {
+		var (
+			send    chan Event
+			next    Event
+			timeout <-chan time.Time
+			timer   *time.Timer
+		)
+		if len(c.queue) > 0 {
+			if head := c.queue[0]; head.wait {
+				timer = time.NewTimer(time.Until(head.until))
+				timeout = timer.C
+			} else {
+				send, next = c.out, head.e
+			}
+		}
+
+		select {
+		case e, ok := <-events:
+			if !ok {
+				done := time.After(c.window)
+				for _, p := range c.queue {
+					select {
+					case c.out <- p.e:
+					case <-done:
+						return
+					}
+				}
+				return
+			}
+			c.add(e)
+		case send <- next:
+			c.queue = c.queue[1:]
+		case <-timeout:
+			c.queue[0].wait = false
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// add queues e, or turns the Rename it matches in to a Move.
+func (c *coalescer) add(e Event) {
+	switch {
+	case e.Op&Create == Create:
+		fi := c.stat(e.Name)
+		for i := range c.queue {
+			p := &c.queue[i]
+			if !p.wait || !c.matches(p, e, fi, i == len(c.queue)-1) {
+				continue
+			}
+			// The Move takes the place of the Rename, so it keeps its Seq
+			// to stay in order.
+			m := e
+			m.Op = Move | (p.e.Op|e.Op)&(MovedFrom|MovedTo)
+			m.OldName = p.e.Name
+			m.Seq = p.e.Seq
+			p.e = m
+			p.wait = false
+			return
+		}
+	case e.Op&Rename == Rename:
+		fi := c.files[c.path(e.Name)]
+		delete(c.files, c.path(e.Name))
+		c.queue = append(c.queue, pendingEvent{e: e, wait: true, until: time.Now().Add(c.window), fi: fi})
+		return
+	case e.Op&Remove == Remove:
+		delete(c.files, c.path(e.Name))
+	default:
+		c.stat(e.Name)
+	}
+	c.queue = append(c.queue, pendingEvent{e: e})
+}
+
+// matches reports if the Create e, for the file fi, is the other half of the
+// Rename p. last is set if p is the event directly before e.
+func (c *coalescer) matches(p *pendingEvent, e Event, fi os.FileInfo, last bool) bool {
+	switch {
+	case p.e.Cookie != 0 && e.Cookie != 0:
+		return p.e.Cookie == e.Cookie
+	case last && p.e.Op&MovedFrom == MovedFrom && e.Op&MovedTo == MovedTo:
+		return true
+	case p.fi != nil && fi != nil:
+		return os.SameFile(p.fi, fi)
+	}
+	return false
+}
+
+// path returns the path of the file the event name is for: with
+// WithRelativePaths the name is relative to the root.
+func (c *coalescer) path(name string) string {
+	if c.root == "" {
+		return name
+	}
+	return filepath.Join(c.root, name)
+}
+
+// stat records the file the event name is for, and returns it; it returns nil
+// if it can't be read.
+func (c *coalescer) stat(name string) os.FileInfo {
+	return c.statPath(c.path(name))
+}
+
+// statPath is stat for a path rather than an event name.
+func (c *coalescer) statPath(path string) os.FileInfo {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		delete(c.files, path)
+		return nil
+	}
+	c.files[path] = fi
+	return fi
+}
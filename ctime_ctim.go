@@ -0,0 +1,27 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build openbsd || dragonfly
+// +build openbsd dragonfly
+
+package fsnotify
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ctime returns the time the inode of fi, from lstat, was last changed in
+// nanoseconds.
+func ctime(fi os.FileInfo) (int64, bool) {
+	switch st := fi.Sys().(type) {
+	case *syscall.Stat_t:
+		return st.Ctim.Nano(), true
+	case *unix.Stat_t: // From a long path.
+		return st.Ctim.Nano(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import (
+	"sync"
+	"time"
+)
+
+// dedupFilter remembers when every (Name, Op) pair was last sent, for
+// WithDedup.
+type dedupFilter struct {
+	mu    sync.Mutex
+	sent  map[dedupKey]time.Time
+	sweep time.Time // When the expired entries were last removed.
+}
+
+type dedupKey struct {
+	name string
+	op   Op
+}
+
+// allow reports if e can be sent: that is, if no event with the same Name and
+// Op was sent within window.
+func (f *dedupFilter) allow(e Event, window time.Duration) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.prune(now, window)
+
+	if f.sent == nil {
+		f.sent = make(map[dedupKey]time.Time)
+	}
+	k := dedupKey{name: e.Name, op: e.Op}
+	if t, ok := f.sent[k]; ok && now.Sub(t) <= window {
+		return false
+	}
+	f.sent[k] = now
+	return true
+}
+
+// prune removes the events that were sent before window, at most once per
+// window.
+//
+// The caller must hold f.mu.
+func (f *dedupFilter) prune(now time.Time, window time.Duration) {
+	if now.Sub(f.sweep) <= window {
+		return
+	}
+	for k, t := range f.sent {
+		if now.Sub(t) > window {
+			delete(f.sent, k)
+		}
+	}
+	f.sweep = now
+}
@@ -0,0 +1,412 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// deferredWatches keeps track of the paths passed to Add with
+// WithDeferredCreate that don't exist yet. For every path the nearest existing
+// ancestor directory is watched, which is moved down as the directories
+// leading up to the path are created.
+//
+// This is also used for WithFollowReplace and WithFollowDirReplace: files and
+// directories that are removed or renamed are deferred until there is a new
+// one at the same path.
+//
+// The backends provide addDeferredWatch, removeDeferredWatch, and isUserWatch
+// to add and remove the actual watches. The watches for ancestors are added
+// with holdWatch, as they may also be needed by WithFollowSymlinks.
+type deferredWatches struct {
+	mu      sync.Mutex
+	targets map[string]string // Path that doesn't exist yet → ancestor watched for it.
+	owned   map[string]int    // Ancestors not watched by the user → number of targets.
+	follow  map[string]bool   // Paths added by the user, for WithFollowReplace.
+	flags   map[string]uint32 // Flags the user added a path with, such as for WithAccess.
+}
+
+// deferred reports if deferredWatches is used.
+func (o withOpts) deferred() bool {
+	return o.deferredCreate || o.followReplace || o.followDirs
+}
+
+// deferWatch waits for name to be created, by watching the nearest existing
+// ancestor. It returns true if name turns out to exist, in which case it
+// should be watched as usual.
+func (w *Watcher) deferWatch(name string) (bool, error) {
+	d := &w.pipeline.deferred
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return w.watchAncestor(name)
+}
+
+// deferredWatching reports if the watch for name is managed here, so that it's
+// watched again when there is a new file at the path, or it's only watched for
+// another path.
+func (w *Watcher) deferredWatching(name string) bool {
+	d := &w.pipeline.deferred
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.follow[name] || d.owned[name] > 0
+}
+
+// claimDeferred is called when the user adds name, so that it's no longer
+// removed when it's not needed for a deferred path. With WithFollowReplace it
+// also starts following name if it's a file, and with WithFollowDirReplace if
+// it's a directory.
+//
+// The backend's flags for the watch are kept, for addDeferredWatch to watch
+// name with the same flags once it exists again.
+func (w *Watcher) claimDeferred(name string, flags uint32) {
+	d := &w.pipeline.deferred
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.owned, name)
+	w.claimWatch(name)
+	if flags != 0 {
+		if d.flags == nil {
+			d.flags = make(map[string]uint32)
+		}
+		d.flags[name] = flags
+	} else {
+		delete(d.flags, name)
+	}
+
+	if w.opts.followReplace || w.opts.followDirs {
+		fi, err := os.Lstat(name)
+		isDir := err == nil && fi.IsDir()
+		if isDir && !w.opts.followDirs || !isDir && !w.opts.followReplace {
+			return
+		}
+		if d.follow == nil {
+			d.follow = make(map[string]bool)
+		}
+		d.follow[name] = true
+	}
+}
+
+// unwatchDeferred is called when the user removes name. It returns true if
+// that was handled here, because name is a deferred path or an ancestor that
+// is still needed for one.
+func (w *Watcher) unwatchDeferred(name string) (bool, error) {
+	d := &w.pipeline.deferred
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.follow, name)
+	delete(d.flags, name)
+	if _, ok := d.targets[name]; ok {
+		w.releaseAncestor(name)
+		return true, nil
+	}
+	if w.heldWatch(name) {
+		// Never added by the user.
+		return true, fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	if !w.isUserWatch(name) {
+		return false, nil
+	}
+	n := 0
+	for _, anc := range d.targets {
+		if anc == name {
+			n++
+		}
+	}
+	if n == 0 {
+		return false, nil
+	}
+	// Keep watching it, but don't send events for it anymore.
+	if d.owned == nil {
+		d.owned = make(map[string]int)
+	}
+	d.owned[name] = n
+	w.keepWatch(name)
+	return true, nil
+}
+
+// resetDeferred forgets all deferred paths, for Close.
+func (w *Watcher) resetDeferred() {
+	d := &w.pipeline.deferred
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.targets, d.owned, d.follow, d.flags = nil, nil, nil, nil
+
+	r := &w.internal
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refs = nil
+}
+
+// deferredEvents returns the events to send for e: events for ancestors that
+// are only watched for deferred paths are dropped, and a Create event is added
+// for every deferred path that was found to exist.
+func (w *Watcher) deferredEvents(e Event) []Event {
+	d := &w.pipeline.deferred
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The targets are normalized with SetPathNormalizer, but the name of a
+	// file in a watched directory is as the kernel reports it, which can be
+	// in a different case or Unicode form.
+	name, dir := w.cleanPath(e.Name), w.cleanPath(filepath.Dir(e.Name))
+
+	var events []Event
+	send := d.owned[dir] == 0 && d.owned[name] == 0
+	if send {
+		events = append(events, e)
+	}
+	if len(d.targets) == 0 && len(d.follow) == 0 {
+		return events
+	}
+
+	var update []string
+	switch {
+	case e.Op&Create == Create:
+		// A directory on the way to the target, or the target itself.
+		for target, anc := range d.targets {
+			if anc == dir && (target == name || strings.HasPrefix(target, name+string(filepath.Separator))) {
+				update = append(update, target)
+			}
+		}
+	case e.Op&(Remove|Rename) != 0:
+		// If it's an ancestor, watch its parent instead.
+		for target, anc := range d.targets {
+			if anc == name {
+				update = append(update, target)
+			}
+		}
+		for _, target := range update {
+			delete(d.targets, target)
+		}
+		if d.owned[name] > 0 {
+			delete(d.owned, name)
+			w.releaseWatch(name)
+		}
+
+		// Replaced or moved away; wait for a new file at the same path. The
+		// watch may still be on the old file if it was renamed.
+		if d.follow[name] {
+			w.removeDeferredWatch(name)
+			update = append(update, name)
+		}
+	}
+
+	for _, target := range update {
+		exists, err := w.watchAncestor(target)
+		if err != nil || !exists {
+			continue
+		}
+		if err := w.addDeferredWatch(target, true); err != nil {
+			w.logf("can't re-arm watch for %s: %s", target, err)
+			continue
+		}
+		w.logf("re-armed watch for %s", target)
+		if target == name && e.Op&Create == Create {
+			if !send {
+				e.Name = target
+				events = append(events, e)
+			}
+		} else if target == name && w.opts.replaceWrite {
+			// Replaced before the event for the old file was read; e is
+			// always the first event if it's sent.
+			if send {
+				events = events[1:]
+			}
+			events = append(events, Event{Name: target, Op: Write, Seq: e.Seq, Watched: true})
+		} else {
+			events = append(events, Event{Name: target, Op: Create, Seq: e.Seq, Watched: true})
+		}
+	}
+	return events
+}
+
+// watchAncestor watches the nearest existing ancestor of target, or stops
+// watching for target if it exists, in which case it returns true.
+//
+// The caller must hold d.mu.
+func (w *Watcher) watchAncestor(target string) (bool, error) {
+	for {
+		dir, err := existingAncestor(target)
+		if err != nil {
+			w.releaseAncestor(target)
+			return false, err
+		}
+		if dir == target {
+			w.releaseAncestor(target)
+			return true, nil
+		}
+		if err := w.setAncestor(target, dir); err != nil {
+			return false, err
+		}
+
+		// The next directory may have been created before the watch was
+		// added, in which case there won't be an event for it.
+		rel, err := filepath.Rel(dir, target)
+		if err != nil {
+			return false, nil
+		}
+		next := filepath.Join(dir, strings.SplitN(rel, string(filepath.Separator), 2)[0])
+		if _, err := os.Lstat(next); err != nil {
+			return false, nil
+		}
+	}
+}
+
+// setAncestor watches dir for target.
+//
+// The caller must hold d.mu.
+func (w *Watcher) setAncestor(target, dir string) error {
+	d := &w.pipeline.deferred
+	old, ok := d.targets[target]
+	if ok && old == dir {
+		return nil
+	}
+
+	if d.owned[dir] > 0 {
+		d.owned[dir]++
+	} else if held, err := w.holdWatch(dir); err != nil {
+		return err
+	} else if held {
+		if d.owned == nil {
+			d.owned = make(map[string]int)
+		}
+		d.owned[dir] = 1
+	}
+
+	if d.targets == nil {
+		d.targets = make(map[string]string)
+	}
+	if ok {
+		w.releaseAncestor(target)
+	}
+	d.targets[target] = dir
+	return nil
+}
+
+// releaseAncestor stops waiting for target, and removes the watch on its
+// ancestor if it's no longer needed.
+//
+// The caller must hold d.mu.
+func (w *Watcher) releaseAncestor(target string) {
+	d := &w.pipeline.deferred
+	anc, ok := d.targets[target]
+	if !ok {
+		return
+	}
+	delete(d.targets, target)
+	if d.owned[anc] == 0 {
+		return
+	}
+	d.owned[anc]--
+	if d.owned[anc] == 0 {
+		delete(d.owned, anc)
+		w.releaseWatch(anc)
+	}
+}
+
+// internalWatches counts the owners of the watches that are added for
+// WithDeferredCreate and WithFollowSymlinks rather than by the user. Both can
+// need the same path, such as a directory that's the ancestor of a deferred
+// path as well as the target of a symlink, so the watch is only removed once
+// neither needs it anymore.
+type internalWatches struct {
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+// holdWatch watches name for WithDeferredCreate or WithFollowSymlinks, or
+// counts another owner if it's already watched for them. It returns false if
+// the user watches name, in which case it's left alone.
+func (w *Watcher) holdWatch(name string) (bool, error) {
+	r := &w.internal
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs[name] == 0 {
+		if w.isUserWatch(name) {
+			return false, nil
+		}
+		if err := w.addDeferredWatch(name, false); err != nil {
+			return false, err
+		}
+		if r.refs == nil {
+			r.refs = make(map[string]int)
+		}
+	}
+	r.refs[name]++
+	return true, nil
+}
+
+// keepWatch takes over the user's watch on name, when it's removed by the
+// user but still needed.
+func (w *Watcher) keepWatch(name string) {
+	r := &w.internal
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs == nil {
+		r.refs = make(map[string]int)
+	}
+	r.refs[name]++
+}
+
+// releaseWatch is called by an owner of the watch on name that no longer needs
+// it; the watch is removed once all of them released it.
+func (w *Watcher) releaseWatch(name string) {
+	r := &w.internal
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs[name] == 0 {
+		return
+	}
+	r.refs[name]--
+	if r.refs[name] == 0 {
+		delete(r.refs, name)
+		w.removeDeferredWatch(name)
+	}
+}
+
+// claimWatch is called when the user adds name, so that the watch on it is no
+// longer removed by releaseWatch.
+func (w *Watcher) claimWatch(name string) {
+	r := &w.internal
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.refs, name)
+}
+
+// heldWatch reports if name is only watched for WithDeferredCreate or
+// WithFollowSymlinks.
+func (w *Watcher) heldWatch(name string) bool {
+	r := &w.internal
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refs[name] > 0
+}
+
+// existingAncestor returns name if it exists, or else the nearest parent
+// directory that exists.
+func existingAncestor(name string) (string, error) {
+	for {
+		_, err := os.Lstat(name)
+		if err == nil {
+			return name, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(name)
+		if parent == name {
+			return "", err
+		}
+		name = parent
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || solaris || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd solaris windows
+
+package fsnotify
+
+import "sync/atomic"
+
+// CloseAndDrain closes the watcher like Close, and returns all events that
+// were already read from the kernel but not yet received from the Events
+// channel, so they can still be processed before exiting. Use WithBufferSize
+// to have events buffered while they're not being received.
+//
+// Unlike with Close, where events that were read but couldn't be sent yet are
+// discarded, every event that was read from the kernel before the watcher
+// stopped is returned, regardless of the backpressure policy. Changes that the
+// kernel hadn't reported yet when the watcher stopped are lost.
+//
+// Errors that are sent on the Errors channel while closing are returned along
+// with any error from Close. This must not be called while other goroutines
+// are receiving from Events or Errors.
+func (w *Watcher) CloseAndDrain() ([]Event, error) {
+	atomic.StoreInt32(&w.draining, 1)
+	closeErr := make(chan error, 1)
+	go func() { closeErr <- w.Close() }()
+
+	var (
+		events  []Event
+		errs    multiError
+		evs, es = w.Events, w.Errors
+	)
+	for evs != nil || es != nil {
+		select {
+		case e, ok := <-evs:
+			if !ok {
+				evs = nil
+				continue
+			}
+			events = append(events, e)
+		case err, ok := <-es:
+			if !ok {
+				es = nil
+				continue
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	if err := <-closeErr; err != nil {
+		errs = append([]error{err}, errs...)
+	}
+	switch len(errs) {
+	case 0:
+		return events, nil
+	case 1:
+		return events, errs[0]
+	default:
+		return events, errs
+	}
+}
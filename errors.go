@@ -0,0 +1,106 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Common errors that can be reported by a watcher
+var (
+	ErrNonExistentWatch = errors.New("fsnotify: can't remove non-existent watcher")
+	ErrEventOverflow    = errors.New("fsnotify: queue overflow")
+	ErrEventDropped     = errors.New("fsnotify: event dropped")
+	ErrClosed           = errors.New("fsnotify: watcher already closed")
+	ErrTooManyWatches   = errors.New("fsnotify: too many watches")
+
+	// ErrMaxWatchesExceeded is returned by Add if adding the watch would go
+	// over the limit set with WithMaxWatches or Watcher.SetMaxWatches; a
+	// limit of 0 or less means there is no limit. It wraps
+	// ErrTooManyWatches, so errors.Is(err, ErrTooManyWatches) is still true
+	// for it. When a limit of the operating system is reached the error
+	// from the system call is returned instead, such as ENOSPC from
+	// inotify_add_watch or EMFILE from open.
+	ErrMaxWatchesExceeded = fmt.Errorf("%w: limit exceeded", ErrTooManyWatches)
+
+	// ErrPathTooLong is returned by Add if a single component of the path
+	// is longer than the platform allows. Paths that are longer than
+	// PATH_MAX are supported on Linux, BSD, and macOS as long as every
+	// component fits.
+	ErrPathTooLong = errors.New("fsnotify: path too long")
+
+	// ErrWatchLost is sent on the Errors channel with WithWatchLost, in a
+	// WatchError for the path, when the watch on a path that was passed to
+	// Add is removed because the path was removed or renamed. It has to be
+	// added again to watch it.
+	ErrWatchLost = errors.New("fsnotify: watch lost")
+
+	// ErrUnsupported is returned by NewWatcher if the platform isn't
+	// supported, or the operating system was built without support for
+	// file notifications; on those platforms the other methods of Watcher
+	// that can fail return it as well. It's also returned by AddWith for
+	// options that aren't supported on the platform.
+	ErrUnsupported = errors.New("fsnotify: not supported")
+)
+
+// WatchError records an error for a specific path that's sent on the Errors
+// channel, such as a directory that couldn't be read to find new files, or a
+// file in a watched directory that couldn't be watched.
+type WatchError struct {
+	Op   string // Operation that failed, such as "readdir" or "kevent".
+	Path string
+	Err  error
+}
+
+func (e *WatchError) Error() string {
+	if pathErr, ok := e.Err.(*os.PathError); ok && pathErr.Op == e.Op && pathErr.Path == e.Path {
+		// Already has the op and path.
+		return "fsnotify: " + pathErr.Error()
+	}
+	return "fsnotify: " + e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error, so that errors.Is and errors.As can be
+// used.
+func (e *WatchError) Unwrap() error { return e.Err }
+
+// watchError returns a *WatchError for err. If err is an *os.PathError then
+// its Op and Path are used instead of op and path. err is kept as-is, so
+// errors.As still finds the *os.PathError.
+func watchError(op, path string, err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		op, path = pathErr.Op, pathErr.Path
+	}
+	return &WatchError{Op: op, Path: path, Err: err}
+}
+
+// multiError combines several errors in to one.
+type multiError []error
+
+func (e multiError) Error() string {
+	s := make([]string, 0, len(e))
+	for _, err := range e {
+		s = append(s, err.Error())
+	}
+	return strings.Join(s, "\n")
+}
+
+// Unwrap is used by errors.Is and errors.As on Go 1.20 and newer.
+func (e multiError) Unwrap() []error { return e }
+
+// Is reports if any of the errors matches target; this is needed for Go 1.19
+// and older, which don't know about Unwrap() []error.
+func (e multiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fsnotify
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Interface is the part of Watcher that FakeWatcher implements as well, so
+// that code that handles events can be tested with a FakeWatcher.
+//
+// The Events and Errors channels are fields, and can't be part of an
+// interface; use Next to receive from them, or pass the channels separately.
+type Interface interface {
+	Add(name string) error
+	Remove(name string) error
+	Close() error
+	WatchList() []string
+	IsWatching(name string) bool
+	Next(ctx context.Context) (Event, error)
+}
+
+var (
+	_ Interface = (*Watcher)(nil)
+	_ Interface = (*FakeWatcher)(nil)
+)
+
+// FakeWatcher is a Watcher that doesn't watch anything: the events and errors
+// are sent with Inject and InjectError. It keeps track of the paths that are
+// added, but never reads the filesystem.
+type FakeWatcher struct {
+	// Events sends the events passed to Inject.
+	Events chan Event
+
+	// Errors sends the errors passed to InjectError.
+	Errors chan error
+
+	mu      sync.Mutex
+	watches map[string]struct{}
+	closed  bool
+	done    chan struct{}
+	senders sync.WaitGroup // Calls to Inject and InjectError in progress.
+}
+
+// NewFakeWatcher creates a new FakeWatcher. The Events and Errors channels
+// are unbuffered, as with NewWatcher.
+func NewFakeWatcher() *FakeWatcher {
+	return &FakeWatcher{
+		Events:  make(chan Event),
+		Errors:  make(chan error),
+		watches: make(map[string]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Inject sends e on the Events channel. It blocks until e is received, and
+// returns ErrClosed if the FakeWatcher is closed first.
+func (w *FakeWatcher) Inject(e Event) error {
+	if !w.startSend() {
+		return ErrClosed
+	}
+	defer w.senders.Done()
+	select {
+	case w.Events <- e:
+		return nil
+	case <-w.done:
+		return ErrClosed
+	}
+}
+
+// InjectError sends err on the Errors channel. It blocks until err is
+// received, and returns ErrClosed if the FakeWatcher is closed first.
+func (w *FakeWatcher) InjectError(err error) error {
+	if !w.startSend() {
+		return ErrClosed
+	}
+	defer w.senders.Done()
+	select {
+	case w.Errors <- err:
+		return nil
+	case <-w.done:
+		return ErrClosed
+	}
+}
+
+// startSend registers a call to Inject or InjectError, so that Close doesn't
+// close the channels while it's sending. It returns false if the FakeWatcher
+// is closed.
+func (w *FakeWatcher) startSend() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	w.senders.Add(1)
+	return true
+}
+
+// Add records name as watched.
+func (w *FakeWatcher) Add(name string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	w.watches[filepath.Clean(name)] = struct{}{}
+	return nil
+}
+
+// Remove forgets name. The error is ErrNonExistentWatch if it wasn't added.
+func (w *FakeWatcher) Remove(name string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	name = filepath.Clean(name)
+	if _, ok := w.watches[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	delete(w.watches, name)
+	return nil
+}
+
+// Close stops any calls to Inject and InjectError that are waiting, and closes
+// the Events and Errors channels.
+func (w *FakeWatcher) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	w.mu.Unlock()
+
+	w.senders.Wait()
+	close(w.Events)
+	close(w.Errors)
+	return nil
+}
+
+// WatchList returns the paths that were added and not removed, sorted.
+//
+// Returns nil if the FakeWatcher is closed.
+func (w *FakeWatcher) WatchList() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	list := make([]string, 0, len(w.watches))
+	for name := range w.watches {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// IsWatching reports if name was added and not removed.
+//
+// Returns false if the FakeWatcher is closed.
+func (w *FakeWatcher) IsWatching(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	_, ok := w.watches[filepath.Clean(name)]
+	return ok
+}
+
+// Next waits for the next event, as with Watcher.Next.
+func (w *FakeWatcher) Next(ctx context.Context) (Event, error) {
+	return next(ctx, w.Events, w.Errors)
+}
+
+// next does the work for Watcher.Next and FakeWatcher.Next.
+func next(ctx context.Context, events <-chan Event, errs <-chan error) (Event, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return Event{}, ctx.Err()
+		case e, ok := <-events:
+			if !ok {
+				return Event{}, ErrClosed
+			}
+			return e, nil
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			return Event{}, err
+		}
+	}
+}
@@ -2,15 +2,11 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build !plan9
-// +build !plan9
-
 // Package fsnotify provides a platform-independent interface for file system notifications.
 package fsnotify
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 )
 
@@ -18,9 +14,81 @@ import (
 type Event struct {
 	Name string // Relative path to the file or directory.
 	Op   Op     // File operation that triggered the event.
+
+	// Size of the file after a Write. This is only set if the Watcher was
+	// created with WithSizeTracking, and is always 0 for directories and for
+	// files that could not be stat'd.
+	Size int64
+
+	// Truncated is set on a Write if the file is smaller than at the previous
+	// Write, or if it's empty and there was no previous Write, as happens
+	// when a log file is rotated with copytruncate. This is only set if the
+	// Watcher was created with WithSizeTracking.
+	Truncated bool
+
+	// Cookie links the MovedFrom and MovedTo events of a single rename. This
+	// is only set on Linux, and only if the Watcher was created with
+	// WithMoveEvents.
+	Cookie uint32
+
+	// RawOp is the platform-specific mask the event was created from: the
+	// inotify mask on Linux, the kevent fflags on BSD and macOS, and the
+	// inotify-style mask the Windows backend translates actions to.
+	//
+	// This is not portable and mostly useful for debugging. It's 0 for
+	// events that fsnotify synthesizes, such as the Create events on kqueue.
+	RawOp uint32
+
+	// Attr describes which attributes changed for a Chmod event. This is
+	// only set on Linux, BSD, and macOS, and only if the Watcher was created
+	// with WithAttrDetail.
+	Attr Attr
+
+	// Ino and Dev are the inode and device number of the file at Name when
+	// the event was read, to tell if two paths are the same file. They're
+	// only set on Linux, BSD, and macOS, and only if the Watcher was created
+	// with WithFileID. They're 0 if the file no longer exists.
+	Ino uint64
+	Dev uint64
+
+	// OldName is the path a file was moved from, for a Move event. It's only
+	// set on the events received from Coalesce.
+	OldName string
+
+	// Seq numbers the events in the order the Watcher read the changes
+	// they're for, starting at 1. Events that are created from the same
+	// change, such as with WithFollowReplace, have the same Seq.
+	//
+	// Events are sent in order of Seq, except for the events held back by
+	// WithAtomicSaveDetection and those from WithInitialScan. With kqueue a
+	// change to a directory is only reported as a whole; the Create events
+	// for the new files in it are sent in the order the files were created,
+	// as far as that can be told from their change time. Seq is 0 on the
+	// events from FakeWatcher.
+	Seq uint64
+
+	// Watched is set if Name is a path that was passed to Add, and not set if
+	// it's a file or directory in a watched directory. If both are watched,
+	// some platforms send the event twice, once with Watched set.
+	Watched bool
+
+	// DirEntries is the number of entries in the directory the file is in,
+	// as read to find the change. This is only set with kqueue, where a
+	// watched directory is read to find new files: on Create events, and on
+	// Remove events with WithDirOnly. It's 0 for the other events, which
+	// can't be told apart from a Remove that left the directory empty.
+	DirEntries int
 }
 
 // Op describes a set of file operations.
+//
+// An Event can have more than one Op set when the platform reports several
+// changes at once. With kqueue a single notification has all the changes to a
+// file since it was last read, such as a Write and a Chmod, and all of them are
+// kept in the same Event. The exception is a directory that no longer exists,
+// which is only reported as Remove (and Rename, if it was renamed first). On
+// Linux and Windows every change is a separate event, other than the ops that
+// are added by options such as MovedFrom.
 type Op uint32
 
 // These are the generalized file operations that can trigger a notification.
@@ -30,6 +98,36 @@ const (
 	Remove
 	Rename
 	Chmod
+
+	// CloseWrite is sent when a file that was opened for writing is closed.
+	// This is only supported on Linux, and only sent if the Watcher was
+	// created with WithCloseWrite.
+	CloseWrite
+
+	// Open and Access are sent when a file is opened or read. These are
+	// only supported on Linux, and only sent if the Watcher was created with
+	// WithAccessEvents.
+	Open
+	Access
+
+	// MovedFrom and MovedTo are sent in addition to Rename and Create
+	// respectively if a file was moved out of or in to a watched directory,
+	// but only if the Watcher was created with WithMoveEvents.
+	//
+	// MovedTo isn't sent with kqueue, as it's impossible to tell a moved
+	// file apart from a newly created one there.
+	MovedFrom
+	MovedTo
+
+	// RootRemoved is sent in addition to Remove or Rename if the path that
+	// was passed to Add no longer exists, but only if the Watcher was
+	// created with WithRootRemoved.
+	RootRemoved
+
+	// Move is sent instead of a Rename and a Create that are the same file
+	// being moved from OldName to Name, but only on the channel returned by
+	// Coalesce.
+	Move
 )
 
 func (op Op) String() string {
@@ -51,20 +149,85 @@ func (op Op) String() string {
 	if op&Chmod == Chmod {
 		buffer.WriteString("|CHMOD")
 	}
+	if op&CloseWrite == CloseWrite {
+		buffer.WriteString("|CLOSE_WRITE")
+	}
+	if op&Open == Open {
+		buffer.WriteString("|OPEN")
+	}
+	if op&Access == Access {
+		buffer.WriteString("|ACCESS")
+	}
+	if op&MovedFrom == MovedFrom {
+		buffer.WriteString("|MOVED_FROM")
+	}
+	if op&MovedTo == MovedTo {
+		buffer.WriteString("|MOVED_TO")
+	}
+	if op&RootRemoved == RootRemoved {
+		buffer.WriteString("|ROOT_REMOVED")
+	}
+	if op&Move == Move {
+		buffer.WriteString("|MOVE")
+	}
 	if buffer.Len() == 0 {
 		return ""
 	}
 	return buffer.String()[1:] // Strip leading pipe
 }
 
+// MemStats describes the size of the state a Watcher keeps for the watched
+// files, as returned by Watcher.MemStats. This grows with the number of files,
+// so it can be used to monitor very large watch sets.
+type MemStats struct {
+	Watches int // Watches, as returned by Count.
+	Paths   int // Watched paths the events are looked up by.
+	Files   int // Files in watched directories known to exist; only with kqueue.
+	Sizes   int // File sizes kept for WithSizeTracking.
+	Attrs   int // File attributes kept for WithAttrDetail; not on Windows.
+}
+
+// Attr describes a set of attribute changes.
+type Attr uint8
+
+// These are the attribute changes reported in Event.Attr.
+const (
+	AttrMode  Attr = 1 << iota // Permission bits or file type.
+	AttrOwner                  // Owner or group.
+	AttrTimes                  // Modification time.
+
+	// AttrOther is any other attribute change, such as extended attributes
+	// or the link count, or a change that couldn't be determined because the
+	// file couldn't be stat'd.
+	AttrOther
+)
+
+func (a Attr) String() string {
+	var buffer bytes.Buffer
+
+	if a&AttrMode == AttrMode {
+		buffer.WriteString("|MODE")
+	}
+	if a&AttrOwner == AttrOwner {
+		buffer.WriteString("|OWNER")
+	}
+	if a&AttrTimes == AttrTimes {
+		buffer.WriteString("|TIMES")
+	}
+	if a&AttrOther == AttrOther {
+		buffer.WriteString("|OTHER")
+	}
+	if buffer.Len() == 0 {
+		return ""
+	}
+	return buffer.String()[1:]
+}
+
 // String returns a string representation of the event in the form
 // "file: REMOVE|WRITE|..."
 func (e Event) String() string {
+	if e.OldName != "" {
+		return fmt.Sprintf("%q: %s from %q", e.Name, e.Op.String(), e.OldName)
+	}
 	return fmt.Sprintf("%q: %s", e.Name, e.Op.String())
 }
-
-// Common errors that can be reported by a watcher
-var (
-	ErrNonExistentWatch = errors.New("fsnotify: can't remove non-existent watcher")
-	ErrEventOverflow    = errors.New("fsnotify: queue overflow")
-)
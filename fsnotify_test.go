@@ -8,6 +8,9 @@
 package fsnotify
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"testing"
 	"time"
@@ -15,10 +18,13 @@ import (
 
 func TestEventStringWithValue(t *testing.T) {
 	for opMask, expectedString := range map[Op]string{
-		Chmod | Create: `"/usr/someFile": CREATE|CHMOD`,
-		Rename:         `"/usr/someFile": RENAME`,
-		Remove:         `"/usr/someFile": REMOVE`,
-		Write | Chmod:  `"/usr/someFile": WRITE|CHMOD`,
+		Chmod | Create:     `"/usr/someFile": CREATE|CHMOD`,
+		Rename:             `"/usr/someFile": RENAME`,
+		Remove:             `"/usr/someFile": REMOVE`,
+		Write | Chmod:      `"/usr/someFile": WRITE|CHMOD`,
+		CloseWrite:         `"/usr/someFile": CLOSE_WRITE`,
+		Open | Access:      `"/usr/someFile": OPEN|ACCESS`,
+		Rename | MovedFrom: `"/usr/someFile": RENAME|MOVED_FROM`,
 	} {
 		event := Event{Name: "/usr/someFile", Op: opMask}
 		if event.String() != expectedString {
@@ -28,6 +34,13 @@ func TestEventStringWithValue(t *testing.T) {
 	}
 }
 
+func TestEventStringWithOldName(t *testing.T) {
+	event := Event{Name: "/usr/new", OldName: "/usr/old", Op: Move}
+	if have, want := event.String(), `"/usr/new": MOVE from "/usr/old"`; have != want {
+		t.Fatalf("Expected %s, got: %v", want, have)
+	}
+}
+
 func TestEventOpStringWithValue(t *testing.T) {
 	expectedOpString := "WRITE|CHMOD"
 	event := Event{Name: "someFile", Op: Write | Chmod}
@@ -44,28 +57,90 @@ func TestEventOpStringWithNoValue(t *testing.T) {
 	}
 }
 
-// TestWatcherClose tests that the goroutine started by creating the watcher can be
-// signalled to return at any time, even if there is no goroutine listening on the events
-// or errors channels.
-func TestWatcherClose(t *testing.T) {
-	t.Parallel()
+func TestAttrString(t *testing.T) {
+	for attr, want := range map[Attr]string{
+		0:                     "",
+		AttrMode:              "MODE",
+		AttrOwner | AttrTimes: "OWNER|TIMES",
+		AttrOther:             "OTHER",
+	} {
+		if have := attr.String(); have != want {
+			t.Errorf("Attr(%d): have %q, want %q", attr, have, want)
+		}
+	}
+}
 
-	name := tempMkFile(t, "")
-	w := newWatcher(t)
-	err := w.Add(name)
-	if err != nil {
-		t.Fatal(err)
+func TestWatchError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{os.ErrPermission, "fsnotify: readdir /dir: permission denied"},
+		{&os.PathError{Op: "open", Path: "/dir/file", Err: os.ErrPermission}, "fsnotify: open /dir/file: permission denied"},
+		{fmt.Errorf("%w: %s", ErrTooManyWatches, "/dir"), "fsnotify: readdir /dir: fsnotify: too many watches: /dir"},
 	}
+	for _, tt := range tests {
+		err := watchError("readdir", "/dir", tt.err)
+		if have := err.Error(); have != tt.want {
+			t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+		}
+		var watchErr *WatchError
+		if !errors.As(err, &watchErr) {
+			t.Errorf("not a *WatchError: %#v", err)
+		}
+		if !errors.Is(err, os.ErrPermission) && !errors.Is(err, ErrTooManyWatches) {
+			t.Errorf("underlying error is lost: %#v", err)
+		}
+		if errors.Unwrap(err) != tt.err {
+			t.Errorf("Err isn't the original error: %#v", errors.Unwrap(err))
+		}
+	}
+}
 
-	err = os.Remove(name)
-	if err != nil {
+func TestFakeWatcher(t *testing.T) {
+	w := NewFakeWatcher()
+
+	if err := w.Add("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add("/b/"); err != nil {
 		t.Fatal(err)
 	}
-	// Allow the watcher to receive the event.
-	time.Sleep(time.Millisecond * 100)
+	if err := w.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Remove("/a"); !errors.Is(err, ErrNonExistentWatch) {
+		t.Errorf("Remove: have %v, want ErrNonExistentWatch", err)
+	}
+	if have := fmt.Sprint(w.WatchList()); have != "[/b]" {
+		t.Errorf("WatchList: have %s, want [/b]", have)
+	}
+	if !w.IsWatching("/b/") || w.IsWatching("/a") {
+		t.Errorf("IsWatching: have %t for /b and %t for /a", w.IsWatching("/b/"), w.IsWatching("/a"))
+	}
+
+	go func() {
+		w.Inject(Event{Name: "/b/file", Op: Create})
+		w.InjectError(ErrEventOverflow)
+	}()
+	ctx := context.Background()
+	if e, err := w.Next(ctx); err != nil || e.Name != "/b/file" || e.Op != Create {
+		t.Errorf("Next: have %s, %v", e, err)
+	}
+	if _, err := w.Next(ctx); err != ErrEventOverflow {
+		t.Errorf("Next: have %v, want ErrEventOverflow", err)
+	}
 
-	err = w.Close()
-	if err != nil {
+	done := make(chan error)
+	go func() { done <- w.Inject(Event{Name: "/b/file", Op: Write}) }()
+	time.Sleep(10 * time.Millisecond)
+	if err := w.Close(); err != nil {
 		t.Fatal(err)
 	}
+	if err := <-done; err != ErrClosed {
+		t.Errorf("Inject after Close: have %v, want ErrClosed", err)
+	}
+	if _, err := w.Next(ctx); err != ErrClosed {
+		t.Errorf("Next after Close: have %v, want ErrClosed", err)
+	}
 }
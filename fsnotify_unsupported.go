@@ -8,16 +8,29 @@
 package fsnotify
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"runtime"
+	"time"
 )
 
 // Watcher watches a set of files, delivering events to a channel.
 type Watcher struct{}
 
 // NewWatcher establishes a new watcher with the underlying OS and begins waiting for events.
-func NewWatcher() (*Watcher, error) {
-	return nil, fmt.Errorf("fsnotify not supported on %s", runtime.GOOS)
+func NewWatcher(opts ...Option) (*Watcher, error) {
+	return nil, fmt.Errorf("%w on %s", ErrUnsupported, runtime.GOOS)
+}
+
+// Closed reports if Close was called.
+func (w *Watcher) Closed() bool {
+	return false
+}
+
+// Done returns a channel that's closed once the watcher has fully stopped.
+func (w *Watcher) Done() <-chan struct{} {
+	return nil
 }
 
 // Close removes all watches and closes the events channel.
@@ -27,10 +40,127 @@ func (w *Watcher) Close() error {
 
 // Add starts watching the named file or directory (non-recursively).
 func (w *Watcher) Add(name string) error {
-	return nil
+	return fmt.Errorf("%w: Add: %s", ErrUnsupported, name)
+}
+
+// AddWith is like Add, but with options for this watch.
+func (w *Watcher) AddWith(name string, opts ...AddOption) error {
+	return w.Add(name)
+}
+
+// AddAll starts watching all the named files or directories
+// (non-recursively).
+func (w *Watcher) AddAll(names []string) []error {
+	errs := make([]error, len(names))
+	for i, name := range names {
+		errs[i] = w.Add(name)
+	}
+	return errs
+}
+
+// Dropped returns the number of events that were discarded because of the
+// backpressure policy or the rate limit.
+func (w *Watcher) Dropped() uint64 {
+	return 0
+}
+
+// DroppedErrors returns the number of errors that were discarded because
+// nobody received them.
+func (w *Watcher) DroppedErrors() uint64 {
+	return 0
+}
+
+// Rescan reads the watched directory name again, and sends a Create event for
+// every file in it.
+func (w *Watcher) Rescan(name string) error {
+	return fmt.Errorf("%w: Rescan: %s", ErrUnsupported, name)
+}
+
+// Pause stops sending events until Resume is called.
+func (w *Watcher) Pause() {}
+
+// SetPathNormalizer sets the function that's used instead of filepath.Clean to
+// normalize paths.
+func (w *Watcher) SetPathNormalizer(f func(string) string) {}
+
+// SetLogger sets a function that's called with diagnostic messages.
+func (w *Watcher) SetLogger(f func(format string, args ...interface{})) {}
+
+// Resume sends events again after Pause, and returns the number of events that
+// were discarded while paused.
+func (w *Watcher) Resume() int {
+	return 0
+}
+
+// Interrupted returns the number of times reading events was interrupted by a
+// signal. It's always 0 on this platform.
+func (w *Watcher) Interrupted() uint64 {
+	return 0
+}
+
+// SetMaxWatches changes the limit on the number of watches.
+func (w *Watcher) SetMaxWatches(n int) {}
+
+// SetRateLimit changes the rate limit set with WithRateLimit.
+func (w *Watcher) SetRateLimit(n uint, window time.Duration) {}
+
+// MemStats returns the size of the state kept for the watched files.
+func (w *Watcher) MemStats() MemStats {
+	return MemStats{}
+}
+
+// Backend returns the name of the mechanism the Watcher uses to watch files,
+// for diagnostics. This is "unsupported" on platforms without one.
+func (w *Watcher) Backend() string {
+	return "unsupported"
+}
+
+// Count returns the number of watches.
+func (w *Watcher) Count() int {
+	return 0
+}
+
+// WatchCount returns the number of paths that are being watched.
+func (w *Watcher) WatchCount() int {
+	return 0
 }
 
 // Remove stops watching the the named file or directory (non-recursively).
 func (w *Watcher) Remove(name string) error {
+	return fmt.Errorf("%w: Remove: %s", ErrUnsupported, name)
+}
+
+// WatchList returns the directories and files that are being monitered.
+func (w *Watcher) WatchList() []string {
 	return nil
 }
+
+// IsWatching reports if name is watched, as it would be listed by WatchList.
+func (w *Watcher) IsWatching(name string) bool {
+	return false
+}
+
+// AddFile starts watching the file or directory f, which is already open.
+func (w *Watcher) AddFile(f *os.File) error {
+	return fmt.Errorf("%w: AddFile: %s", ErrUnsupported, f.Name())
+}
+
+// Plan returns the paths that Add would watch for name.
+func (w *Watcher) Plan(name string) ([]string, error) {
+	return nil, fmt.Errorf("%w: Plan: %s", ErrUnsupported, name)
+}
+
+// Next waits for the next event.
+func (w *Watcher) Next(ctx context.Context) (Event, error) {
+	return Event{}, ErrUnsupported
+}
+
+// SetEventMapper sets the EventMapper that's used instead of the one set with
+// WithEventMapper.
+func (w *Watcher) SetEventMapper(m EventMapper) {}
+
+// DefaultEventMapper returns an Event without any Op, as there are no events
+// on this platform; see WithEventMapper.
+func DefaultEventMapper(name string, mask uint32) Event {
+	return Event{Name: name, RawOp: mask}
+}
@@ -1,3 +1,6 @@
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
 package fsnotify
 
 import (
@@ -257,10 +260,19 @@ type eventCollector struct {
 	events Events
 	mu     sync.Mutex
 	done   chan struct{}
+
+	// allowDropped ignores ErrEventDropped on the Errors channel, for tests
+	// that drop events on purpose.
+	allowDropped bool
 }
 
-func newCollector(t *testing.T) *eventCollector {
-	return &eventCollector{w: newWatcher(t), done: make(chan struct{})}
+func newCollector(t *testing.T, opts ...Option) *eventCollector {
+	t.Helper()
+	w, err := NewWatcher(opts...)
+	if err != nil {
+		t.Fatalf("newCollector: %s", err)
+	}
+	return &eventCollector{w: w, done: make(chan struct{})}
 }
 
 func (w *eventCollector) stop(t *testing.T) Events {
@@ -293,6 +305,9 @@ func (w *eventCollector) collect(t *testing.T) {
 					w.done <- struct{}{}
 					return
 				}
+				if w.allowDropped && e == ErrEventDropped {
+					continue
+				}
 				t.Error(e)
 				return
 			case e, ok := <-w.w.Events:
@@ -400,6 +415,18 @@ func newEvents(t *testing.T, s string) Events {
 					op |= Rename
 				case "CHMOD":
 					op |= Chmod
+				case "CLOSE_WRITE":
+					op |= CloseWrite
+				case "OPEN":
+					op |= Open
+				case "ACCESS":
+					op |= Access
+				case "MOVED_FROM":
+					op |= MovedFrom
+				case "MOVED_TO":
+					op |= MovedTo
+				case "ROOT_REMOVED":
+					op |= RootRemoved
 				default:
 					t.Fatalf("newEvents: line %d has unknown event %q: %s", no, ee, line)
 				}
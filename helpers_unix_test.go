@@ -0,0 +1,30 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd
+// +build darwin dragonfly freebsd openbsd linux netbsd
+
+package fsnotify
+
+import (
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// mkfifo
+func mkfifo(t *testing.T, path ...string) {
+	t.Helper()
+	if len(path) < 1 {
+		t.Fatalf("mkfifo: path must have at least one element: %s", path)
+	}
+	err := unix.Mkfifo(filepath.Join(path...), 0o600)
+	if err != nil {
+		t.Fatalf("mkfifo(%q): %s", filepath.Join(path...), err)
+	}
+	if shouldWait(path...) {
+		eventSeparator()
+	}
+}
@@ -12,9 +12,11 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -31,15 +33,36 @@ type Watcher struct {
 	paths       map[int]string    // Map of watched paths (key: watch descriptor)
 	done        chan struct{}     // Channel for sending a "quit message" to the reader goroutine
 	doneResp    chan struct{}     // Channel to respond to Close
+	opts        withOpts          // Options passed to NewWatcher
+	scans       scanQueue         // Events for WithInitialScan
+	pipeline    eventPipeline     // Options that change or drop events; see eventPipeline
+	links       followedLinks     // Symlinks for WithFollowSymlinks
+	internal    internalWatches   // Watches for WithDeferredCreate and WithFollowSymlinks
+	attrs       attrCache         // Attributes for WithAttrDetail
+	drops       dropCounter       // Events discarded by the backpressure policy
+	removed     removedPrefixes   // Directories removed with RemovePrefix
+	paused      bool              // Set by Pause; guarded by mu
+	suppressed  int               // Events discarded while paused; guarded by mu
+	draining    int32             // Set by CloseAndDrain; accessed atomically
+	errDrops    uint64            // Errors discarded for WithDropErrors; accessed atomically
+	seq         uint64            // Last Event.Seq; accessed atomically
+	onEvent     atomic.Value      // Function set with OnEvent
+	logger      atomic.Value      // Function set with SetLogger
+	normalizer  atomic.Value      // Function set with SetPathNormalizer
+	mapper      atomic.Value      // EventMapper set with SetEventMapper
 }
 
 // NewWatcher establishes a new watcher with the underlying OS and begins waiting for events.
-func NewWatcher() (*Watcher, error) {
+func NewWatcher(opts ...Option) (*Watcher, error) {
 	// Create inotify fd
 	// Need to set the FD to nonblocking mode in order for SetDeadline methods to work
 	// Otherwise, blocking i/o operations won't terminate on close
 	fd, errno := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
 	if fd == -1 {
+		if errno == unix.ENOSYS {
+			// Kernel built without CONFIG_INOTIFY_USER.
+			return nil, fmt.Errorf("%w: inotify_init1: %s", ErrUnsupported, errno)
+		}
 		return nil, errno
 	}
 
@@ -48,11 +71,12 @@ func NewWatcher() (*Watcher, error) {
 		inotifyFile: os.NewFile(uintptr(fd), ""),
 		watches:     make(map[string]*watch),
 		paths:       make(map[int]string),
-		Events:      make(chan Event),
-		Errors:      make(chan error),
 		done:        make(chan struct{}),
 		doneResp:    make(chan struct{}),
+		opts:        getOptions(opts...),
 	}
+	w.Events = make(chan Event, w.opts.eventsBuffer(0))
+	w.Errors = make(chan error, w.opts.errorsBuffer)
 
 	go w.readEvents()
 	return w, nil
@@ -67,6 +91,17 @@ func (w *Watcher) isClosed() bool {
 	}
 }
 
+// Closed reports if Close was called.
+func (w *Watcher) Closed() bool {
+	return w.isClosed()
+}
+
+// Done returns a channel that's closed once the watcher has fully stopped
+// after Close, and the Events and Errors channels are closed.
+func (w *Watcher) Done() <-chan struct{} {
+	return w.doneResp
+}
+
 // Close removes all watches and closes the events channel.
 func (w *Watcher) Close() error {
 	w.mu.Lock()
@@ -78,6 +113,9 @@ func (w *Watcher) Close() error {
 	// Send 'close' signal to goroutine, and set the Watcher to closed.
 	close(w.done)
 	w.mu.Unlock()
+	w.resetDeferred()
+	w.resetLinks()
+	w.pipeline.saves.reset()
 
 	// Causes any blocking reads to return with an error, provided the file still supports deadline operations
 	err := w.inotifyFile.Close()
@@ -92,27 +130,127 @@ func (w *Watcher) Close() error {
 }
 
 // Add starts watching the named file or directory (non-recursively).
+//
+// The watch is active in the kernel when Add returns: any change made after
+// that is reported.
 func (w *Watcher) Add(name string) error {
-	name = filepath.Clean(name)
+	return w.AddWith(name)
+}
+
+// AddWith is like Add, but with options for this watch.
+func (w *Watcher) AddWith(name string, opts ...AddOption) error {
+	var flags uint32
+	if getAddOptions(opts...).access {
+		flags |= unix.IN_OPEN | unix.IN_ACCESS
+	}
+
+	name = w.cleanPath(name)
+	return w.add(name, flags, func() error { return w.addOrDefer(name, flags) })
+}
+
+// add is the part of Add and AddFile that's the same for both: addWatch is
+// called to add the watch for name, and everything the options need for a path
+// the user added is done around it.
+func (w *Watcher) add(name string, flags uint32, addWatch func() error) error {
 	if w.isClosed() {
-		return errors.New("inotify instance already closed")
+		return ErrClosed
+	}
+	if w.opts.deferred() {
+		w.claimDeferred(name, flags)
+	}
+	w.removed.clear(name)
+	if !w.opts.initialScan {
+		return w.added(name, addWatch())
 	}
 
+	w.mu.Lock()
+	if w.isClosed() {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	scan := w.scans.add(w.deliverEvent, w.done)
+	w.mu.Unlock()
+
+	err := w.added(name, addWatch())
+	var events []Event
+	if err == nil {
+		events = initialScanEvents(name)
+	}
+	scan(events)
+	return err
+}
+
+// added records name for the options that keep track of the paths the user
+// added, if err from adding the watch for it is nil. It returns err.
+func (w *Watcher) added(name string, err error) error {
+	if err != nil {
+		return err
+	}
+	w.logAdded(name)
+	if w.opts.attrDetail {
+		w.attrs.add(name)
+	}
+	if w.opts.rootRemoved {
+		w.pipeline.roots.add(name)
+	}
+	if w.opts.childrenOnly {
+		w.pipeline.roots.addDir(name)
+	}
+	if w.opts.followLinks {
+		w.followAdded(name)
+	}
+	return nil
+}
+
+// addOrDefer adds a watch for name, or waits for it to be created with
+// WithDeferredCreate.
+func (w *Watcher) addOrDefer(name string, flags uint32) error {
+	err := w.addWatch(name, flags)
+	if w.opts.deferredCreate && errors.Is(err, os.ErrNotExist) {
+		var exists bool
+		if exists, err = w.deferWatch(name); exists {
+			err = w.addWatch(name, flags)
+		}
+	}
+	return err
+}
+
+// addWatch adds a watch for name, with the flags in addition to the ones
+// for the watcher's options.
+func (w *Watcher) addWatch(name string, flags uint32) error {
+	return w.addWatchAt(name, name, flags)
+}
+
+// addWatchAt is addWatch, with the watch added through path rather than name.
+func (w *Watcher) addWatchAt(name, path string, flags uint32) error {
 	const agnosticEvents = unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
 		unix.IN_CREATE | unix.IN_ATTRIB | unix.IN_MODIFY |
 		unix.IN_MOVE_SELF | unix.IN_DELETE | unix.IN_DELETE_SELF
 
-	var flags uint32 = agnosticEvents
+	flags |= agnosticEvents
+	if w.opts.closeWrite {
+		flags |= unix.IN_CLOSE_WRITE
+	}
+	if w.opts.access {
+		flags |= unix.IN_OPEN | unix.IN_ACCESS
+	}
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	watchEntry := w.watches[name]
 	if watchEntry != nil {
 		flags |= watchEntry.flags | unix.IN_MASK_ADD
+	} else if w.removed.has(name) {
+		return errRemovedPrefix
+	} else if w.opts.maxWatches > 0 && len(w.watches) >= w.opts.maxWatches {
+		return fmt.Errorf("%w: %s", ErrMaxWatchesExceeded, name)
+	}
+	wd, errno := unix.InotifyAddWatch(w.fd, path, flags)
+	if wd == -1 && errors.Is(errno, unix.ENAMETOOLONG) && path == name {
+		wd, errno = inotifyAddWatchLong(w.fd, name, flags)
 	}
-	wd, errno := unix.InotifyAddWatch(w.fd, name, flags)
 	if wd == -1 {
-		return errno
+		return longPathError("inotify_add_watch", name, errno)
 	}
 
 	if watchEntry == nil {
@@ -126,13 +264,126 @@ func (w *Watcher) Add(name string) error {
 	return nil
 }
 
+// inotifyAddWatchLong adds a watch for a name that's longer than PATH_MAX:
+// the parent directory is opened with openat(), and the watch is added
+// through its /proc/self/fd entry.
+func inotifyAddWatchLong(fd int, name string, flags uint32) (int, error) {
+	dirfd, base, err := openParent(name)
+	if err != nil {
+		return -1, err
+	}
+	defer unix.Close(dirfd)
+	return unix.InotifyAddWatch(fd, "/proc/self/fd/"+strconv.Itoa(dirfd)+"/"+base, flags)
+}
+
+// AddFile starts watching the file or directory f, which is already open,
+// without opening it again by its path; for example in a sandbox where the
+// path can't be opened. The events have f.Name() as the Name.
+//
+// The watch is added through the /proc/self/fd entry for f, so f can be
+// closed afterwards.
+//
+// To watch a descriptor that doesn't have a path, such as one inherited from a
+// parent process, wrap it with os.NewFile and the name the events should have.
+func (w *Watcher) AddFile(f *os.File) error {
+	name := w.cleanPath(f.Name())
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return w.add(name, 0, func() error {
+		var err error
+		if ctrlErr := rc.Control(func(fd uintptr) {
+			err = w.addWatchAt(name, "/proc/self/fd/"+strconv.Itoa(int(fd)), 0)
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	})
+}
+
+// AddAll starts watching all the named files or directories
+// (non-recursively).
+//
+// The returned slice has an error (or nil) for every name, in the same order.
+func (w *Watcher) AddAll(names []string) []error {
+	errs := make([]error, len(names))
+	for i, name := range names {
+		errs[i] = w.Add(name)
+	}
+	return errs
+}
+
 // Remove stops watching the named file or directory (non-recursively).
+//
+// The error is ErrNonExistentWatch (check with errors.Is) if name isn't
+// watched, including when it was already removed by a concurrent call to
+// Remove, so that this can be ignored during teardown.
 func (w *Watcher) Remove(name string) error {
-	name = filepath.Clean(name)
+	name = w.cleanPath(name)
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if w.opts.rootRemoved || w.opts.childrenOnly {
+		w.pipeline.roots.remove(name)
+	}
+	if w.opts.followLinks {
+		w.unfollowDir(name)
+	}
+	if w.opts.deferred() {
+		if ok, err := w.unwatchDeferred(name); ok {
+			return err
+		}
+	}
+	return w.remove(name)
+}
 
-	// Fetch the watch.
+func (w *Watcher) remove(name string) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.dropWatch(name)
+}
+
+// removePrefix is RemovePrefix: the paths added by the user are forgotten
+// first, and then every watch below dir is removed while holding w.mu, so
+// that nothing sees only some of them removed.
+func (w *Watcher) removePrefix(dir string) error {
+	var errs multiError
+	for _, name := range w.userWatchesBelow(dir) {
+		if w.opts.rootRemoved || w.opts.childrenOnly {
+			w.pipeline.roots.remove(name)
+		}
+		if w.opts.followLinks {
+			w.unfollowDir(name)
+		}
+		if w.opts.deferred() {
+			if _, err := w.unwatchDeferred(name); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	w.mu.Lock()
+	for name := range w.watches {
+		if !hasPathPrefix(name, dir) {
+			continue
+		}
+		if err := w.dropWatch(name); err != nil && !errors.Is(err, ErrNonExistentWatch) {
+			errs = append(errs, err)
+		}
+	}
+	w.mu.Unlock()
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// dropWatch removes the watch for name.
+//
+// The caller must hold w.mu.
+func (w *Watcher) dropWatch(name string) error {
 	watch, ok := w.watches[name]
 
 	// Remove it from inotify.
@@ -160,14 +411,140 @@ func (w *Watcher) Remove(name string) error {
 		// EINVAL, which is when fd is not an inotify descriptor or wd is not a valid watch descriptor.
 		// Watch descriptors are invalidated when they are removed explicitly or implicitly;
 		// explicitly by inotify_rm_watch, implicitly when the file they are watching is deleted.
-		return errno
+		if errno == unix.EINVAL {
+			// Already removed by the kernel; report it like a watch that
+			// was already removed with Remove.
+			return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+		}
+		return &os.PathError{Op: "inotify_rm_watch", Path: name, Err: errno}
 	}
 
 	return nil
 }
 
+// addDeferredWatch, removeDeferredWatch, and isUserWatch manage the watches
+// for WithDeferredCreate; see deferredWatches.
+//
+// A target is watched with the flags it was added with; the caller holds
+// d.mu.
+func (w *Watcher) addDeferredWatch(name string, target bool) error {
+	var flags uint32
+	if target {
+		flags = w.pipeline.deferred.flags[name]
+	}
+	return w.addWatch(name, flags)
+}
+
+func (w *Watcher) removeDeferredWatch(name string) { w.remove(name) }
+
+func (w *Watcher) isUserWatch(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.watches[name]
+	return ok
+}
+
+// Rescan reads the watched directory name again, and sends a Create event for
+// every file in it. inotify doesn't keep track of the files, so there's no way
+// to tell which ones are new, or to send Remove events for the ones that are
+// gone. This can be used to get back in sync after ErrEventOverflow. It does
+// nothing for a watched file.
+//
+// The events are sent before any events that are read after Rescan returns.
+// The error is ErrNonExistentWatch if name isn't watched.
+func (w *Watcher) Rescan(name string) error {
+	name = w.cleanPath(name)
+	w.mu.Lock()
+	if w.isClosed() {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	if _, ok := w.watches[name]; !ok {
+		w.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	scan := w.scans.add(w.deliverEvent, w.done)
+	w.mu.Unlock()
+
+	w.logf("rescanning directory %s", name)
+	scan(initialScanEvents(name))
+	return nil
+}
+
+// Dropped returns the number of events that were discarded because of the
+// backpressure policy or the rate limit; see WithBackpressure and
+// WithRateLimit.
+func (w *Watcher) Dropped() uint64 {
+	return w.drops.count()
+}
+
+// DroppedErrors returns the number of errors that were discarded because
+// nobody received them; see WithDropErrors.
+func (w *Watcher) DroppedErrors() uint64 {
+	return atomic.LoadUint64(&w.errDrops)
+}
+
+// Interrupted returns the number of times reading events was interrupted by a
+// signal. This is always 0 with inotify: the inotify descriptor is read through
+// the runtime's poller, which retries a read that's interrupted.
+func (w *Watcher) Interrupted() uint64 {
+	return 0
+}
+
+// Backend returns the name of the mechanism the Watcher uses to watch files,
+// for diagnostics: "inotify" on this platform.
+func (w *Watcher) Backend() string {
+	return "inotify"
+}
+
+// Count returns the number of watches.
+func (w *Watcher) Count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.watches)
+}
+
+// MemStats returns the size of the state kept for the watched files. Paths is
+// the same as Watches, and Files is always 0, as inotify watches a directory
+// as a whole.
+func (w *Watcher) MemStats() MemStats {
+	w.mu.Lock()
+	s := MemStats{Watches: len(w.watches), Paths: len(w.paths)}
+	w.mu.Unlock()
+	s.Sizes = w.pipeline.sizes.len()
+	s.Attrs = w.attrs.len()
+	return s
+}
+
+// SetMaxWatches changes the limit on the number of watches set with
+// WithMaxWatches; n <= 0 removes the limit. Watches that are already there
+// are kept if there are more than n, but adding more fails with
+// ErrMaxWatchesExceeded until there are fewer.
+func (w *Watcher) SetMaxWatches(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.opts.maxWatches = n
+}
+
+// WatchCount returns the number of paths that WatchList would return, without
+// allocating the list.
+//
+// Returns 0 if the watcher is closed.
+func (w *Watcher) WatchCount() int {
+	if w.isClosed() {
+		return 0
+	}
+	return w.Count()
+}
+
 // WatchList returns the directories and files that are being monitered.
+//
+// Returns nil if the watcher is closed.
 func (w *Watcher) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -179,6 +556,37 @@ func (w *Watcher) WatchList() []string {
 	return entries
 }
 
+// IsWatching reports if name is watched, as it would be listed by WatchList.
+// name is cleaned the same way as with Remove.
+//
+// Returns false if the watcher is closed.
+func (w *Watcher) IsWatching(name string) bool {
+	if w.isClosed() {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.watches[w.cleanPath(name)]
+	return ok
+}
+
+// Plan returns the paths that Add would watch for name, without watching
+// anything. With inotify that's only name, as a directory is watched as a
+// whole.
+//
+// The error is the one Add would return if name can't be watched.
+func (w *Watcher) Plan(name string) ([]string, error) {
+	if w.isClosed() {
+		return nil, ErrClosed
+	}
+	name = w.cleanPath(name)
+	if _, err := os.Stat(name); err != nil {
+		return nil, err
+	}
+	return []string{name}, nil
+}
+
 type watch struct {
 	wd    uint32 // Watch descriptor (as returned by the inotify_add_watch() syscall)
 	flags uint32 // inotify flags of this watch (see inotify(7) for the list of valid flags)
@@ -195,6 +603,7 @@ func (w *Watcher) readEvents() {
 	defer close(w.doneResp)
 	defer close(w.Errors)
 	defer close(w.Events)
+	defer w.scans.wg.Wait()
 
 	for {
 		// See if we have been closed.
@@ -207,9 +616,7 @@ func (w *Watcher) readEvents() {
 		case errors.Unwrap(err) == os.ErrClosed:
 			return
 		case err != nil:
-			select {
-			case w.Errors <- err:
-			case <-w.done:
+			if !w.sendError(err) {
 				return
 			}
 			continue
@@ -227,9 +634,7 @@ func (w *Watcher) readEvents() {
 				// Read was too short.
 				err = errors.New("notify: short read in readEvents()")
 			}
-			select {
-			case w.Errors <- err:
-			case <-w.done:
+			if !w.sendError(err) {
 				return
 			}
 			continue
@@ -246,9 +651,7 @@ func (w *Watcher) readEvents() {
 			nameLen := uint32(raw.Len)
 
 			if mask&unix.IN_Q_OVERFLOW != 0 {
-				select {
-				case w.Errors <- ErrEventOverflow:
-				case <-w.done:
+				if !w.sendError(ErrEventOverflow) {
 					return
 				}
 			}
@@ -259,6 +662,7 @@ func (w *Watcher) readEvents() {
 			// the "paths" map.
 			w.mu.Lock()
 			name, ok := w.paths[int(raw.Wd)]
+			dir := name
 			// IN_DELETE_SELF occurs when the file/directory being watched is removed.
 			// This is a sign to clean up the maps, otherwise we are no longer in sync
 			// with the inotify kernel state which has already deleted the watch
@@ -272,19 +676,50 @@ func (w *Watcher) readEvents() {
 			if nameLen > 0 {
 				// Point "bytes" at the first byte of the filename
 				bytes := (*[unix.PathMax]byte)(unsafe.Pointer(&buf[offset+unix.SizeofInotifyEvent]))[:nameLen:nameLen]
+				// The watched path can end with a slash with SetPathNormalizer.
+				if !strings.HasSuffix(name, "/") {
+					name += "/"
+				}
 				// The filename is padded with NULL bytes. TrimRight() gets rid of those.
-				name += "/" + strings.TrimRight(string(bytes[0:nameLen]), "\000")
+				name += strings.TrimRight(string(bytes[0:nameLen]), "\000")
 			}
 
-			event := newEvent(name, mask)
+			event := w.mapEvent(name, mask)
+			event.Watched = nameLen == 0 && !(w.opts.followLinks && w.isFollowedTarget(name))
+			ignored := mask&unix.IN_IGNORED == unix.IN_IGNORED
+			if w.opts.moveEvents {
+				if mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM {
+					event.Op |= MovedFrom
+				}
+				if mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
+					event.Op |= MovedTo
+				}
+				event.Cookie = raw.Cookie
+			}
+			if w.opts.dirOnly && nameLen > 0 {
+				event.Op &= Create | Remove | Rename | MovedFrom | MovedTo
+				ignored = ignored || event.Op == 0
+			}
+			if w.opts.sizeTracking {
+				w.pipeline.sizes.update(&event)
+			}
 
 			// Send the events that are not ignored on the events channel
-			if mask&unix.IN_IGNORED == 0 {
-				select {
-				case w.Events <- event:
-				case <-w.done:
+			if !ignored {
+				if !w.sendEvent(event) {
 					return
 				}
+				if ok && event.Watched && mask&unix.IN_DELETE_SELF == unix.IN_DELETE_SELF && w.watchLost(dir) {
+					if !w.sendError(watchError("watch", dir, ErrWatchLost)) {
+						return
+					}
+				}
+				if w.opts.dirWrites && nameLen > 0 && event.Op&(Create|Remove|Rename) != 0 {
+					watched := !(w.opts.followLinks && w.isFollowedTarget(dir))
+					if !w.sendEvent(Event{Name: dir, Op: Write, Watched: watched}) {
+						return
+					}
+				}
 			}
 
 			// Move to the next event in the buffer
@@ -293,9 +728,99 @@ func (w *Watcher) readEvents() {
 	}
 }
 
-// newEvent returns an platform-independent Event based on an inotify mask.
-func newEvent(name string, mask uint32) Event {
-	e := Event{Name: name}
+// sendEvent sends the event on the Events channel, following the backpressure
+// policy. It returns false if the watcher was closed.
+func (w *Watcher) sendEvent(e Event) bool {
+	e.Seq = atomic.AddUint64(&w.seq, 1)
+	if w.opts.attrDetail {
+		w.attrs.update(&e)
+	}
+	if w.opts.followLinks {
+		w.followEvent(e)
+	}
+	events := w.prepareEvents(e)
+	if w.opts.atomicSaves > 0 {
+		w.pipeline.saves.schedule(w.flushSaves)
+	}
+	w.scans.wait(w.done)
+	for _, e := range events {
+		if !w.deliverEvent(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// flushSaves sends the events for WithAtomicSaveDetection that waited long
+// enough, when there are no other events to send them with. They're queued
+// like the events for WithInitialScan, so that they're sent in order.
+func (w *Watcher) flushSaves() {
+	w.mu.Lock()
+	if w.isClosed() {
+		w.mu.Unlock()
+		return
+	}
+	scan := w.scans.add(w.deliverEvent, w.done)
+	w.mu.Unlock()
+
+	scan(w.pipeline.saves.expired(time.Now()))
+	w.pipeline.saves.schedule(w.flushSaves)
+}
+
+// deliverEvent is sendEvent without waiting for WithInitialScan.
+func (w *Watcher) deliverEvent(e Event) bool {
+	if e.Seq == 0 {
+		// From WithInitialScan.
+		e.Seq = atomic.AddUint64(&w.seq, 1)
+	}
+	if w.skipEvent(e) || !w.filterEvent(&e) {
+		return true
+	}
+	if w.callEvent(e) {
+		return true
+	}
+	if atomic.LoadInt32(&w.draining) == 1 {
+		// CloseAndDrain receives until Events is closed, so this can't
+		// block forever, and no event that was already read is lost.
+		w.Events <- e
+		return true
+	}
+	if w.opts.backpressure.trySend(w.Events, w.Errors, &w.drops, e) {
+		return !w.isClosed()
+	}
+	timeout, stop := sendTimer(w.opts.sendTimeout)
+	defer stop()
+	select {
+	case w.Events <- e:
+		return true
+	case <-timeout:
+		w.drops.drop(w.Errors)
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// sendError sends err on the Errors channel, or discards it with
+// WithDropErrors if it can't be sent right away. It returns false if the
+// watcher was closed.
+func (w *Watcher) sendError(err error) bool {
+	if w.opts.dropErrors {
+		trySendError(w.Errors, &w.errDrops, err)
+		return !w.isClosed()
+	}
+	select {
+	case w.Errors <- err:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// DefaultEventMapper returns a platform-independent Event based on the inotify
+// mask; see WithEventMapper.
+func DefaultEventMapper(name string, mask uint32) Event {
+	e := Event{Name: name, RawOp: mask}
 	if mask&unix.IN_CREATE == unix.IN_CREATE || mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
 		e.Op |= Create
 	}
@@ -311,5 +836,14 @@ func newEvent(name string, mask uint32) Event {
 	if mask&unix.IN_ATTRIB == unix.IN_ATTRIB {
 		e.Op |= Chmod
 	}
+	if mask&unix.IN_CLOSE_WRITE == unix.IN_CLOSE_WRITE {
+		e.Op |= CloseWrite
+	}
+	if mask&unix.IN_OPEN == unix.IN_OPEN {
+		e.Op |= Open
+	}
+	if mask&unix.IN_ACCESS == unix.IN_ACCESS {
+		e.Op |= Access
+	}
 	return e
 }
@@ -16,6 +16,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 // TODO: I'm not sure if these tests are still needed; I think they've become
@@ -501,3 +503,181 @@ func TestInotifyDeleteOpenedFile(t *testing.T) {
 	fd.Close()
 	checkEvent(Remove)
 }
+
+func TestInotifyCloseWrite(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t, WithCloseWrite())
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	cat(t, "data", tmp, "file")
+	touch(t, tmp, "file") // Truncates, so also a write.
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create       /file
+		write        /file
+		close_write  /file
+		write        /file
+		close_write  /file
+	`))
+}
+
+func TestInotifyAccess(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	cat(t, "data", file)
+
+	w := newCollector(t, WithAccessEvents())
+	w.collect(t)
+	addWatch(t, w.w, file)
+
+	if _, err := os.ReadFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		open    /file
+		access  /file
+	`))
+}
+
+func TestInotifyAddWithAccess(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	b := filepath.Join(tmp, "b")
+	cat(t, "data", a)
+	cat(t, "data", b)
+
+	w := newCollector(t)
+	w.collect(t)
+	if err := w.w.AddWith(a, WithAccess()); err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w.w, b)
+
+	for _, f := range []string{a, b} {
+		if _, err := os.ReadFile(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		open    /a
+		access  /a
+	`))
+}
+
+// The flags from AddWith are kept for a path that's watched once it's created.
+func TestInotifyAddWithAccessDeferred(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+
+	w := newCollector(t, WithDeferredCreate())
+	w.collect(t)
+	if err := w.w.AddWith(a, WithAccess()); err != nil {
+		t.Fatal(err)
+	}
+	cat(t, "data", a)
+	eventSeparator()
+	if _, err := os.ReadFile(a); err != nil {
+		t.Fatal(err)
+	}
+
+	var have Events
+	for _, e := range w.stop(t) {
+		if e.Op&(Open|Access) != 0 {
+			have = append(have, e)
+		}
+	}
+	cmpEvents(t, tmp, have, newEvents(t, `
+		open    /a
+		access  /a
+	`))
+}
+
+func TestInotifyRawOp(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t, tmp)
+	defer w.Close()
+
+	touch(t, tmp, "file")
+	select {
+	case e := <-w.Events:
+		if e.RawOp&unix.IN_CREATE != unix.IN_CREATE {
+			t.Errorf("IN_CREATE not set in RawOp: %#x", e.RawOp)
+		}
+	case err := <-w.Errors:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for create event")
+	}
+}
+
+func TestInotifyAddFileFd(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	touch(t, file, noWait)
+
+	fd, err := unix.Open(file, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fd), "fd-name")
+
+	w := newCollector(t)
+	w.collect(t)
+	err = w.w.AddFile(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cat(t, "data", file)
+	events := w.stop(t)
+	if len(events) == 0 || events[0].Name != "fd-name" || events[0].Op&Write == 0 {
+		t.Errorf("wrong events:\n%s", events)
+	}
+}
+
+// The options for the paths passed to Add apply to AddFile as well.
+func TestInotifyAddFileOptions(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "dir")
+	mkdir(t, dir, noWait)
+	touch(t, dir, "file", noWait)
+
+	f, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newCollector(t, WithInitialScan(), WithRootRemoved())
+	w.collect(t)
+	err = w.w.AddFile(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rmAll(t, dir)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create               /dir/file
+		remove               /dir/file
+		remove|root_removed  /dir
+	`))
+}
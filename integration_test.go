@@ -2,17 +2,23 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build !plan9 && !solaris
-// +build !plan9,!solaris
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
 
 package fsnotify
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -337,14 +343,14 @@ func TestWatchRm(t *testing.T) {
 			`
 				# OpenBSD, NetBSD
 				remove             /file
-				remove|write       /
+				remove             /
 				freebsd:
-					remove|write   "/"
+					remove         "/"
 					remove         ""
 					create         "."
 				darwin:
 					remove         /file
-					remove|write   /
+					remove         /
 				linux:
 					remove         /file
 					remove         /
@@ -367,6 +373,9 @@ func TestClose(t *testing.T) {
 		t.Parallel()
 
 		w := newWatcher(t)
+		if w.Closed() {
+			t.Fatal("Closed() is true before Close()")
+		}
 		if err := w.Close(); err != nil {
 			t.Fatal(err)
 		}
@@ -382,9 +391,63 @@ func TestClose(t *testing.T) {
 			t.Fatal("double Close() test failed: second Close() call didn't return")
 		}
 
-		if err := w.Add(t.TempDir()); err == nil {
-			t.Fatal("expected error on Watch() after Close(), got nil")
+		if err := w.Add(t.TempDir()); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected ErrClosed on Watch() after Close(), got: %v", err)
+		}
+		if err := w.Remove(t.TempDir()); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected ErrClosed on Remove() after Close(), got: %v", err)
+		}
+		if l := w.WatchList(); l != nil {
+			t.Fatalf("expected nil WatchList() after Close(), got: %v", l)
+		}
+		if !w.Closed() {
+			t.Fatal("Closed() is false after Close()")
+		}
+	})
+
+	t.Run("done", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t, t.TempDir())
+		select {
+		case <-w.Done():
+			t.Fatal("Done() is closed before Close()")
+		default:
+		}
+
+		go w.Close()
+		select {
+		case <-w.Done():
+		case <-time.After(time.Second):
+			t.Fatal("Done() not closed after Close()")
+		}
+		if _, ok := <-w.Events; ok {
+			t.Error("Events not closed")
 		}
+		if _, ok := <-w.Errors; ok {
+			t.Error("Errors not closed")
+		}
+
+		// The reader is blocked on sending an event that's never read.
+		t.Run("pending", func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			w := newWatcher(t, tmp)
+			for i := 0; i < 100; i++ {
+				touch(t, tmp, fmt.Sprintf("file%d", i), noWait)
+			}
+			eventSeparator()
+
+			go w.Close()
+			select {
+			case <-w.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("Done() not closed after Close() with a pending event")
+			}
+			for range w.Events {
+			}
+		})
 	})
 
 	// Make sure that Close() works even when the Events channel isn't being
@@ -470,6 +533,51 @@ func TestClose(t *testing.T) {
 	})
 }
 
+func TestWatchRemoveTree(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("watched directories can't be removed on Windows")
+	}
+	t.Parallel()
+
+	for i := 0; i < 10; i++ {
+		tmp := t.TempDir()
+		var dirs, paths []string
+		dir := tmp
+		for level := 0; level < 5; level++ {
+			dir = filepath.Join(dir, fmt.Sprintf("dir%d", level))
+			mkdir(t, dir, noWait)
+			touch(t, dir, "file", noWait)
+			dirs = append(dirs, dir)
+			paths = append(paths, dir, filepath.Join(dir, "file"))
+		}
+
+		w := newCollector(t)
+		w.collect(t)
+		addWatch(t, w.w, tmp)
+		for _, d := range dirs {
+			addWatch(t, w.w, d)
+		}
+
+		rmAll(t, tmp, "dir0")
+
+		have := w.stop(t)
+		removed := make(map[string]bool)
+		for _, e := range have {
+			if e.Op&Remove == Remove {
+				removed[e.Name] = true
+			}
+		}
+		for _, p := range paths {
+			if !removed[p] {
+				t.Errorf("no Remove for %s:\n%s", p, indent(have))
+			}
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
+
 func TestRemove(t *testing.T) {
 	t.Parallel()
 
@@ -496,7 +604,8 @@ func TestRemove(t *testing.T) {
 		}
 	})
 
-	// Make sure that concurrent calls to Remove() don't race.
+	// Make sure that concurrent calls to Remove() don't race, and that the
+	// one that loses gets ErrNonExistentWatch.
 	t.Run("no race", func(t *testing.T) {
 		t.Parallel()
 
@@ -508,25 +617,88 @@ func TestRemove(t *testing.T) {
 			defer w.Close()
 			addWatch(t, w, tmp)
 
-			done := make(chan struct{})
-			go func() {
-				defer func() { done <- struct{}{} }()
-				w.Remove(tmp)
-			}()
-			go func() {
-				defer func() { done <- struct{}{} }()
-				w.Remove(tmp)
-			}()
-			<-done
-			<-done
+			errs := make(chan error)
+			for j := 0; j < 2; j++ {
+				go func() { errs <- w.Remove(tmp) }()
+			}
+			var removed int
+			for j := 0; j < 2; j++ {
+				switch err := <-errs; {
+				case err == nil:
+					removed++
+				case !errors.Is(err, ErrNonExistentWatch):
+					t.Errorf("expected ErrNonExistentWatch, got: %v", err)
+				}
+			}
+			if removed != 1 {
+				t.Errorf("%d calls to Remove succeeded, want 1", removed)
+			}
 			w.Close()
 		}
 	})
+
+	// Removing a file that was already deleted, and which may or may not be
+	// removed already by the kernel, isn't an unexpected error.
+	t.Run("deleted", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file", noWait)
+		file := filepath.Join(tmp, "file")
+
+		w := newWatcher(t, file)
+		defer w.Close()
+		rm(t, file, noWait)
+
+		if err := w.Remove(file); err != nil && !errors.Is(err, ErrNonExistentWatch) {
+			t.Errorf("expected nil or ErrNonExistentWatch, got: %v", err)
+		}
+	})
 }
 
 // Make sure Close() doesn't race; hard to write a good reproducible test for
 // this, but running it 150 times seems to reproduce it in ~75% of cases and
 // isn't too slow (~0.06s on my system).
+// TestWatcherClose tests that the goroutine started by creating the watcher can be
+// signalled to return at any time, even if there is no goroutine listening on the events
+// or errors channels.
+func TestWatcherClose(t *testing.T) {
+	t.Parallel()
+
+	name := tempMkFile(t, "")
+	w := newWatcher(t)
+	err := w.Add(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Remove(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Allow the watcher to receive the event.
+	time.Sleep(time.Millisecond * 100)
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrySendError(t *testing.T) {
+	errs := make(chan error, 1)
+	var dropped uint64
+	trySendError(errs, &dropped, ErrEventOverflow)
+	trySendError(errs, &dropped, ErrEventDropped)
+
+	if dropped != 1 {
+		t.Errorf("dropped: have %d, want 1", dropped)
+	}
+	if err := <-errs; err != ErrEventOverflow {
+		t.Errorf("have %v, want %v", err, ErrEventOverflow)
+	}
+}
+
 func TestCloseRace(t *testing.T) {
 	for i := 0; i < 150; i++ {
 		w, err := NewWatcher()
@@ -538,3 +710,2513 @@ func TestCloseRace(t *testing.T) {
 		go w.Close()
 	}
 }
+
+func TestWatchSizeTracking(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	touch(t, file)
+
+	w, err := NewWatcher(WithSizeTracking())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, file)
+
+	next := func() Event {
+		t.Helper()
+		for {
+			select {
+			case e := <-w.Events:
+				if e.Op&Write == Write {
+					return e
+				}
+			case err := <-w.Errors:
+				t.Fatal(err)
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for write event")
+			}
+		}
+	}
+
+	if err := os.WriteFile(file, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Size != 4 || e.Truncated {
+		t.Errorf("after append: have Size %d, Truncated %t; want 4, false", e.Size, e.Truncated)
+	}
+
+	if err := os.Truncate(file, 2); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Size != 2 || !e.Truncated {
+		t.Errorf("after truncate: have Size %d, Truncated %t; want 2, true", e.Size, e.Truncated)
+	}
+}
+
+func TestWatchBackpressure(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		policy Backpressure
+		want   string
+	}{
+		{"drop newest", DropNewest, "a"},
+		{"drop oldest", DropOldest, "c"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			w, err := NewWatcher(WithBufferSize(1), WithBackpressure(tt.policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			addWatch(t, w, tmp)
+
+			var dropped int32
+			errDone := make(chan struct{})
+			go func() {
+				defer close(errDone)
+				for err := range w.Errors {
+					if err == ErrEventDropped {
+						atomic.AddInt32(&dropped, 1)
+					}
+				}
+			}()
+
+			touch(t, tmp, "a")
+			touch(t, tmp, "b")
+			touch(t, tmp, "c")
+			waitForEvents()
+
+			e := <-w.Events
+			if have := filepath.Base(e.Name); have != tt.want {
+				t.Errorf("buffered event for %q, want %q", have, tt.want)
+			}
+
+			w.Close()
+			<-errDone
+			if atomic.LoadInt32(&dropped) == 0 {
+				t.Error("no ErrEventDropped on Errors")
+			}
+			if n := w.Dropped(); n < 2 {
+				t.Errorf("Dropped: have %d, want at least 2", n)
+			}
+		})
+	}
+}
+
+func TestWatchSendTimeout(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w, err := NewWatcher(WithSendTimeout(10 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp)
+
+	// Nobody reads Events; the reader shouldn't get stuck on the first event.
+	touch(t, tmp, "a")
+	touch(t, tmp, "b")
+	waitForEvents()
+	if n := w.Dropped(); n < 2 {
+		t.Errorf("Dropped: have %d, want at least 2", n)
+	}
+
+	touch(t, tmp, "c", noWait)
+	select {
+	case e := <-w.Events:
+		if have := filepath.Base(e.Name); have != "c" {
+			t.Errorf("event for %q, want \"c\"", have)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event after the dropped ones")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchDropErrors(t *testing.T) {
+	t.Parallel()
+
+	w, err := NewWatcher(WithDropErrors(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if have := cap(w.Errors); have != 4 {
+		t.Errorf("cap(Errors): have %d, want 4", have)
+	}
+	if have := w.DroppedErrors(); have != 0 {
+		t.Errorf("DroppedErrors: have %d, want 0", have)
+	}
+
+	// Send more errors than fit in the buffer without reading Errors; the
+	// events that come after them are still sent.
+	tmp := t.TempDir()
+	const n = 10
+	for i := 0; i < n; i++ {
+		touch(t, tmp, fmt.Sprintf("file%d", i), noWait)
+	}
+	w, err = NewWatcher(WithDropErrors(4), WithWatchLost())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp)
+	for i := 0; i < n; i++ {
+		addWatch(t, w, tmp, fmt.Sprintf("file%d", i))
+	}
+	for i := 0; i < n; i++ {
+		rm(t, tmp, fmt.Sprintf("file%d", i))
+	}
+	touch(t, tmp, "done")
+
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case e := <-w.Events:
+			done = e.Name == filepath.Join(tmp, "done") && e.Op&Create == Create
+		case <-timeout:
+			t.Fatal("timeout waiting for the event after the errors; blocked on sending an error?")
+		}
+	}
+	if have := len(w.Errors); have != 4 {
+		t.Errorf("len(Errors): have %d, want 4", have)
+	}
+	if have := w.DroppedErrors(); have == 0 {
+		t.Error("DroppedErrors: have 0, want more than 0")
+	}
+}
+
+func TestWatchRateLimit(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file", noWait)
+	touch(t, tmp, "other", noWait)
+
+	w := newCollector(t, WithRateLimit(2, time.Minute))
+	w.allowDropped = true
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	for i := 0; i < 5; i++ {
+		cat(t, "data", tmp, "file")
+	}
+	cat(t, "data", tmp, "other")
+
+	counts := make(map[string]int)
+	for _, e := range w.stop(t) {
+		counts[filepath.Base(e.Name)]++
+	}
+	if counts["file"] != 2 {
+		t.Errorf("events for file: have %d, want 2", counts["file"])
+	}
+	if counts["other"] == 0 {
+		t.Error("no events for other")
+	}
+	if n := w.w.Dropped(); n < 3 {
+		t.Errorf("Dropped: have %d, want at least 3", n)
+	}
+}
+
+func TestSetRateLimit(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file", noWait)
+
+	w := newCollector(t)
+	w.allowDropped = true
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	w.w.SetRateLimit(1, time.Minute)
+	for i := 0; i < 3; i++ {
+		cat(t, "data", tmp, "file")
+	}
+	w.w.SetRateLimit(0, 0)
+	touch(t, tmp, "other")
+	rm(t, tmp, "file")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write   /file
+		create  /other
+		remove  /file
+	`))
+	if n := w.w.Dropped(); n < 2 {
+		t.Errorf("Dropped: have %d, want at least 2", n)
+	}
+}
+
+func TestWatchDedup(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file", noWait)
+
+	w := newCollector(t, WithDedup(time.Minute))
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	for i := 0; i < 5; i++ {
+		cat(t, "data", tmp, "file")
+	}
+	rm(t, tmp, "file")
+	events := w.stop(t)
+
+	type key struct {
+		name string
+		op   Op
+	}
+	seen := make(map[key]bool)
+	for _, e := range events {
+		k := key{e.Name, e.Op}
+		if seen[k] {
+			t.Errorf("duplicate event: %s", e)
+		}
+		seen[k] = true
+	}
+	if !seen[key{filepath.Join(tmp, "file"), Write}] {
+		t.Errorf("no Write event for file in %v", events)
+	}
+	if n := w.w.Dropped(); n != 0 {
+		t.Errorf("Dropped: have %d, want 0", n)
+	}
+}
+
+func TestWatchDirWriteEvents(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+
+	w := newCollector(t, WithDirWriteEvents())
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	touch(t, tmp, "file")
+	rm(t, tmp, "file")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /file
+		write   /
+		remove  /file
+		write   /
+	`))
+}
+
+func TestWatchOnEvent(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+
+	w := newCollector(t)
+	var (
+		mu     sync.Mutex
+		called Events
+	)
+	w.w.OnEvent(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		called = append(called, e)
+	})
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	touch(t, tmp, "file")
+	rm(t, tmp, "file")
+
+	// Nothing is sent on the Events channel.
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, ``))
+
+	mu.Lock()
+	defer mu.Unlock()
+	cmpEvents(t, tmp, called, newEvents(t, `
+		create  /file
+		remove  /file
+	`))
+}
+
+func TestAddMany(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file", noWait)
+	missing := filepath.Join(tmp, "missing")
+
+	w := newWatcher(t)
+	defer w.Close()
+
+	err := w.AddMany(tmp, missing, filepath.Join(tmp, "file"))
+	if err == nil {
+		t.Fatal("expected an error for the missing path")
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("errors.Is(err, os.ErrNotExist) is false: %v", err)
+	}
+	if !strings.Contains(err.Error(), missing) {
+		t.Errorf("error doesn't mention %q: %v", missing, err)
+	}
+
+	var found bool
+	for _, p := range w.WatchList() {
+		found = found || p == tmp
+	}
+	if !found {
+		t.Errorf("%q not watched after AddMany; WatchList: %v", tmp, w.WatchList())
+	}
+}
+
+func TestAddWithAccess(t *testing.T) {
+	t.Parallel()
+
+	w := newWatcher(t)
+	defer w.Close()
+
+	err := w.AddWith(t.TempDir(), WithAccess())
+	if runtime.GOOS == "linux" {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got: %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	t.Parallel()
+
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	missing := filepath.Join(dirs[0], "missing")
+
+	w := newWatcher(t, dirs[0], dirs[1])
+	defer w.Close()
+
+	err := w.Update([]string{dirs[1], dirs[2], missing})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist for %q, got: %v", missing, err)
+	}
+
+	have := w.WatchList()
+	sort.Strings(have)
+	want := []string{dirs[1], dirs[2]}
+	sort.Strings(want)
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("wrong WatchList after Update\nhave: %v\nwant: %v", have, want)
+	}
+
+	if err := w.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	if l := w.WatchList(); len(l) > 0 {
+		t.Errorf("expected empty WatchList, got: %v", l)
+	}
+}
+
+func TestWatchDirOnly(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "existing", noWait)
+
+	w := newCollector(t, WithDirOnly())
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	cat(t, "data", tmp, "file")
+	if runtime.GOOS != "windows" {
+		chmod(t, 0o700, tmp, "file")
+	}
+	cat(t, "more data", tmp, "existing")
+	rm(t, tmp, "file")
+	rm(t, tmp, "existing")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /file
+		remove  /file
+		remove  /existing
+	`))
+}
+
+func TestWatchMoveEvents(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	unwatched := t.TempDir()
+	touch(t, tmp, "out", noWait)
+	touch(t, unwatched, "in", noWait)
+
+	w := newCollector(t, WithMoveEvents())
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	mv(t, filepath.Join(tmp, "out"), unwatched, "out")
+	mv(t, filepath.Join(unwatched, "in"), tmp, "in")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		rename|moved_from  /out
+		create|moved_to    /in
+
+		# kqueue can't tell a moved file from a new one.
+		darwin:
+			rename|moved_from  /out
+			create             /in
+		freebsd:
+			rename|moved_from  /out
+			create             /in
+		netbsd:
+			rename|moved_from  /out
+			create             /in
+		openbsd:
+			rename|moved_from  /out
+			create             /in
+		dragonfly:
+			rename|moved_from  /out
+			create             /in
+
+		# Moving across directories are a remove and create on Windows.
+		windows:
+			remove  /out
+			create  /in
+	`))
+}
+
+func TestWatchDirOnlyMoveEvents(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	unwatched := t.TempDir()
+	touch(t, tmp, "out", noWait)
+	touch(t, unwatched, "in", noWait)
+
+	w := newCollector(t, WithDirOnly(), WithMoveEvents())
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	mv(t, filepath.Join(tmp, "out"), unwatched, "out")
+	mv(t, filepath.Join(unwatched, "in"), tmp, "in")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		rename|moved_from  /out
+		create|moved_to    /in
+
+		# The files aren't watched with kqueue, so a moved file is only
+		# found by reading the directory.
+		darwin:
+			remove  /out
+			create  /in
+		freebsd:
+			remove  /out
+			create  /in
+		netbsd:
+			remove  /out
+			create  /in
+		openbsd:
+			remove  /out
+			create  /in
+		dragonfly:
+			remove  /out
+			create  /in
+
+		# Moving across directories are a remove and create on Windows.
+		windows:
+			remove  /out
+			create  /in
+	`))
+}
+
+func TestWatchTree(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "sub", noWait)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	batches, errs, err := WatchTree(ctx, tmp, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	touch(t, tmp, "sub", "file")
+	mkdir(t, tmp, "new")
+	touch(t, tmp, "new", "file")
+
+	var have []string
+	timeout := time.After(5 * time.Second)
+	for !strings.Contains(strings.Join(have, " "), filepath.Join(tmp, "new", "file")) {
+		select {
+		case batch := <-batches:
+			if len(batch) == 0 {
+				t.Fatal("empty batch")
+			}
+			for _, e := range batch {
+				have = append(have, e.Name)
+			}
+		case err := <-errs:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatalf("timeout; have events for: %s", have)
+		}
+	}
+	if !strings.Contains(strings.Join(have, " "), filepath.Join(tmp, "sub", "file")) {
+		t.Errorf("no event for sub/file; have events for: %s", have)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-batches:
+		if ok {
+			// A final batch may be pending; the channel must still be
+			// closed after it.
+			if _, ok := <-batches; ok {
+				t.Fatal("batches not closed after cancel")
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("batches not closed after cancel")
+	}
+}
+
+func TestWatchFS(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "sub", noWait)
+
+	if _, err := WatchFS(os.DirFS(t.TempDir()), tmp); err == nil {
+		t.Fatal("expected an error for an fs.FS that isn't backed by root")
+	}
+
+	fw, err := WatchFS(os.DirFS(tmp), tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	if err := fw.Add("../escape"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("expected fs.ErrInvalid, got: %v", err)
+	}
+	err = fw.Add("missing")
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != "missing" || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.PathError for \"missing\", got: %#v", err)
+	}
+	if err := fw.Add("sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	touch(t, tmp, "sub", "file", noWait)
+	select {
+	case e := <-fw.Events:
+		if e.Name != "sub/file" || e.Op&Create != Create {
+			t.Errorf("wrong event: %s", e)
+		}
+	case err := <-fw.Errors:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-fw.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done not closed after Close")
+	}
+	if _, ok := <-fw.Events; ok {
+		t.Error("Events not closed after Done")
+	}
+}
+
+func TestWatchCoalesce(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	other := t.TempDir()
+	touch(t, tmp, "existing", noWait)
+
+	w, err := NewWatcher(WithMoveEvents())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp)
+	events := w.Coalesce(time.Second)
+
+	mv(t, filepath.Join(tmp, "existing"), tmp, "renamed")
+	mv(t, filepath.Join(tmp, "renamed"), other, "gone")
+
+	var have []Event
+	timeout := time.After(5 * time.Second)
+	for len(have) < 2 {
+		select {
+		case e := <-events:
+			have = append(have, e)
+		case err := <-w.Errors:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatalf("timeout; have: %v", have)
+		}
+	}
+
+	want := []Event{
+		{Name: filepath.Join(tmp, "renamed"), OldName: filepath.Join(tmp, "existing"), Op: Move},
+		{Name: filepath.Join(tmp, "renamed"), Op: Rename},
+	}
+	for i := range want {
+		if have[i].Name != want[i].Name || have[i].OldName != want[i].OldName || have[i].Op&^(MovedFrom|MovedTo) != want[i].Op {
+			t.Errorf("event %d: have %s, want %s", i, have[i], want[i])
+		}
+	}
+	if runtime.GOOS == "linux" && have[0].Op&MovedTo == 0 {
+		t.Errorf("Move doesn't have MovedTo from the Create: %s", have[0])
+	}
+
+	w.Close()
+	for range events {
+	}
+}
+
+func TestWatchCoalesceRelative(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "existing", noWait)
+
+	// Without WithMoveEvents, so the files have to be matched by inode.
+	w, err := NewWatcher(WithRelativePaths(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp)
+	events := w.Coalesce(time.Second)
+
+	mv(t, filepath.Join(tmp, "existing"), tmp, "renamed")
+
+	select {
+	case e := <-events:
+		if e.Op&Move == 0 || e.Name != "renamed" || e.OldName != "existing" {
+			t.Errorf("want a Move from existing to renamed, have %s (OldName %q)", e, e.OldName)
+		}
+	case err := <-w.Errors:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	w.Close()
+	for range events {
+	}
+}
+
+// The events that are held back when the Watcher is closed mustn't block
+// forever if nobody receives them.
+func TestWatchCoalesceClose(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	other := t.TempDir()
+	touch(t, tmp, "file", noWait)
+
+	w, err := NewWatcher(WithBufferSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp)
+	events := w.Coalesce(100 * time.Millisecond)
+
+	// Waits for a Create that never comes.
+	mv(t, filepath.Join(tmp, "file"), other, "file")
+	w.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("held back event sent after the window")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed")
+	}
+}
+
+func TestBatchedWatcher(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewBatchedWatcher(0, time.Second); err == nil {
+		t.Fatal("expected an error for maxBatch 0")
+	}
+
+	tmp := t.TempDir()
+	bw, err := NewBatchedWatcher(3, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bw.Close()
+	if err := bw.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		touch(t, tmp, fmt.Sprintf("file%d", i), noWait)
+	}
+
+	var have []Event
+	for len(have) < 4 {
+		select {
+		case batch := <-bw.BatchEvents:
+			if len(batch) == 0 || len(batch) > 3 {
+				t.Fatalf("wrong batch size %d: %v", len(batch), batch)
+			}
+			have = append(have, batch...)
+		case err := <-bw.Errors:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout; have: %v", have)
+		}
+	}
+	for i, e := range have {
+		if want := filepath.Join(tmp, fmt.Sprintf("file%d", i)); e.Name != want || e.Op&Create != Create {
+			t.Errorf("event %d: want CREATE %q, have %s", i, want, e)
+		}
+	}
+
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-bw.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done not closed after Close")
+	}
+	if _, ok := <-bw.BatchEvents; ok {
+		t.Error("BatchEvents not closed after Done")
+	}
+
+	// Close while the Watcher still has events to send that nothing reads.
+	t.Run("pending", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		bw, err := NewBatchedWatcher(1, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bw.Add(tmp); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			touch(t, tmp, fmt.Sprintf("file%d", i), noWait)
+		}
+		eventSeparator()
+
+		if err := bw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-bw.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("Done not closed after Close")
+		}
+	})
+}
+
+func TestAddFS(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "a", noWait)
+	mkdir(t, tmp, "a", "b", noWait)
+	mkdir(t, tmp, "c", noWait)
+	touch(t, tmp, "a", "file", noWait)
+
+	w := newWatcher(t)
+	defer w.Close()
+
+	if err := w.AddFS(os.DirFS(t.TempDir()), tmp); err == nil {
+		t.Fatal("expected an error for an fs.FS that isn't backed by root")
+	}
+	if err := w.AddFS(os.DirFS(tmp), tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	have := w.WatchList()
+	sort.Strings(have)
+	want := []string{
+		tmp,
+		filepath.Join(tmp, "a"),
+		filepath.Join(tmp, "a", "b"),
+		filepath.Join(tmp, "c"),
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+}
+
+func TestRemovePrefix(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "a", noWait)
+	mkdir(t, tmp, "a", "b", noWait)
+	mkdir(t, tmp, "ab", noWait)
+	mkdir(t, tmp, "c", noWait)
+
+	w := newWatcher(t)
+	defer w.Close()
+	if err := w.AddFS(os.DirFS(tmp), tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.RemovePrefix(filepath.Join(tmp, "a")); err != nil {
+		t.Fatal(err)
+	}
+	have := w.WatchList()
+	sort.Strings(have)
+	want := []string{tmp, filepath.Join(tmp, "ab"), filepath.Join(tmp, "c")}
+	sort.Strings(want)
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+
+	if err := w.RemovePrefix(filepath.Join(tmp, "missing")); err != nil {
+		t.Errorf("RemovePrefix for a path that isn't watched: %v", err)
+	}
+	if err := w.RemovePrefix(tmp + string(filepath.Separator)); err != nil {
+		t.Fatal(err)
+	}
+	if l := w.WatchList(); len(l) != 0 {
+		t.Errorf("watches left after removing the root: %q", l)
+	}
+}
+
+func TestRemovePrefixEvents(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "a", noWait)
+	mkdir(t, tmp, "a", "b", noWait)
+	mkdir(t, tmp, "c", noWait)
+
+	w := newCollector(t)
+	w.collect(t)
+	if err := w.w.AddFS(os.DirFS(tmp), tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.RemovePrefix(filepath.Join(tmp, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	touch(t, tmp, "a", "b", "file")
+	touch(t, tmp, "c", "file")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create /c/file
+	`))
+}
+
+// Files that are created below the prefix while RemovePrefix runs aren't
+// watched again when the directories they're in are read.
+func TestRemovePrefixRace(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "a", noWait)
+	mkdir(t, tmp, "c", noWait)
+	for i := 0; i < 10; i++ {
+		mkdir(t, tmp, "a", fmt.Sprintf("dir%d", i), noWait)
+	}
+
+	w := newCollector(t)
+	w.collect(t)
+	if err := w.w.AddFS(os.DirFS(tmp), tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			touch(t, tmp, "a", fmt.Sprintf("dir%d", i%10), fmt.Sprintf("file%d", i), noWait)
+		}
+	}()
+	if err := w.w.RemovePrefix(filepath.Join(tmp, "a")); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	waitForEvents()
+
+	checkWatches := func() {
+		t.Helper()
+		for _, name := range w.w.WatchList() {
+			if hasPathPrefix(name, filepath.Join(tmp, "a")) {
+				t.Errorf("still watched after RemovePrefix: %q", name)
+			}
+		}
+	}
+	checkWatches()
+	w.mu.Lock()
+	seen := len(w.events)
+	w.mu.Unlock()
+
+	touch(t, tmp, "a", "dir0", "new")
+	mkdir(t, tmp, "a", "dir1", "new")
+	touch(t, tmp, "c", "file")
+	checkWatches()
+
+	cmpEvents(t, tmp, w.stop(t)[seen:], newEvents(t, `
+		create /c/file
+	`))
+}
+
+func TestWatchInitialScan(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "a", noWait)
+	touch(t, tmp, "b", noWait)
+	mkdir(t, tmp, "dir", noWait)
+
+	w := newCollector(t, WithInitialScan())
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	touch(t, tmp, "c")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /a
+		create  /b
+		create  /dir
+		create  /c
+	`))
+
+	// Files created while Add is running are all reported.
+	t.Run("race", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, WithInitialScan())
+		w.collect(t)
+
+		const n = 100
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < n; i++ {
+				touch(t, tmp, fmt.Sprintf("file%d", i), noWait)
+			}
+		}()
+		addWatch(t, w.w, tmp)
+		<-done
+
+		seen := make(map[string]bool)
+		for _, e := range w.stop(t) {
+			if e.Op&Create == Create {
+				seen[filepath.Base(e.Name)] = true
+			}
+		}
+		for i := 0; i < n; i++ {
+			if name := fmt.Sprintf("file%d", i); !seen[name] {
+				t.Errorf("no Create event for %s", name)
+			}
+		}
+	})
+}
+
+// Files that exist when Add is called never get a Create event, files that
+// are created after Add returns always get one, and files that are created
+// while Add is running get at most one.
+func TestAddCreateBoundary(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	const n = 50
+	for i := 0; i < n; i++ {
+		touch(t, tmp, fmt.Sprintf("before%d", i), noWait)
+	}
+
+	w := newCollector(t)
+	w.collect(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			touch(t, tmp, fmt.Sprintf("during%d", i), noWait)
+		}
+	}()
+	addWatch(t, w.w, tmp)
+	for i := 0; i < n; i++ {
+		touch(t, tmp, fmt.Sprintf("after%d", i), noWait)
+	}
+	<-done
+
+	creates := make(map[string]int)
+	for _, e := range w.stop(t) {
+		if e.Op&Create == Create {
+			creates[filepath.Base(e.Name)]++
+		}
+	}
+	for i := 0; i < n; i++ {
+		if name := fmt.Sprintf("before%d", i); creates[name] != 0 {
+			t.Errorf("Create event for %s, which existed before Add", name)
+		}
+		if name := fmt.Sprintf("during%d", i); creates[name] > 1 {
+			t.Errorf("%d Create events for %s", creates[name], name)
+		}
+		if name := fmt.Sprintf("after%d", i); creates[name] != 1 {
+			t.Errorf("%d Create events for %s, want 1", creates[name], name)
+		}
+	}
+}
+
+func TestAddConcurrent(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file", noWait)
+
+	w := newCollector(t)
+	w.collect(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.w.Add(tmp); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if l := w.w.WatchList(); len(l) != 1 || l[0] != tmp {
+		t.Errorf("WatchList: have %q, want [%q]", l, tmp)
+	}
+
+	touch(t, tmp, "new")
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /new
+	`))
+}
+
+func TestWatchDeferredCreate(t *testing.T) {
+	t.Parallel()
+
+	t.Run("create", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, WithDeferredCreate())
+		w.collect(t)
+		addWatch(t, w.w, tmp, "a", "b", "file")
+
+		mkdir(t, tmp, "a")
+		mkdir(t, tmp, "a", "b")
+		touch(t, tmp, "a", "b", "other")
+		touch(t, tmp, "a", "b", "file")
+		cat(t, "data", tmp, "a", "b", "file")
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			create  /a/b/file
+			write   /a/b/file
+		`))
+	})
+
+	// A file in a directory that already exists, such as a config file.
+	t.Run("file", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, WithDeferredCreate())
+		w.collect(t)
+		addWatch(t, w.w, tmp, "config")
+
+		touch(t, tmp, "other")
+		touch(t, tmp, "config")
+		cat(t, "data", tmp, "config")
+		chmod(t, 0o600, tmp, "config")
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			create  /config
+			write   /config
+			chmod   /config
+
+			windows:
+				create  /config
+				write   /config
+		`))
+	})
+
+	// A file that's created with a name that's only the same as the deferred
+	// path after SetPathNormalizer, such as in a different case on a file
+	// system that ignores the case.
+	t.Run("normalized", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "probe", noWait)
+		if _, err := os.Lstat(filepath.Join(tmp, "PROBE")); err != nil {
+			t.Skip("the file system is case-sensitive")
+		}
+		rm(t, tmp, "probe", noWait)
+
+		w := newCollector(t, WithDeferredCreate())
+		w.w.SetPathNormalizer(func(name string) string {
+			name = filepath.Clean(name)
+			if rel, err := filepath.Rel(tmp, name); err == nil && !strings.HasPrefix(rel, "..") {
+				return filepath.Join(tmp, strings.ToLower(rel))
+			}
+			return name
+		})
+		w.collect(t)
+		addWatch(t, w.w, tmp, "Config")
+
+		touch(t, tmp, "CONFIG")
+		cat(t, "data", tmp, "CONFIG")
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			create  /config
+			write   /config
+		`))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, WithDeferredCreate())
+		w.collect(t)
+		addWatch(t, w.w, tmp, "file")
+		if err := w.w.Remove(filepath.Join(tmp, "file")); err != nil {
+			t.Fatal(err)
+		}
+
+		touch(t, tmp, "file")
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, ``))
+	})
+}
+
+func TestCloseAndDrain(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w, err := NewWatcher(WithBufferSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp)
+
+	touch(t, tmp, "a")
+	touch(t, tmp, "b")
+	waitForEvents()
+
+	events, err := w.CloseAndDrain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmpEvents(t, tmp, events, newEvents(t, `
+		create  /a
+		create  /b
+	`))
+
+	if err := w.Add(tmp); !errors.Is(err, ErrClosed) {
+		t.Errorf("Add after CloseAndDrain: expected ErrClosed, got: %v", err)
+	}
+}
+
+// Events that were read but not sent yet when closing aren't lost.
+func TestCloseAndDrainPending(t *testing.T) {
+	t.Parallel()
+
+	const n = 20
+	tmp := t.TempDir()
+	// Big enough that the reader never blocks, so that all events are read
+	// from the kernel before CloseAndDrain; anything it hadn't read yet is
+	// lost.
+	w, err := NewWatcher(WithBufferSize(4 * n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp)
+
+	for i := 0; i < n; i++ {
+		touch(t, tmp, fmt.Sprintf("file%d", i), noWait)
+	}
+	// Wait until nothing more is read.
+	for prev, start := -1, time.Now(); len(w.Events) != prev || len(w.Events) < n; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("only %d events read", len(w.Events))
+		}
+		prev = len(w.Events)
+		eventSeparator()
+	}
+
+	events, err := w.CloseAndDrain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := make(map[string]bool)
+	for _, e := range events {
+		if e.Op&Create == Create {
+			created[filepath.Base(e.Name)] = true
+		}
+	}
+	if len(created) != n {
+		t.Errorf("expected %d Create events, got %d:\n%s", n, len(created), Events(events))
+	}
+}
+
+func TestNext(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t, tmp)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := w.Next(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got: %v", err)
+	}
+
+	touch(t, tmp, "file", noWait)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e, err := w.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Name != filepath.Join(tmp, "file") || e.Op&Create != Create {
+		t.Errorf("wrong event: %s", e)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := w.Next(ctx); err != nil {
+			if !errors.Is(err, ErrClosed) {
+				t.Errorf("expected ErrClosed after Close, got: %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestMaxWatches(t *testing.T) {
+	t.Parallel()
+
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()}
+
+	w, err := NewWatcher(WithMaxWatches(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	addWatch(t, w, dirs[0])
+	addWatch(t, w, dirs[1])
+	err = w.Add(dirs[2])
+	if !errors.Is(err, ErrMaxWatchesExceeded) {
+		t.Fatalf("expected ErrMaxWatchesExceeded, got: %v", err)
+	}
+	if !errors.Is(err, ErrTooManyWatches) {
+		t.Errorf("ErrMaxWatchesExceeded doesn't wrap ErrTooManyWatches: %v", err)
+	}
+	if n := w.Count(); n != 2 {
+		t.Errorf("Count: have %d, want 2", n)
+	}
+
+	// Adding an existing watch again is fine.
+	addWatch(t, w, dirs[1])
+
+	if err := w.Remove(dirs[0]); err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, dirs[2])
+	if n := w.Count(); n != 2 {
+		t.Errorf("Count: have %d, want 2", n)
+	}
+
+	w.SetMaxWatches(1)
+	if err := w.Add(dirs[0]); !errors.Is(err, ErrMaxWatchesExceeded) {
+		t.Fatalf("expected ErrMaxWatchesExceeded after lowering the limit, got: %v", err)
+	}
+	if n := w.Count(); n != 2 {
+		t.Errorf("Count after lowering the limit: have %d, want 2", n)
+	}
+	w.SetMaxWatches(0)
+	addWatch(t, w, dirs[0])
+
+	// Anything below 0 is no limit as well.
+	w.SetMaxWatches(-1)
+	addWatch(t, w, dirs[3])
+}
+
+func TestPlan(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "a", noWait)
+	mkdir(t, tmp, "sub", noWait)
+
+	w := newWatcher(t)
+	defer w.Close()
+
+	have, err := w.Plan(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{tmp}
+	switch runtime.GOOS {
+	case "linux", "windows":
+	default:
+		want = append(want, filepath.Join(tmp, "a"), filepath.Join(tmp, "sub"))
+	}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("Plan:\nhave: %s\nwant: %s", have, want)
+	}
+	if n := w.WatchCount(); n != 0 {
+		t.Errorf("WatchCount after Plan: have %d, want 0", n)
+	}
+
+	if _, err := w.Plan(filepath.Join(tmp, "missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Plan for a missing path: have %v, want fs.ErrNotExist", err)
+	}
+
+	// Hidden files aren't included with WithIgnoreHidden, as Add doesn't
+	// watch them.
+	touch(t, tmp, ".hidden", noWait)
+	hw, err := NewWatcher(WithIgnoreHidden())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hw.Close()
+	have, err = hw.Plan(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("Plan with WithIgnoreHidden:\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file", noWait)
+
+	f, err := os.Open(filepath.Join(tmp, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newCollector(t)
+	w.collect(t)
+	err = w.w.AddFile(f)
+	f.Close()
+	if runtime.GOOS == "windows" {
+		if !errors.Is(err, ErrUnsupported) {
+			t.Fatalf("AddFile: have %v, want ErrUnsupported", err)
+		}
+		w.stop(t)
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cat(t, "data", tmp, "file")
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write  /file
+	`))
+}
+
+func TestIsWatching(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t)
+	addWatch(t, w, tmp)
+
+	if !w.IsWatching(tmp) {
+		t.Errorf("IsWatching(%q) = false after Add", tmp)
+	}
+	if !w.IsWatching(tmp + string(filepath.Separator)) {
+		t.Errorf("IsWatching(%q) = false; not cleaned", tmp+string(filepath.Separator))
+	}
+	if w.IsWatching(filepath.Join(tmp, "missing")) {
+		t.Errorf("IsWatching for a path that isn't watched = true")
+	}
+
+	if err := w.Remove(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if w.IsWatching(tmp) {
+		t.Errorf("IsWatching(%q) = true after Remove", tmp)
+	}
+
+	addWatch(t, w, tmp)
+	w.Close()
+	if w.IsWatching(tmp) {
+		t.Errorf("IsWatching(%q) = true after Close", tmp)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	t.Parallel()
+
+	w := newWatcher(t)
+	defer w.Close()
+
+	want := "kqueue"
+	switch runtime.GOOS {
+	case "linux":
+		want = "inotify"
+	case "windows":
+		want = "ReadDirectoryChangesW"
+	}
+	if have := w.Backend(); have != want {
+		t.Errorf("Backend: have %q, want %q", have, want)
+	}
+}
+
+func TestWatchCount(t *testing.T) {
+	tmp := t.TempDir()
+	touch(t, tmp, "file", noWait)
+	mkdir(t, tmp, "dir", noWait)
+
+	w := newWatcher(t, tmp, filepath.Join(tmp, "dir"), filepath.Join(tmp, "file"))
+	if have, want := w.WatchCount(), len(w.WatchList()); have != want {
+		t.Errorf("WatchCount: have %d, want %d", have, want)
+	}
+	if n := testing.AllocsPerRun(10, func() { w.WatchCount() }); n != 0 {
+		t.Errorf("WatchCount allocates %v times", n)
+	}
+
+	w.Close()
+	if n := w.WatchCount(); n != 0 {
+		t.Errorf("WatchCount after Close: have %d, want 0", n)
+	}
+}
+
+func TestAddPathError(t *testing.T) {
+	t.Parallel()
+
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	w := newWatcher(t)
+	defer w.Close()
+
+	err := w.Add(missing)
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) {
+		t.Fatalf("expected *os.PathError, got: %#v", err)
+	}
+	if pathErr.Path != missing {
+		t.Errorf("wrong path: have %q, want %q", pathErr.Path, missing)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got: %v", err)
+	}
+}
+
+func TestWatchAttrDetail(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Chmod events are not sent on Windows")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	touch(t, file)
+
+	w, err := NewWatcher(WithAttrDetail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp)
+
+	next := func() Event {
+		t.Helper()
+		for {
+			select {
+			case e := <-w.Events:
+				if e.Name == file && e.Op&Chmod == Chmod {
+					return e
+				}
+			case err := <-w.Errors:
+				t.Fatal(err)
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for chmod event")
+			}
+		}
+	}
+
+	chmod(t, 0o600, file)
+	if e := next(); e.Attr != AttrMode {
+		t.Errorf("Attr after chmod: have %s, want %s", e.Attr, AttrMode)
+	}
+
+	mtime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Attr != AttrTimes {
+		t.Errorf("Attr after chtimes: have %s, want %s", e.Attr, AttrTimes)
+	}
+
+	if err := os.Chtimes(file, time.Now(), mtime); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Attr != AttrOther {
+		t.Errorf("Attr after changing the access time: have %s, want %s", e.Attr, AttrOther)
+	}
+}
+
+// A new directory isn't read for WithAttrDetail; its entries are recorded
+// when they get their own events.
+func TestWatchAttrDetailNewDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("attributes are not kept on Windows")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	unwatched := t.TempDir()
+	mkdir(t, unwatched, "dir", noWait)
+	for _, name := range []string{"a", "b", "c"} {
+		touch(t, unwatched, "dir", name, noWait)
+	}
+
+	w := newCollector(t, WithAttrDetail())
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	mv(t, filepath.Join(unwatched, "dir"), tmp, "dir")
+	waitForEvents()
+
+	// tmp and dir.
+	if s := w.w.MemStats(); s.Attrs != 2 {
+		t.Errorf("Attrs: have %d, want 2", s.Attrs)
+	}
+	w.stop(t)
+}
+
+func TestEventSeq(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	touch(t, tmp, "a")
+	touch(t, tmp, "b")
+	cat(t, "data", tmp, "a")
+	rm(t, tmp, "b")
+
+	// Without waiting, so that kqueue reports them together and the Create
+	// events come from reading the directory, along with the kevents for
+	// the other files.
+	for i := 0; i < 10; i++ {
+		touch(t, tmp, fmt.Sprintf("batch%d", i), noWait)
+		cat(t, "data", tmp, "a", noWait)
+	}
+
+	events := w.stop(t)
+	if len(events) == 0 {
+		t.Fatal("no events")
+	}
+	var last uint64
+	for _, e := range events {
+		if e.Seq <= last {
+			t.Fatalf("Seq not increasing:\n%s", dumpSeq(events))
+		}
+		last = e.Seq
+	}
+}
+
+func dumpSeq(events Events) string {
+	var b strings.Builder
+	for _, e := range events {
+		fmt.Fprintf(&b, "%3d %s\n", e.Seq, e)
+	}
+	return b.String()
+}
+
+func TestEventWatched(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "dir")
+	file := filepath.Join(tmp, "file")
+	mkdir(t, dir, noWait)
+	cat(t, "data", file)
+
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, dir)
+	addWatch(t, w.w, file)
+
+	touch(t, dir, "child")
+	cat(t, "more data", file)
+
+	events := w.stop(t)
+	if len(events) == 0 {
+		t.Fatal("no events")
+	}
+	for _, e := range events {
+		if want := e.Name == file; e.Watched != want {
+			t.Errorf("Watched for %s: have %t, want %t", e, e.Watched, want)
+		}
+	}
+}
+
+// Watched is also set for a path that was passed to Add in a form that isn't
+// clean.
+func TestEventWatchedUnclean(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	cat(t, "data", file)
+
+	sep := string(filepath.Separator)
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, tmp+sep+"."+sep+"file")
+
+	cat(t, "more data", file)
+
+	events := w.stop(t)
+	if len(events) == 0 {
+		t.Fatal("no events")
+	}
+	for _, e := range events {
+		if !e.Watched {
+			t.Errorf("Watched for %s: have false, want true", e)
+		}
+	}
+}
+
+func TestWatchLost(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	other := filepath.Join(tmp, "other")
+	touch(t, file, noWait)
+	touch(t, other, noWait)
+
+	w, err := NewWatcher(WithWatchLost())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, file)
+	addWatch(t, w, tmp)
+
+	// Only in a watched directory: not reported.
+	rm(t, other)
+	rm(t, file)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-w.Errors:
+			if !errors.Is(err, ErrWatchLost) {
+				t.Fatalf("want ErrWatchLost, have %v", err)
+			}
+			var werr *WatchError
+			if !errors.As(err, &werr) || werr.Path != file {
+				t.Fatalf("want a WatchError for %q, have %v", file, err)
+			}
+			if w.IsWatching(file) {
+				t.Error("still watching after ErrWatchLost")
+			}
+			return
+		case <-w.Events:
+		case <-timeout:
+			t.Fatal("timeout waiting for ErrWatchLost")
+		}
+	}
+}
+
+// ErrWatchLost is also sent for a path that was passed to Add in a form that
+// isn't clean.
+func TestWatchLostUnclean(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	touch(t, file, noWait)
+
+	w, err := NewWatcher(WithWatchLost())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	sep := string(filepath.Separator)
+	addWatch(t, w, tmp+sep+"."+sep+"file")
+
+	rm(t, file)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-w.Errors:
+			if !errors.Is(err, ErrWatchLost) {
+				t.Fatalf("want ErrWatchLost, have %v", err)
+			}
+			var werr *WatchError
+			if !errors.As(err, &werr) || werr.Path != file {
+				t.Fatalf("want a WatchError for %q, have %v", file, err)
+			}
+			return
+		case <-w.Events:
+		case <-timeout:
+			t.Fatal("timeout waiting for ErrWatchLost")
+		}
+	}
+}
+
+func TestRescan(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "a", noWait)
+
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	if err := w.w.Rescan(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.Rescan(filepath.Join(tmp, "missing")); !errors.Is(err, ErrNonExistentWatch) {
+		t.Errorf("Rescan for a path that isn't watched: have %v, want ErrNonExistentWatch", err)
+	}
+
+	// kqueue only sends the changes since the directory was read.
+	var want Events
+	switch runtime.GOOS {
+	case "linux", "windows":
+		want = newEvents(t, `create  /a`)
+	}
+	cmpEvents(t, tmp, w.stop(t), want)
+}
+
+// Rescan is meant to be called from the loop that receives the events, after
+// ErrEventOverflow, so it mustn't wait for the events to be received.
+func TestRescanFromEventLoop(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w, err := NewWatcher(WithBufferSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp)
+	touch(t, tmp, "a", noWait)
+	touch(t, tmp, "b", noWait)
+
+	timeout := time.After(5 * time.Second)
+	select {
+	case <-w.Events:
+	case err := <-w.Errors:
+		t.Fatal(err)
+	case <-timeout:
+		t.Fatal("timeout waiting for an event")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- w.Rescan(tmp) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-timeout:
+		t.Fatal("Rescan blocked while the events weren't received")
+	}
+}
+
+func TestWatchPause(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	touch(t, tmp, "before")
+	w.w.Pause()
+	touch(t, tmp, "paused")
+	cat(t, "data", tmp, "paused")
+	if n := w.w.Resume(); n == 0 {
+		t.Error("Resume: no events discarded")
+	}
+	if n := w.w.Resume(); n != 0 {
+		t.Errorf("Resume when not paused: have %d, want 0", n)
+	}
+	touch(t, tmp, "after")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /before
+		create  /after
+	`))
+}
+
+func TestWatchAtomicSave(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	cat(t, "data", file)
+
+	w := newCollector(t, WithAtomicSaveDetection(500*time.Millisecond))
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	cat(t, "new data", tmp, "file.tmp")
+	mv(t, filepath.Join(tmp, "file.tmp"), file)
+
+	// Not renamed: sent once the window is over.
+	touch(t, tmp, "other")
+	time.Sleep(600 * time.Millisecond)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write   /file
+		create  /other
+	`))
+}
+
+func TestWatchFollowReplace(t *testing.T) {
+	t.Parallel()
+
+	t.Run("rename over", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		file := filepath.Join(tmp, "file")
+		cat(t, "data", file)
+
+		w := newCollector(t, WithFollowReplace())
+		w.collect(t)
+		addWatch(t, w.w, file)
+
+		cat(t, "new data", tmp, "file.tmp")
+		mv(t, filepath.Join(tmp, "file.tmp"), file)
+		cat(t, "more data", file)
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			remove  /file
+			create  /file
+			write   /file
+
+			# The link count of the old file changes.
+			linux:
+				chmod   /file
+				remove  /file
+				create  /file
+				write   /file
+		`))
+	})
+
+	t.Run("as write", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		file := filepath.Join(tmp, "file")
+		cat(t, "data", file)
+
+		w := newCollector(t, WithFollowReplace(), WithReplaceAsWrite())
+		w.collect(t)
+		addWatch(t, w.w, file)
+
+		cat(t, "new data", tmp, "file.tmp")
+		mv(t, filepath.Join(tmp, "file.tmp"), file)
+		cat(t, "more data", file)
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			write   /file
+			write   /file
+
+			linux:
+				chmod   /file
+				write   /file
+				write   /file
+		`))
+	})
+
+	t.Run("move away", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		file := filepath.Join(tmp, "file")
+		cat(t, "data", file)
+
+		w := newCollector(t, WithFollowReplace())
+		w.collect(t)
+		addWatch(t, w.w, file)
+
+		mv(t, file, tmp, "file.bak")
+		touch(t, file)
+		cat(t, "more data", tmp, "file.bak")
+		cat(t, "more data", file)
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			rename  /file
+			create  /file
+			write   /file
+		`))
+	})
+}
+
+func TestWatchFileID(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("WithFileID is not supported on Windows")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	link := filepath.Join(tmp, "link")
+
+	w := newCollector(t, WithFileID())
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	touch(t, file)
+	if err := os.Link(file, link); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+	rm(t, file)
+
+	var created []Event
+	for _, e := range w.stop(t) {
+		switch {
+		case e.Op&Create == Create:
+			if e.Ino == 0 {
+				t.Errorf("Ino not set: %s", e)
+			}
+			created = append(created, e)
+		case e.Op&Remove == Remove && e.Name == file:
+			if e.Ino != 0 || e.Dev != 0 {
+				t.Errorf("Ino and Dev set for a removed file: %s (%d, %d)", e, e.Ino, e.Dev)
+			}
+		}
+	}
+	if len(created) != 2 {
+		t.Fatalf("expected 2 Create events, got: %v", created)
+	}
+	if created[0].Ino != created[1].Ino || created[0].Dev != created[1].Dev {
+		t.Errorf("hard links have different IDs: (%d, %d) and (%d, %d)",
+			created[0].Ino, created[0].Dev, created[1].Ino, created[1].Dev)
+	}
+}
+
+func TestWatchEventMapper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Chmod events are not sent on Windows")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	touch(t, file, noWait)
+
+	// Report attribute changes as writes.
+	mapper := func(name string, raw uint32) Event {
+		e := DefaultEventMapper(name, raw)
+		if e.Op&Chmod == Chmod {
+			e.Op = e.Op&^Chmod | Write
+		}
+		return e
+	}
+
+	w := newCollector(t, WithEventMapper(mapper))
+	w.collect(t)
+	addWatch(t, w.w, file)
+
+	chmod(t, 0o600, file)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write  /file
+	`))
+}
+
+func TestSetEventMapper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Chmod events are not sent on Windows")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	touch(t, file, noWait)
+
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, file)
+
+	w.w.SetEventMapper(func(name string, raw uint32) Event {
+		e := DefaultEventMapper(name, raw)
+		if e.Op&Chmod == Chmod {
+			e.Op = e.Op&^Chmod | Write
+		}
+		return e
+	})
+	chmod(t, 0o600, file)
+	w.w.SetEventMapper(nil)
+	chmod(t, 0o700, file)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write  /file
+		chmod  /file
+	`))
+}
+
+func TestWatchRelativePaths(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "sub", noWait)
+
+	w := newCollector(t, WithRelativePaths(tmp))
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+	addWatch(t, w.w, filepath.Join(tmp, "sub"))
+
+	touch(t, tmp, "file")
+	touch(t, tmp, "sub", "file")
+	rm(t, tmp, "sub", "file")
+
+	have := make(map[string]bool)
+	for _, e := range w.stop(t) {
+		have[e.Name] = true
+	}
+	for _, want := range []string{"file", filepath.Join("sub", "file")} {
+		if !have[want] {
+			t.Errorf("no event for %q; have: %v", want, have)
+		}
+	}
+	for name := range have {
+		if filepath.IsAbs(name) {
+			t.Errorf("absolute path in event: %q", name)
+		}
+	}
+}
+
+func TestWatchRootRemoved(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir", noWait)
+	touch(t, tmp, "dir", "file", noWait)
+	touch(t, tmp, "file", noWait)
+
+	w := newCollector(t, WithRootRemoved())
+	w.collect(t)
+	addWatch(t, w.w, filepath.Join(tmp, "dir"))
+	addWatch(t, w.w, filepath.Join(tmp, "file"))
+
+	rmAll(t, tmp, "dir")
+	rm(t, tmp, "file")
+
+	// The other events differ per platform; only check for RootRemoved.
+	var have Events
+	for _, e := range w.stop(t) {
+		if e.Op&RootRemoved == RootRemoved {
+			have = append(have, e)
+		}
+	}
+	for i, e := range have {
+		if e.Op&(Remove|Rename) == 0 {
+			t.Errorf("RootRemoved without Remove or Rename: %s", e)
+		}
+		have[i].Op = RootRemoved
+	}
+	cmpEvents(t, tmp, have, newEvents(t, `
+		root_removed  /dir
+		root_removed  /file
+	`))
+}
+
+func TestWatchFollowSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks don't work on Windows")
+	}
+	t.Parallel()
+
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdir(t, tmp, "dir", noWait)
+	mkdir(t, tmp, "store", noWait)
+	mkdir(t, tmp, "store2", noWait)
+	touch(t, tmp, "store", "target", noWait)
+	symlink(t, filepath.Join(tmp, "store", "target"), tmp, "dir", "link")
+	symlink(t, filepath.Join(tmp, "store2"), tmp, "dir", "dlink")
+	symlink(t, filepath.Join(tmp, "dir"), tmp, "store2", "back")
+	symlink(t, ".", tmp, "dir", "self")
+	symlink(t, filepath.Join(tmp, "missing"), tmp, "dir", "broken")
+
+	w := newCollector(t, WithFollowSymlinks())
+	w.collect(t)
+	addWatch(t, w.w, tmp, "dir")
+
+	cat(t, "data", tmp, "store", "target")
+	touch(t, tmp, "store2", "new")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write   /store/target
+		create  /store2/new
+	`))
+}
+
+// A directory that's watched both as the ancestor of a deferred path and as
+// the target of a symlink is still watched for the symlink once the deferred
+// path is created.
+func TestWatchFollowSymlinksDeferred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("WithFollowSymlinks only adds its own watches with inotify")
+	}
+	t.Parallel()
+
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdir(t, tmp, "dir", noWait)
+	mkdir(t, tmp, "links", noWait)
+	symlink(t, filepath.Join(tmp, "dir"), tmp, "links", "link")
+
+	w := newCollector(t, WithDeferredCreate(), WithFollowSymlinks())
+	w.collect(t)
+	addWatch(t, w.w, tmp, "dir", "sub")
+	addWatch(t, w.w, tmp, "links")
+
+	mkdir(t, tmp, "dir", "sub")
+	touch(t, tmp, "dir", "file")
+
+	var have Events
+	for _, e := range w.stop(t) {
+		if e.Name == filepath.Join(tmp, "dir", "file") {
+			have = append(have, e)
+		}
+	}
+	cmpEvents(t, tmp, have, newEvents(t, `
+		create  /dir/file
+	`))
+}
+
+func TestWatchFollowDirReplace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("a watched directory can't be renamed on Windows")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "dir")
+	mkdir(t, dir, noWait)
+
+	w := newCollector(t, WithFollowDirReplace())
+	w.collect(t)
+	addWatch(t, w.w, dir)
+
+	mkdir(t, tmp, "dir.new")
+	touch(t, tmp, "dir.new", "file")
+	mv(t, dir, tmp, "dir.old")
+	mv(t, filepath.Join(tmp, "dir.new"), dir)
+	touch(t, dir, "file2")
+	touch(t, tmp, "dir.old", "file3")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		rename  /dir
+		create  /dir
+		create  /dir/file2
+	`))
+}
+
+func TestAddAll(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	names := []string{
+		filepath.Join(tmp, "a"),
+		filepath.Join(tmp, "missing"),
+		filepath.Join(tmp, "b"),
+		filepath.Join(tmp, "a"),
+	}
+	touch(t, names[0], noWait)
+	touch(t, names[2], noWait)
+
+	w := newCollector(t)
+	w.collect(t)
+
+	errs := w.w.AddAll(names)
+	if len(errs) != len(names) {
+		t.Fatalf("have %d errors, want %d", len(errs), len(names))
+	}
+	for i, err := range errs {
+		if i == 1 {
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("errs[%d]: expected ErrNotExist, got: %v", i, err)
+			}
+		} else if err != nil {
+			t.Errorf("errs[%d]: %s", i, err)
+		}
+	}
+
+	cat(t, "data", names[0])
+	cat(t, "data", names[2])
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write  /a
+		write  /b
+	`))
+}
+
+func TestSetLogger(t *testing.T) {
+	t.Parallel()
+
+	// logged sets a logger, runs fn, and returns the messages that were
+	// logged.
+	logged := func(t *testing.T, w *Watcher, fn func()) []string {
+		var (
+			mu   sync.Mutex
+			msgs []string
+		)
+		w.SetLogger(func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			msgs = append(msgs, fmt.Sprintf(format, args...))
+		})
+		fn()
+		w.SetLogger(nil)
+
+		mu.Lock()
+		defer mu.Unlock()
+		return msgs
+	}
+
+	t.Run("rescan", func(t *testing.T) {
+		t.Parallel()
+		tmp := t.TempDir()
+
+		w := newCollector(t)
+		w.collect(t)
+		addWatch(t, w.w, tmp)
+
+		msgs := logged(t, w.w, func() {
+			if err := w.w.Rescan(tmp); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if err := w.w.Rescan(tmp); err != nil {
+			t.Fatal(err)
+		}
+		w.stop(t)
+
+		want := "rescanning directory " + tmp
+		if len(msgs) != 1 || msgs[0] != want {
+			t.Errorf("wrong messages\nhave: %q\nwant: %q", msgs, []string{want})
+		}
+	})
+
+	t.Run("symlink", func(t *testing.T) {
+		t.Parallel()
+		tmp := t.TempDir()
+		touch(t, tmp, "file", noWait)
+		link := filepath.Join(tmp, "link")
+		if err := os.Symlink(filepath.Join(tmp, "file"), link); err != nil {
+			t.Skipf("can't create symlinks: %s", err)
+		}
+		target, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := newWatcher(t)
+		defer w.Close()
+		msgs := logged(t, w, func() { addWatch(t, w, link) })
+
+		want := "following symlink " + link + " to " + target
+		if len(msgs) != 1 || msgs[0] != want {
+			t.Errorf("wrong messages\nhave: %q\nwant: %q", msgs, []string{want})
+		}
+	})
+
+	t.Run("special file", func(t *testing.T) {
+		t.Parallel()
+		tmp := t.TempDir()
+		fifo := filepath.Join(tmp, "fifo")
+		mkfifo(t, fifo, noWait)
+
+		w := newWatcher(t)
+		defer w.Close()
+		msgs := logged(t, w, func() { addWatch(t, w, fifo) })
+
+		// kqueue skips it, and inotify watches it like any other file.
+		if len(msgs) != 1 || !strings.Contains(msgs[0], "named pipe "+fifo) {
+			t.Errorf("wrong messages\nhave: %q\nwant a message for the named pipe %q", msgs, fifo)
+		}
+	})
+}
+
+func TestWatchChildrenOnly(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "dir")
+	file := filepath.Join(tmp, "file")
+	mkdir(t, dir, noWait)
+	touch(t, file, noWait)
+
+	w := newCollector(t, WithChildrenOnly(), WithDirWriteEvents())
+	w.collect(t)
+	addWatch(t, w.w, dir)
+	addWatch(t, w.w, file)
+
+	touch(t, dir, "child")
+	chmod(t, 0o700, dir)
+	cat(t, "data", file)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create /dir/child
+		write  /file
+	`))
+}
+
+func TestSetPathNormalizer(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "dir")
+	mkdir(t, dir, noWait)
+
+	// Keep a trailing separator.
+	sep := string(filepath.Separator)
+	normalize := func(name string) string {
+		if strings.HasSuffix(name, sep) {
+			return filepath.Clean(name) + sep
+		}
+		return filepath.Clean(name)
+	}
+
+	w := newCollector(t)
+	w.w.SetPathNormalizer(normalize)
+	w.collect(t)
+	if err := w.w.Add(dir + sep); err != nil {
+		t.Fatal(err)
+	}
+
+	if !w.w.IsWatching(dir + sep) {
+		t.Errorf("not watching %q", dir+sep)
+	}
+	touch(t, dir, "file")
+	// Watches are found by the file rather than the path on Windows.
+	if runtime.GOOS != "windows" {
+		if err := w.w.Remove(dir); !errors.Is(err, ErrNonExistentWatch) {
+			t.Errorf("Remove with a different normalized path: have %v, want ErrNonExistentWatch", err)
+		}
+	}
+	if err := w.w.Remove(dir + sep); err != nil {
+		t.Errorf("Remove: %v", err)
+	}
+
+	have := w.stop(t)
+	if len(have) == 0 || have[0].Name != filepath.Join(dir, "file") || have[0].Op&Create == 0 {
+		t.Errorf("wrong events:\n%s", have)
+	}
+}
+
+func TestWatchIgnoreHidden(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, ".hidden", noWait)
+
+	w := newCollector(t, WithIgnoreHidden())
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+	addWatch(t, w.w, tmp, ".hidden")
+
+	touch(t, tmp, ".file")
+	cat(t, "data", tmp, ".file")
+	touch(t, tmp, "file")
+	touch(t, tmp, ".hidden", "file")
+	rm(t, tmp, ".file")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create /file
+		create /.hidden/file
+	`))
+}
+
+func TestMemStats(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "a", noWait)
+	touch(t, tmp, "b", noWait)
+
+	w := newCollector(t, WithSizeTracking())
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+	cat(t, "data", tmp, "a")
+	waitForEvents()
+
+	s := w.w.MemStats()
+	if s.Watches != w.w.Count() {
+		t.Errorf("Watches: have %d, want %d", s.Watches, w.w.Count())
+	}
+	if s.Paths < 1 {
+		t.Errorf("Paths: have %d, want at least 1", s.Paths)
+	}
+	if s.Sizes != 1 {
+		t.Errorf("Sizes: have %d, want 1", s.Sizes)
+	}
+	switch runtime.GOOS {
+	case "linux", "windows":
+		if s.Files != 0 {
+			t.Errorf("Files: have %d, want 0", s.Files)
+		}
+	default:
+		if s.Files != 2 {
+			t.Errorf("Files: have %d, want 2", s.Files)
+		}
+	}
+	w.stop(t)
+}
@@ -10,10 +10,14 @@ package fsnotify
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -22,27 +26,65 @@ import (
 type Watcher struct {
 	Events chan Event
 	Errors chan error
-	done   chan struct{}
+	done   chan struct{} // Closed when Close is called.
+	closed chan struct{} // Closed when the reader goroutine has stopped.
 
 	kq        int    // File descriptor (as returned by the kqueue() syscall).
 	closepipe [2]int // Pipe used for closing.
 
-	mu              sync.Mutex        // Protects access to watcher data
-	watches         map[string]int    // Map of watched file descriptors (key: path).
-	externalWatches map[string]bool   // Map of watches added by user of the library.
-	dirFlags        map[string]uint32 // Map of watched directories to fflags used in kqueue.
-	paths           map[int]pathInfo  // Map file descriptors to path names for processing kqueue events.
-	fileExists      map[string]bool   // Keep track of if we know this file exists (to stop duplicate create events).
-	isClosed        bool              // Set to true when Close() is first called
+	mu              sync.Mutex          // Protects access to watcher data
+	watches         map[string]int      // Map of watched file descriptors (key: path).
+	externalWatches map[string]bool     // Map of watches added by user of the library.
+	dirFlags        map[string]uint32   // Map of watched directories to fflags used in kqueue.
+	paths           map[int]pathInfo    // Map file descriptors to path names for processing kqueue events.
+	fileExists      knownFiles          // Keep track of if we know this file exists (to stop duplicate create events).
+	excluded        map[string]bool     // Files in a watched directory that were explicitly removed with Remove().
+	adding          map[string]*addCall // addWatch calls in progress.
+	isClosed        bool                // Set to true when Close() is first called
+	reopen          chan chan error     // Reopen() requests for the reader goroutine.
+	reopenMu        sync.Mutex          // Only one Reopen() at a time.
+	opts            withOpts            // Options passed to NewWatcher.
+	scans           scanQueue           // Events for WithInitialScan.
+	pipeline        eventPipeline       // Options that change or drop events; see eventPipeline.
+	internal        internalWatches     // Watches for WithDeferredCreate.
+	attrs           attrCache           // Attributes for WithAttrDetail.
+	drops           dropCounter         // Events discarded by the backpressure policy.
+	removed         removedPrefixes     // Directories removed with RemovePrefix.
+	links           linkNames           // Names passed to Add, for WithOriginalNames.
+	paused          bool                // Set by Pause; guarded by mu.
+	suppressed      int                 // Events discarded while paused; guarded by mu.
+	draining        int32               // Set by CloseAndDrain; accessed atomically.
+	errDrops        uint64              // Errors discarded for WithDropErrors; accessed atomically.
+	seq             uint64              // Last Event.Seq; accessed atomically.
+	interrupts      uint64              // kevent calls interrupted by a signal; accessed atomically.
+	onEvent         atomic.Value        // Function set with OnEvent.
+	logger          atomic.Value        // Function set with SetLogger.
+	normalizer      atomic.Value        // Function set with SetPathNormalizer.
+	mapper          atomic.Value        // EventMapper set with SetEventMapper.
+	errSenders      sync.WaitGroup      // Goroutines started by sendErrors.
+
+	// Directories to read after a Write; only used by readEvents.
+	rescans  map[string]struct{}
+	rescanAt time.Time
+
+	// Directories to read for Rescan; protected by mu.
+	requested map[string]struct{}
+
+	// Watches checked for WithPollFallback; only used by readEvents.
+	polls  map[string]*pollState
+	pollAt time.Time
 }
 
 type pathInfo struct {
-	name  string
-	isDir bool
+	name      string
+	isDir     bool
+	isSpecial bool   // Device or named pipe.
+	flags     uint32 // fflags this watch was registered with.
+	byFd      bool   // Added with AddFile; name may not be a path.
 }
 
 // NewWatcher establishes a new watcher with the underlying OS and begins waiting for events.
-func NewWatcher() (*Watcher, error) {
+func NewWatcher(opts ...Option) (*Watcher, error) {
 	kq, closepipe, err := kqueue()
 	if err != nil {
 		return nil, err
@@ -54,17 +96,34 @@ func NewWatcher() (*Watcher, error) {
 		watches:         make(map[string]int),
 		dirFlags:        make(map[string]uint32),
 		paths:           make(map[int]pathInfo),
-		fileExists:      make(map[string]bool),
 		externalWatches: make(map[string]bool),
-		Events:          make(chan Event),
-		Errors:          make(chan error),
+		excluded:        make(map[string]bool),
+		adding:          make(map[string]*addCall),
+		reopen:          make(chan chan error, 1),
 		done:            make(chan struct{}),
+		closed:          make(chan struct{}),
+		opts:            getOptions(opts...),
 	}
+	w.Events = make(chan Event, w.opts.eventsBuffer(0))
+	w.Errors = make(chan error, w.opts.errorsBuffer)
 
 	go w.readEvents()
 	return w, nil
 }
 
+// Closed reports if Close was called.
+func (w *Watcher) Closed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.isClosed
+}
+
+// Done returns a channel that's closed once the watcher has fully stopped
+// after Close, and the Events and Errors channels are closed.
+func (w *Watcher) Done() <-chan struct{} {
+	return w.closed
+}
+
 // Close removes all watches and closes the events channel.
 func (w *Watcher) Close() error {
 	w.mu.Lock()
@@ -73,86 +132,624 @@ func (w *Watcher) Close() error {
 		return nil
 	}
 	w.isClosed = true
+	// Stop a reader that's blocked on sending an event that's never read.
+	close(w.done)
 
 	// copy paths to remove while locked
 	pathsToRemove := make([]string, 0, len(w.watches))
 	for name := range w.watches {
 		pathsToRemove = append(pathsToRemove, name)
 	}
+	// The closepipe is never replaced after isClosed is set; see reopenKqueue.
+	closepipe := w.closepipe[1]
 	w.mu.Unlock()
 	// unlock before calling Remove, which also locks
 
 	for _, name := range pathsToRemove {
-		w.Remove(name)
+		w.remove(name)
 	}
+	w.resetDeferred()
 
 	// Send "quit" message to the reader goroutine.
-	unix.Close(w.closepipe[1])
+	unix.Close(closepipe)
 
 	return nil
 }
 
+// Reopen replaces the kqueue with a new one, and registers all current
+// watches on it again with the same flags.
+//
+// This can be used to recover after the kqueue descriptor was lost, for
+// example in a child process after fork(), as kqueues are not inherited. The
+// Events and Errors channels stay the same.
+func (w *Watcher) Reopen() error {
+	w.reopenMu.Lock()
+	defer w.reopenMu.Unlock()
+
+	req := make(chan error, 1)
+	w.mu.Lock()
+	if w.isClosed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.reopen <- req
+	// Wake up the reader; this gets picked up in readEvents, which does the
+	// actual work.
+	_, err := unix.Write(w.closepipe[1], []byte{0})
+	w.mu.Unlock()
+	if err != nil {
+		<-w.reopen
+		return err
+	}
+
+	select {
+	case err := <-req:
+		return err
+	case <-w.done:
+		return ErrClosed
+	}
+}
+
 // Add starts watching the named file or directory (non-recursively).
+//
+// The watch is registered with the kqueue when Add returns: any change to the
+// file, or to the directory and the files that are in it at that point, is
+// reported. Files created in a watched directory afterwards are watched once
+// their Create event is read, so a change made right after creating a file
+// may be missed.
+//
+// Sockets and named pipes aren't watched, unless the Watcher was created with
+// WithWatchSpecialFiles. Block and character devices and named pipes are only
+// watched for Chmod, Remove, and Rename, as reading from or writing to them
+// isn't reported consistently by the BSDs.
 func (w *Watcher) Add(name string) error {
+	cleaned := w.cleanPath(name)
+	if w.opts.deferred() {
+		w.claimDeferred(cleaned, 0)
+	}
+
+	w.mu.Lock()
+	w.externalWatches[cleaned] = true
+	delete(w.excluded, cleaned)
+	w.removed.clear(cleaned)
+	var scan func([]Event)
+	if w.opts.initialScan && !w.isClosed {
+		scan = w.scans.add(w.deliverEvent, w.done)
+	}
+	w.mu.Unlock()
+
+	realName, err := w.addOrDefer(name)
+	if err == nil && w.opts.rootRemoved {
+		w.pipeline.roots.add(cleaned)
+	}
+	if err == nil && w.opts.childrenOnly {
+		w.pipeline.roots.addDir(cleaned)
+		if realName != "" {
+			w.pipeline.roots.addDir(realName)
+		}
+	}
+	if err == nil && w.opts.origNames && realName != "" {
+		w.links.add(realName, cleaned)
+	}
+	if scan != nil {
+		var events []Event
+		if err == nil {
+			events = w.existingFileEvents(realName)
+		}
+		scan(events)
+	}
+	return err
+}
+
+// AddRaw is like Add, but registers the watch with exactly the NOTE_* fflags
+// in fflags instead of the ones that are needed to report every Op; for
+// example only unix.NOTE_DELETE|unix.NOTE_RENAME to find out when a lock file
+// goes away. A directory is only scanned for files if fflags has NOTE_WRITE.
+//
+// This is only available on BSD and macOS, and isn't portable. If name is
+// already watched, fflags are added to the flags it's watched with; flags
+// are never removed from an existing watch. Options such as
+// WithDeferredCreate and WithInitialScan don't apply to AddRaw.
+func (w *Watcher) AddRaw(name string, fflags uint32) error {
+	name = w.cleanPath(name)
+	w.mu.Lock()
+	delete(w.excluded, name)
+	w.removed.clear(name)
+	w.mu.Unlock()
+
+	if _, err := w.addWatch(name, fflags); err != nil {
+		return err
+	}
 	w.mu.Lock()
 	w.externalWatches[name] = true
 	w.mu.Unlock()
-	_, err := w.addWatch(name, noteAllEvents)
+	return nil
+}
+
+// AddFile starts watching the file or directory f, which is already open,
+// without opening it again by its path; for example in a sandbox where the
+// path can't be opened. The events have f.Name() as the Name.
+//
+// The file descriptor is duplicated, so f can be closed afterwards. The files
+// in a directory are still found and watched by their path.
+//
+// To watch a descriptor that doesn't have a path, such as one inherited from a
+// parent process, wrap it with os.NewFile and the name the events should have.
+// For a directory the name has to be its path, to read the files in it.
+func (w *Watcher) AddFile(f *os.File) error {
+	name := w.cleanPath(f.Name())
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var (
+		fd     int
+		dupErr error
+	)
+	if err := rc.Control(func(s uintptr) { fd, dupErr = unix.Dup(int(s)) }); err != nil {
+		return err
+	}
+	if dupErr != nil {
+		return &os.PathError{Op: "dup", Path: name, Err: dupErr}
+	}
+	unix.CloseOnExec(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return &os.PathError{Op: "fstat", Path: name, Err: err}
+	}
+	fi := &statInfo{name: filepath.Base(name), st: st}
+	isDir := fi.IsDir()
+	isSpecial := fi.Mode()&(os.ModeDevice|os.ModeNamedPipe) != 0
+
+	w.mu.Lock()
+	if w.isClosed {
+		w.mu.Unlock()
+		unix.Close(fd)
+		return ErrClosed
+	}
+	w.externalWatches[name] = true
+	delete(w.excluded, name)
+	w.removed.clear(name)
+	w.mu.Unlock()
+
+	nw := &newWatch{
+		name:      name,
+		watchfd:   fd,
+		isDir:     isDir,
+		isSpecial: isSpecial,
+		flags:     w.watchFlags(w.noteFlags(), isDir, isSpecial),
+		byFd:      true,
+	}
+	if err := w.registerWatches([]*newWatch{nw})[0]; err != nil {
+		return err
+	}
+	_, err = w.watchDirectory(nw)
 	return err
 }
 
+// AddWith is like Add, but with options for this watch.
+//
+// WithAccess isn't supported and fails with ErrUnsupported.
+func (w *Watcher) AddWith(name string, opts ...AddOption) error {
+	if getAddOptions(opts...).access {
+		return fmt.Errorf("%w: WithAccess: %s", ErrUnsupported, name)
+	}
+	return w.Add(name)
+}
+
+// AddAll starts watching all the named files or directories
+// (non-recursively).
+//
+// This is faster than calling Add for every path, as the watches are
+// registered with the kqueue in as few system calls as possible. The returned
+// slice has an error (or nil) for every name, in the same order.
+func (w *Watcher) AddAll(names []string) []error {
+	errs := make([]error, len(names))
+
+	cleaned := make([]string, len(names))
+	for i, name := range names {
+		cleaned[i] = w.cleanPath(name)
+	}
+	if w.opts.deferred() {
+		for _, name := range cleaned {
+			w.claimDeferred(name, 0)
+		}
+	}
+
+	scans := make([]func([]Event), len(names))
+	w.mu.Lock()
+	for i, name := range cleaned {
+		w.externalWatches[name] = true
+		delete(w.excluded, name)
+		w.removed.clear(name)
+		if w.opts.initialScan && !w.isClosed {
+			scans[i] = w.scans.add(w.deliverEvent, w.done)
+		}
+	}
+	w.mu.Unlock()
+
+	var (
+		pending = make([]*newWatch, 0, len(names))
+		idx     = make([]int, 0, len(names))
+		seen    = make(map[string]struct{}, len(names))
+		flags   = w.noteFlags()
+	)
+	for i, name := range names {
+		// Opening the same path twice would leak a file descriptor.
+		if _, ok := seen[cleaned[i]]; ok {
+			continue
+		}
+		seen[cleaned[i]] = struct{}{}
+
+		nw, _, err := w.openWatch(name, flags)
+		if nw == nil {
+			errs[i] = err
+			continue
+		}
+		pending = append(pending, nw)
+		idx = append(idx, i)
+	}
+
+	realNames := make([]string, len(names))
+	for j, err := range w.registerWatches(pending) {
+		if err == nil {
+			realNames[idx[j]], err = w.watchDirectory(pending[j])
+		}
+		if err == nil && w.opts.attrDetail {
+			w.attrs.add(realNames[idx[j]])
+		}
+		errs[idx[j]] = err
+	}
+
+	if w.opts.deferredCreate {
+		for i, err := range errs {
+			if errors.Is(err, os.ErrNotExist) {
+				realNames[i], errs[i] = w.addOrDefer(names[i])
+			}
+		}
+	}
+
+	if w.opts.rootRemoved {
+		for i, err := range errs {
+			if err == nil {
+				w.pipeline.roots.add(cleaned[i])
+			}
+		}
+	}
+	if w.opts.childrenOnly {
+		for i, err := range errs {
+			if err == nil {
+				w.pipeline.roots.addDir(cleaned[i])
+				if realNames[i] != "" {
+					w.pipeline.roots.addDir(realNames[i])
+				}
+			}
+		}
+	}
+	if w.opts.origNames {
+		for i, err := range errs {
+			if err == nil && realNames[i] != "" {
+				w.links.add(realNames[i], cleaned[i])
+			}
+		}
+	}
+
+	for i, scan := range scans {
+		if scan == nil {
+			continue
+		}
+		var events []Event
+		if errs[i] == nil && realNames[i] != "" {
+			events = w.existingFileEvents(realNames[i])
+		}
+		scan(events)
+	}
+	return errs
+}
+
 // Remove stops watching the the named file or directory (non-recursively).
+//
+// Files in a watched directory can also be removed, even if they were never
+// added with Add. No more events will be sent for that file, even if it's
+// deleted and re-created, until it's added again with Add or the directory
+// itself is removed.
+//
+// The error is ErrNonExistentWatch (check with errors.Is) if name isn't
+// watched, including when it was already removed by a concurrent call to
+// Remove, so that this can be ignored during teardown.
 func (w *Watcher) Remove(name string) error {
-	name = filepath.Clean(name)
+	name = w.cleanPath(name)
 	w.mu.Lock()
-	watchfd, ok := w.watches[name]
+	if w.isClosed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	if _, ok := w.watches[name]; ok && !w.externalWatches[name] {
+		w.excluded[name] = true
+	}
 	w.mu.Unlock()
+	if w.opts.rootRemoved || w.opts.childrenOnly {
+		w.pipeline.roots.remove(name)
+	}
+	if w.opts.deferred() {
+		if ok, err := w.unwatchDeferred(name); ok {
+			return err
+		}
+	}
+	if w.opts.origNames {
+		real, inUse := w.links.remove(name)
+		if inUse {
+			// Still watched through another name.
+			return nil
+		}
+		name = real
+	}
+	return w.remove(name)
+}
+
+func (w *Watcher) remove(name string) error {
+	// Look up and forget the watch in one go, so that a concurrent remove
+	// for the same name gets ErrNonExistentWatch rather than an error for a
+	// closed descriptor.
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropWatch(name)
+}
+
+// removePrefix is RemovePrefix: the paths added by the user are forgotten
+// first, and then every watch below dir is removed while holding w.mu, so
+// that a directory that's read in the meantime can't watch the files in it
+// again.
+func (w *Watcher) removePrefix(dir string) error {
+	var (
+		errs multiError
+		real []string
+	)
+	for _, name := range w.userWatchesBelow(dir) {
+		if w.opts.rootRemoved || w.opts.childrenOnly {
+			w.pipeline.roots.remove(name)
+		}
+		if w.opts.deferred() {
+			if ok, err := w.unwatchDeferred(name); ok {
+				if err != nil {
+					errs = append(errs, err)
+				}
+				continue
+			}
+		}
+		if w.opts.origNames {
+			// The link may point outside of dir.
+			if r, inUse := w.links.remove(name); !inUse && r != name {
+				real = append(real, r)
+			}
+		}
+	}
+
+	w.mu.Lock()
+	for name := range w.watches {
+		if hasPathPrefix(name, dir) {
+			real = append(real, name)
+		}
+	}
+	for _, name := range real {
+		if err := w.dropWatch(name); err != nil && !errors.Is(err, ErrNonExistentWatch) {
+			errs = append(errs, err)
+		}
+	}
+	for name := range w.externalWatches {
+		if hasPathPrefix(name, dir) {
+			delete(w.externalWatches, name)
+		}
+	}
+	for name := range w.excluded {
+		if hasPathPrefix(name, dir) {
+			delete(w.excluded, name)
+		}
+	}
+	w.mu.Unlock()
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// dropWatch removes the watch for name, along with the watches for the files
+// in it that weren't added by the user if it's a directory.
+//
+// The caller must hold w.mu.
+func (w *Watcher) dropWatch(name string) error {
+	watchfd, ok := w.watches[name]
 	if !ok {
 		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
 	}
-
 	err := register(w.kq, []int{watchfd}, unix.EV_DELETE, 0)
 	if err != nil {
-		return err
+		return &os.PathError{Op: "kevent", Path: name, Err: err}
 	}
-
-	unix.Close(watchfd)
-
-	w.mu.Lock()
 	isDir := w.paths[watchfd].isDir
 	delete(w.watches, name)
 	delete(w.paths, watchfd)
 	delete(w.dirFlags, name)
-	w.mu.Unlock()
+	unix.Close(watchfd)
 
 	// Find all watched paths that are in this directory that are not external.
 	if isDir {
 		var pathsToRemove []string
-		w.mu.Lock()
 		for _, path := range w.paths {
 			wdir, _ := filepath.Split(path.name)
-			if filepath.Clean(wdir) == name {
+			if w.cleanPath(wdir) == name {
 				if !w.externalWatches[path.name] {
 					pathsToRemove = append(pathsToRemove, path.name)
 				}
 			}
 		}
-		w.mu.Unlock()
+		for path := range w.excluded {
+			wdir, _ := filepath.Split(path)
+			if w.cleanPath(wdir) == name {
+				delete(w.excluded, path)
+			}
+		}
 		for _, name := range pathsToRemove {
 			// Since these are internal, not much sense in propagating error
 			// to the user, as that will just confuse them with an error about
 			// a path they did not explicitly watch themselves.
-			w.Remove(name)
+			w.dropWatch(name)
 		}
 	}
 
 	return nil
 }
 
+// Rescan reads the watched directory name again, and sends a Create event for
+// every file that's new and a Remove event for every file that's gone since
+// the last time it was read, as if the kevents for them were read. New
+// directories are watched as usual. This can be used to get back in sync after
+// ErrEventOverflow. It does nothing for a watched file.
+//
+// The directory is read by the goroutine that reads the kevents, so Rescan
+// doesn't wait for the events to be received and can be called from the loop
+// that receives them.
+//
+// The error is ErrNonExistentWatch if name isn't watched.
+func (w *Watcher) Rescan(name string) error {
+	name = w.cleanPath(name)
+	w.mu.Lock()
+	closed := w.isClosed
+	watchfd, ok := w.watches[name]
+	isDir := ok && w.paths[watchfd].isDir
+	w.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	if !isDir {
+		return nil
+	}
+
+	// The directory is read in readEvents, so that the events are sent in
+	// order with the others, and Rescan doesn't block on sending them.
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed {
+		return ErrClosed
+	}
+	if w.requested == nil {
+		w.requested = make(map[string]struct{})
+	}
+	w.requested[name] = struct{}{}
+	// EAGAIN means the pipe is full: readEvents is woken up anyway, and reads
+	// all requested directories at once.
+	if _, err := unix.Write(w.closepipe[1], []byte{1}); err != nil && err != unix.EAGAIN {
+		delete(w.requested, name)
+		return err
+	}
+	return nil
+}
+
+// flushRequested reads the directories requested with Rescan. It must be
+// called from the readEvents goroutine; it returns false if the watcher was
+// closed.
+func (w *Watcher) flushRequested() bool {
+	w.mu.Lock()
+	dirs := w.requested
+	w.requested = nil
+	w.mu.Unlock()
+
+	for dirPath := range dirs {
+		err := w.sendDirectoryChangeEvents(dirPath, true)
+		if err != nil && !os.IsNotExist(err) {
+			if !w.sendError(watchError("readdir", dirPath, err)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Dropped returns the number of events that were discarded because of the
+// backpressure policy or the rate limit; see WithBackpressure and
+// WithRateLimit.
+func (w *Watcher) Dropped() uint64 {
+	return w.drops.count()
+}
+
+// DroppedErrors returns the number of errors that were discarded because
+// nobody received them; see WithDropErrors.
+func (w *Watcher) DroppedErrors() uint64 {
+	return atomic.LoadUint64(&w.errDrops)
+}
+
+// Interrupted returns the number of times reading the kqueue was interrupted
+// by a signal (EINTR), to tell if that happens excessively. It's retried right
+// away.
+func (w *Watcher) Interrupted() uint64 {
+	return atomic.LoadUint64(&w.interrupts)
+}
+
+// Backend returns the name of the mechanism the Watcher uses to watch files,
+// for diagnostics: "kqueue" on this platform.
+func (w *Watcher) Backend() string {
+	return "kqueue"
+}
+
+// Count returns the number of watches. This includes the files in watched
+// directories, which are watched individually.
+func (w *Watcher) Count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.watches)
+}
+
+// MemStats returns the size of the state kept for the watched files. With
+// kqueue every file in a watched directory has a watch and is in Files, unless
+// WithDirOnly is used, which only keeps it in Files.
+func (w *Watcher) MemStats() MemStats {
+	w.mu.Lock()
+	s := MemStats{Watches: len(w.watches), Paths: len(w.paths), Files: w.fileExists.len()}
+	w.mu.Unlock()
+	s.Sizes = w.pipeline.sizes.len()
+	s.Attrs = w.attrs.len()
+	return s
+}
+
+// SetMaxWatches changes the limit on the number of watches set with
+// WithMaxWatches; n <= 0 removes the limit. Watches that are already there
+// are kept if there are more than n, but adding more fails with
+// ErrMaxWatchesExceeded until there are fewer.
+func (w *Watcher) SetMaxWatches(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.opts.maxWatches = n
+}
+
+// WatchCount returns the number of paths that WatchList would return, without
+// allocating the list.
+//
+// Returns 0 if the watcher is closed.
+func (w *Watcher) WatchCount() int {
+	w.mu.Lock()
+	closed := w.isClosed
+	w.mu.Unlock()
+	if closed {
+		return 0
+	}
+	return w.Count()
+}
+
 // WatchList returns the directories and files that are being monitered.
+//
+// Returns nil if the watcher is closed.
 func (w *Watcher) WatchList() []string {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if w.isClosed {
+		return nil
+	}
 
 	entries := make([]string, 0, len(w.watches))
 	for pathname := range w.watches {
@@ -162,119 +759,602 @@ func (w *Watcher) WatchList() []string {
 	return entries
 }
 
+// IsWatching reports if name is watched, as it would be listed by WatchList.
+// name is cleaned the same way as with Remove.
+//
+// Returns false if the watcher is closed.
+func (w *Watcher) IsWatching(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed {
+		return false
+	}
+	_, ok := w.watches[w.cleanPath(name)]
+	return ok
+}
+
+// addDeferredWatch, removeDeferredWatch, and isUserWatch manage the watches
+// for WithDeferredCreate; see deferredWatches.
+func (w *Watcher) addDeferredWatch(name string, target bool) error {
+	if target {
+		// There is a Create event for it already; don't send another one
+		// from sendFileCreatedEventIfNew.
+		w.mu.Lock()
+		w.externalWatches[name] = true
+		w.fileExists.add(name)
+		w.mu.Unlock()
+	}
+	_, err := w.addWatch(name, w.noteFlags())
+	return err
+}
+
+func (w *Watcher) removeDeferredWatch(name string) {
+	w.mu.Lock()
+	delete(w.externalWatches, name)
+	w.mu.Unlock()
+	w.remove(name)
+}
+
+func (w *Watcher) isUserWatch(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.watches[name]
+	return ok && w.externalWatches[name]
+}
+
 // Watch all events (except NOTE_EXTEND, NOTE_LINK, NOTE_REVOKE)
 const noteAllEvents = unix.NOTE_DELETE | unix.NOTE_WRITE | unix.NOTE_ATTRIB | unix.NOTE_RENAME
 
+// Events that are only watched with WithExtendedEvents.
+const noteExtendedEvents = unix.NOTE_EXTEND | unix.NOTE_LINK | unix.NOTE_REVOKE
+
+// noteFlags returns the fflags to watch files with.
+func (w *Watcher) noteFlags() uint32 {
+	if w.opts.extendedEvents {
+		return noteAllEvents | noteExtendedEvents
+	}
+	return noteAllEvents
+}
+
+// linkNames maps the real paths of watches back to the names that were passed
+// to Add, for WithOriginalNames. Only paths that were added through a symlink
+// are recorded.
+type linkNames struct {
+	mu     sync.Mutex
+	names  map[string][]string // Real path → names passed to Add.
+	direct map[string]bool     // Real paths that were also passed to Add as is.
+}
+
+// add records that name was passed to Add, and is watched as real.
+func (l *linkNames) add(real, name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.names == nil {
+		l.names = make(map[string][]string)
+		l.direct = make(map[string]bool)
+	}
+	if real == name {
+		l.direct[real] = true
+		return
+	}
+	for _, n := range l.names[real] {
+		if n == name {
+			return
+		}
+	}
+	l.names[real] = append(l.names[real], name)
+}
+
+// remove forgets name. It returns the real path to remove the watch for, and
+// true if that's still needed for another name.
+func (l *linkNames) remove(name string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.direct[name] {
+		delete(l.direct, name)
+		return name, len(l.names[name]) > 0
+	}
+	for real, names := range l.names {
+		for i, n := range names {
+			if n != name {
+				continue
+			}
+			names = append(names[:i:i], names[i+1:]...)
+			if len(names) > 0 {
+				l.names[real] = names
+			} else {
+				delete(l.names, real)
+			}
+			return real, len(names) > 0 || l.direct[real]
+		}
+	}
+	return name, false
+}
+
+// events returns e with the name of every path it was added as, or nil if
+// it's not for a path that was added through a symlink.
+func (l *linkNames) events(e Event) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Use the closest link if they're nested, as that's the one the file is
+	// watched for.
+	var match string
+	for real := range l.names {
+		if len(real) > len(match) && (e.Name == real || strings.HasPrefix(e.Name, real+string(filepath.Separator))) {
+			match = real
+		}
+	}
+	if match == "" {
+		return nil
+	}
+
+	names, rest := l.names[match], e.Name[len(match):]
+	events := make([]Event, 0, len(names)+1)
+	if l.direct[match] {
+		events = append(events, e)
+	}
+	for _, n := range names {
+		e.Name = n + rest
+		events = append(events, e)
+	}
+	return events
+}
+
+// knownFiles is the set of files that we know exist, by directory, so that
+// the files in one directory can be found without going over all of them. It's
+// guarded by Watcher.mu.
+type knownFiles struct {
+	dirs map[string]map[string]struct{} // Directory → names of the files in it.
+	n    int
+}
+
+func (k *knownFiles) has(name string) bool {
+	dir, file := filepath.Split(name)
+	_, ok := k.dirs[filepath.Clean(dir)][file]
+	return ok
+}
+
+func (k *knownFiles) add(name string) {
+	dir, file := filepath.Split(name)
+	dir = filepath.Clean(dir)
+	if k.dirs == nil {
+		k.dirs = make(map[string]map[string]struct{})
+	}
+	files, ok := k.dirs[dir]
+	if !ok {
+		files = make(map[string]struct{})
+		k.dirs[dir] = files
+	}
+	if _, ok := files[file]; !ok {
+		files[file] = struct{}{}
+		k.n++
+	}
+}
+
+func (k *knownFiles) remove(name string) {
+	dir, file := filepath.Split(name)
+	dir = filepath.Clean(dir)
+	files := k.dirs[dir]
+	if _, ok := files[file]; !ok {
+		return
+	}
+	delete(files, file)
+	k.n--
+	if len(files) == 0 {
+		delete(k.dirs, dir)
+	}
+}
+
+// in returns the names of the files in dir. The map must not be modified.
+func (k *knownFiles) in(dir string) map[string]struct{} {
+	return k.dirs[dir]
+}
+
+func (k *knownFiles) len() int {
+	return k.n
+}
+
+// addCall is an addWatch that's in progress.
+type addCall struct {
+	flags    uint32
+	realName string
+	err      error
+	done     chan struct{}
+}
+
 // addWatch adds name to the watched file set.
 // The flags are interpreted as described in kevent(2).
 // Returns the real path to the file which was added, if any, which may be different from the one passed in the case of symlinks.
+//
+// If name is already being added with the same flags, this waits for that to
+// finish and returns the same result, rather than opening and registering it
+// again.
 func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
-	var isDir bool
+	key := w.cleanPath(name)
+	var c *addCall
+	for {
+		w.mu.Lock()
+		cur, ok := w.adding[key]
+		if !ok {
+			c = &addCall{flags: flags, done: make(chan struct{})}
+			w.adding[key] = c
+			w.mu.Unlock()
+			break
+		}
+		w.mu.Unlock()
+
+		<-cur.done
+		if flags&^cur.flags == 0 {
+			return cur.realName, cur.err
+		}
+	}
+	defer func() {
+		w.mu.Lock()
+		delete(w.adding, key)
+		w.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.realName, c.err = w.addWatchOnce(name, flags)
+	return c.realName, c.err
+}
+
+// addWatchOnce does the work for addWatch.
+func (w *Watcher) addWatchOnce(name string, flags uint32) (string, error) {
+	nw, realName, err := w.openWatch(name, flags)
+	if nw == nil {
+		return realName, err
+	}
+	if err := w.registerWatches([]*newWatch{nw})[0]; err != nil {
+		return "", err
+	}
+	return w.watchDirectory(nw)
+}
+
+// addOrDefer adds a watch for name, or waits for it to be created with
+// WithDeferredCreate.
+func (w *Watcher) addOrDefer(name string) (string, error) {
+	realName, err := w.addWatch(name, w.noteFlags())
+	if err == nil && w.opts.attrDetail {
+		w.attrs.add(realName)
+	}
+	if w.opts.deferredCreate && errors.Is(err, os.ErrNotExist) {
+		var exists bool
+		if exists, err = w.deferWatch(w.cleanPath(name)); exists {
+			return w.addWatch(name, w.noteFlags())
+		}
+	}
+	return realName, err
+}
+
+// resolveWatch follows name if it's a symlink, and returns the path to watch
+// and its FileInfo. The FileInfo is nil if there's nothing to watch: for a
+// broken symlink, a socket, or a named pipe without WithWatchSpecialFiles.
+func (w *Watcher) resolveWatch(name string) (string, os.FileInfo, error) {
+	fi, err := lstat(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Follow Symlinks
+	// Unfortunately, Linux can add bogus symlinks to watch list without
+	// issue, and Windows can't do symlinks period (AFAIK). To  maintain
+	// consistency, we will act like everything is fine. There will simply
+	// be no file events for broken symlinks.
+	// Hence the returns of nil on errors.
+	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		link := name
+		name, err = filepath.EvalSymlinks(name)
+		if err != nil {
+			w.logf("not watching broken symlink %s: %s", link, err)
+			return "", nil, nil
+		}
+		fi, err = lstat(name)
+		if err != nil {
+			w.logf("not watching broken symlink %s: %s", link, err)
+			return "", nil, nil
+		}
+		w.logf("following symlink %s to %s", link, name)
+	}
+
+	// Sockets can't be opened, and named pipes are only watched with
+	// WithWatchSpecialFiles.
+	switch {
+	case fi.Mode()&os.ModeSocket == os.ModeSocket:
+		if w.opts.specialFiles {
+			return "", nil, fmt.Errorf("%w: can't watch socket %s", ErrUnsupported, name)
+		}
+		w.logf("not watching socket %s", name)
+		return "", nil, nil
+	case fi.Mode()&os.ModeNamedPipe == os.ModeNamedPipe && !w.opts.specialFiles:
+		w.logf("not watching named pipe %s without WithWatchSpecialFiles", name)
+		return "", nil, nil
+	}
+	return name, fi, nil
+}
+
+// Plan returns the paths that Add would watch for name, without watching
+// anything: name itself, or the path it resolves to if it's a symlink, and
+// for a directory every file in it, as kqueue needs a file descriptor for
+// every file. This can be used to check how many watches Add would use.
+//
+// The error is the one Add would return if name can't be watched.
+func (w *Watcher) Plan(name string) ([]string, error) {
+	w.mu.Lock()
+	closed := w.isClosed
+	w.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+
+	name, fi, err := w.resolveWatch(w.cleanPath(name))
+	if fi == nil {
+		return nil, err
+	}
+	paths := []string{name}
+	if !fi.IsDir() || w.opts.dirOnly {
+		return paths, nil
+	}
+
+	entries, err := readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	seen := map[string]bool{name: true}
+	for _, entry := range entries {
+		filePath := filepath.Join(name, entry.Name())
+		w.mu.Lock()
+		excluded := w.excluded[filePath] || w.removed.has(filePath)
+		w.mu.Unlock()
+		if excluded || w.opts.ignoreHidden && isHidden(entry.Name()) {
+			continue
+		}
+		// Files that can't be watched don't fail Add for the directory.
+		path, fi, _ := w.resolveWatch(filePath)
+		if fi == nil || seen[path] {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// newWatch is a watch that's been opened by openWatch, but not yet registered
+// with the kqueue.
+type newWatch struct {
+	name            string
+	watchfd         int
+	isDir           bool
+	isSpecial       bool
+	alreadyWatching bool
+	flags           uint32
+	byFd            bool
+}
+
+// openWatch does all the work for addWatch up to registering the watch with
+// the kqueue. If there's nothing to register it returns nil and the name that
+// addWatch should return.
+func (w *Watcher) openWatch(name string, flags uint32) (*newWatch, string, error) {
+	var isDir, isSpecial bool
 	// Make ./name and name equivalent
-	name = filepath.Clean(name)
+	name = w.cleanPath(name)
 
 	w.mu.Lock()
 	if w.isClosed {
 		w.mu.Unlock()
-		return "", errors.New("kevent instance already closed")
+		return nil, "", ErrClosed
 	}
 	watchfd, alreadyWatching := w.watches[name]
-	// We already have a watch, but we can still override flags.
+	// We already have a watch, but we can still add flags. Never remove any,
+	// as that would break whoever added the watch with those flags.
 	if alreadyWatching {
 		isDir = w.paths[watchfd].isDir
+		isSpecial = w.paths[watchfd].isSpecial
+		flags |= w.paths[watchfd].flags
+	} else if w.opts.maxWatches > 0 && len(w.watches) >= w.opts.maxWatches {
+		w.mu.Unlock()
+		return nil, "", fmt.Errorf("%w: %s", ErrMaxWatchesExceeded, name)
 	}
 	w.mu.Unlock()
 
 	if !alreadyWatching {
-		fi, err := os.Lstat(name)
-		if err != nil {
-			return "", err
-		}
-
-		// Don't watch sockets.
-		if fi.Mode()&os.ModeSocket == os.ModeSocket {
-			return "", nil
-		}
-
-		// Don't watch named pipes.
-		if fi.Mode()&os.ModeNamedPipe == os.ModeNamedPipe {
-			return "", nil
+		resolved, fi, err := w.resolveWatch(name)
+		if fi == nil {
+			return nil, "", err
 		}
-
-		// Follow Symlinks
-		// Unfortunately, Linux can add bogus symlinks to watch list without
-		// issue, and Windows can't do symlinks period (AFAIK). To  maintain
-		// consistency, we will act like everything is fine. There will simply
-		// be no file events for broken symlinks.
-		// Hence the returns of nil on errors.
-		if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
-			name, err = filepath.EvalSymlinks(name)
-			if err != nil {
-				return "", nil
-			}
-
+		if resolved != name {
+			name = resolved
 			w.mu.Lock()
 			_, alreadyWatching = w.watches[name]
 			w.mu.Unlock()
 
 			if alreadyWatching {
-				return name, nil
+				return nil, name, nil
 			}
+		}
 
-			fi, err = os.Lstat(name)
-			if err != nil {
-				return "", nil
-			}
+		mode := openMode
+		if fi.Mode()&os.ModeNamedPipe == os.ModeNamedPipe {
+			// Don't block until there's a writer.
+			mode |= unix.O_NONBLOCK
 		}
 
 		// Retry on EINTR; open() can return EINTR in practice on macOS.
 		// See #354, and go issues 11180 and 39237.
 		for {
-			watchfd, err = unix.Open(name, openMode, 0)
+			watchfd, err = unix.Open(name, mode, 0)
 			if err == nil {
 				break
 			}
 			if errors.Is(err, unix.EINTR) {
 				continue
 			}
+			if errors.Is(err, unix.ENAMETOOLONG) {
+				if watchfd, err = openLong(name, mode); err == nil {
+					break
+				}
+				return nil, "", err
+			}
 
-			return "", err
+			return nil, "", &os.PathError{Op: "open", Path: name, Err: err}
 		}
 
 		isDir = fi.IsDir()
+		isSpecial = fi.Mode()&(os.ModeDevice|os.ModeNamedPipe) != 0
 	}
 
-	err := register(w.kq, []int{watchfd}, unix.EV_ADD|unix.EV_CLEAR|unix.EV_ENABLE, flags)
-	if err != nil {
-		unix.Close(watchfd)
-		return "", err
+	return &newWatch{
+		name:            name,
+		watchfd:         watchfd,
+		isDir:           isDir,
+		isSpecial:       isSpecial,
+		alreadyWatching: alreadyWatching,
+		flags:           w.watchFlags(flags, isDir, isSpecial),
+	}, name, nil
+}
+
+// watchFlags returns the fflags to watch a file with, out of flags.
+func (w *Watcher) watchFlags(flags uint32, isDir, isSpecial bool) uint32 {
+	if isSpecial {
+		// Reading from or writing to a device or pipe isn't a change of the
+		// file; only watch for attribute changes and removal.
+		flags &= unix.NOTE_ATTRIB | unix.NOTE_DELETE | unix.NOTE_RENAME | unix.NOTE_REVOKE
+	}
+	if isDir && w.opts.dirOnly {
+		flags &= unix.NOTE_WRITE | unix.NOTE_DELETE | unix.NOTE_RENAME
+	}
+	if isDir {
+		// NOTE_EXTEND and NOTE_LINK fire on directories for every new entry
+		// or subdirectory; that's already covered by NOTE_WRITE.
+		flags &^= unix.NOTE_EXTEND | unix.NOTE_LINK
 	}
+	return flags
+}
 
-	if !alreadyWatching {
-		w.mu.Lock()
-		w.watches[name] = watchfd
-		w.paths[watchfd] = pathInfo{name: name, isDir: isDir}
-		w.mu.Unlock()
+// registerWatches registers the watches with the kqueue and records them.
+// Watches with the same flags are registered with a single kevent() call.
+//
+// The returned errors are in the same order as ws.
+func (w *Watcher) registerWatches(ws []*newWatch) []error {
+	errs := make([]error, len(ws))
+
+	// Register and record the watches in one go, so that Reopen() can't miss
+	// them.
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	byFlags := make(map[uint32][]int)
+	for i, nw := range ws {
+		// Someone else added a watch for this path while we weren't holding
+		// the lock; use that one.
+		if fd, ok := w.watches[nw.name]; ok && !nw.alreadyWatching {
+			unix.Close(nw.watchfd)
+			nw.watchfd, nw.alreadyWatching = fd, true
+			nw.flags |= w.paths[fd].flags
+		}
+		// Checked here rather than before it's opened, so that RemovePrefix
+		// can't miss it.
+		if !nw.alreadyWatching && !w.externalWatches[nw.name] && w.removed.has(nw.name) {
+			errs[i] = errRemovedPrefix
+			continue
+		}
+		byFlags[nw.flags] = append(byFlags[nw.flags], i)
 	}
 
-	if isDir {
+	// openWatch already checked this, but several watches may have been
+	// opened at the same time.
+	if w.opts.maxWatches > 0 {
+		n := len(w.watches)
+		for i, nw := range ws {
+			if nw.alreadyWatching || errs[i] != nil {
+				continue
+			}
+			if n >= w.opts.maxWatches {
+				errs[i] = fmt.Errorf("%w: %s", ErrMaxWatchesExceeded, nw.name)
+				continue
+			}
+			n++
+		}
+	}
+
+	for flags, idx := range byFlags {
+		fds := make([]int, 0, len(idx))
+		for _, i := range idx {
+			if errs[i] == nil {
+				fds = append(fds, ws[i].watchfd)
+			}
+		}
+		if len(fds) == 0 {
+			continue
+		}
+		err := register(w.kq, fds, unix.EV_ADD|unix.EV_CLEAR|unix.EV_ENABLE, flags)
+		for _, i := range idx {
+			switch {
+			case errs[i] != nil:
+			case err != nil && len(fds) > 1:
+				// Find out which ones failed.
+				errs[i] = register(w.kq, []int{ws[i].watchfd}, unix.EV_ADD|unix.EV_CLEAR|unix.EV_ENABLE, flags)
+			default:
+				errs[i] = err
+			}
+		}
+	}
+
+	for i, nw := range ws {
+		if errs[i] != nil {
+			if !nw.alreadyWatching {
+				unix.Close(nw.watchfd)
+			}
+			if !errors.Is(errs[i], ErrMaxWatchesExceeded) && !errors.Is(errs[i], errRemovedPrefix) {
+				errs[i] = &os.PathError{Op: "kevent", Path: nw.name, Err: errs[i]}
+			}
+			continue
+		}
+		w.watches[nw.name] = nw.watchfd
+		w.paths[nw.watchfd] = pathInfo{name: nw.name, isDir: nw.isDir, isSpecial: nw.isSpecial, flags: nw.flags, byFd: nw.byFd}
+	}
+	return errs
+}
+
+// watchDirectory finishes addWatch for a registered watch, by watching the
+// files in it if it's a directory.
+func (w *Watcher) watchDirectory(nw *newWatch) (string, error) {
+	if nw.isDir {
 		// Watch the directory if it has not been watched before,
 		// or if it was watched before, but perhaps only a NOTE_DELETE (watchDirectoryFiles)
 		w.mu.Lock()
 
-		watchDir := (flags&unix.NOTE_WRITE) == unix.NOTE_WRITE &&
-			(!alreadyWatching || (w.dirFlags[name]&unix.NOTE_WRITE) != unix.NOTE_WRITE)
+		watchDir := (nw.flags&unix.NOTE_WRITE) == unix.NOTE_WRITE &&
+			(!nw.alreadyWatching || (w.dirFlags[nw.name]&unix.NOTE_WRITE) != unix.NOTE_WRITE)
 		// Store flags so this watch can be updated later
-		w.dirFlags[name] = flags
+		w.dirFlags[nw.name] = nw.flags
 		w.mu.Unlock()
 
 		if watchDir {
-			if err := w.watchDirectoryFiles(name); err != nil {
+			if err := w.watchDirectoryFiles(nw.name); err != nil {
 				return "", err
 			}
 		}
 	}
-	return name, nil
+	return nw.name, nil
+}
+
+// maxReadFailures is the number of errors in a row from reading the kqueue
+// after which the Watcher is closed.
+const maxReadFailures = 10
+
+// readBackoff returns how long to wait before reading the kqueue again after
+// the given number of errors in a row: 1ms, doubling every time up to 1s.
+func readBackoff(failures int) time.Duration {
+	d := time.Millisecond << (failures - 1)
+	if d > time.Second || d <= 0 {
+		d = time.Second
+	}
+	return d
 }
 
 // readEvents reads from kqueue and converts the received kevents into
@@ -282,28 +1362,53 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 func (w *Watcher) readEvents() {
 	eventBuffer := make([]unix.Kevent_t, 10)
 	defer func() {
+		// Stopped on its own, rather than by Close.
+		w.Close()
 		err := unix.Close(w.kq)
 		if err != nil {
-			w.Errors <- err
+			w.sendError(err)
 		}
 		unix.Close(w.closepipe[0])
-		close(w.done)
+		w.scans.wg.Wait()
+		w.errSenders.Wait()
 		close(w.Events)
 		close(w.Errors)
+		close(w.closed)
 	}()
 
+	var failures int // Errors from kevent in a row.
 	for closed := false; !closed; {
-		kevents, err := read(w.kq, eventBuffer)
+		var reopen bool
+		kevents, err := read(w.kq, eventBuffer, w.readTimeout())
 		// EINTR is okay, the syscall was interrupted before timeout expired.
-		if err != nil && err != unix.EINTR {
+		if err == unix.EINTR {
+			atomic.AddUint64(&w.interrupts, 1)
+			continue
+		}
+		if err != nil {
+			// Wait a bit before trying again, so that an error that doesn't
+			// go away doesn't flood the Errors channel, and stop after a
+			// while.
+			failures++
+			if failures >= maxReadFailures {
+				w.sendError(fmt.Errorf("fsnotify: stopped after %d errors reading the kqueue: %w", failures, err))
+				w.Close()
+				closed = true
+				continue
+			}
+			if !w.sendError(err) {
+				closed = true
+				continue
+			}
 			select {
-			case w.Errors <- err:
+			case <-time.After(readBackoff(failures)):
 			case <-w.done:
 				closed = true
-				continue
 			}
 			continue
 		}
+		failures = 0
+		removing := hasRemoval(kevents)
 
 		// Flush the events we received to the Events channel
 		for _, kevent := range kevents {
@@ -313,42 +1418,92 @@ func (w *Watcher) readEvents() {
 			)
 
 			// Shut down the loop when the pipe is closed, but only after all
-			// other events have been processed.
+			// other events have been processed. A write on the pipe rather
+			// than a close is a Reopen() request, or a 1 for Rescan().
 			if watchfd == w.closepipe[0] {
-				closed = true
+				var b [1]byte
+				switch n, _ := unix.Read(w.closepipe[0], b[:]); {
+				case n == 1 && b[0] == 1:
+					// Registered with EV_ONESHOT; keep listening for
+					// Close and Reopen.
+					if err := registerClosepipe(w.kq, w.closepipe[0]); err != nil {
+						w.sendError(err)
+					}
+				case n == 1:
+					reopen = true
+				default:
+					closed = true
+				}
 				continue
 			}
 
 			w.mu.Lock()
 			path := w.paths[watchfd]
+			watched := w.externalWatches[path.name]
 			w.mu.Unlock()
-			event := newEvent(path.name, mask)
-
-			if path.isDir && !(event.Op&Remove == Remove) {
-				// Double check to make sure the directory exists. This can happen when
-				// we do a rm -fr on a recursively watched folders and we receive a
-				// modification event first but the folder has been deleted and later
-				// receive the delete event
-				if _, err := os.Lstat(event.Name); os.IsNotExist(err) {
-					// mark is as delete event
-					event.Op |= Remove
+			if p, ok := w.polls[path.name]; ok {
+				p.fired = true
+			}
+			event := w.mapEvent(path.name, mask)
+			event.Watched = watched
+			if w.opts.moveEvents && event.Op&Rename == Rename {
+				event.Op |= MovedFrom
+			}
+
+			var readErr error
+			if needsExistCheck(path, event.Op, removing) {
+				// Double check to make sure the file or directory exists. With
+				// rm -rf on a recursively watched directory the kevent for a
+				// change can be read after the path is already gone, and the
+				// kevent for the delete may never be read, as it can arrive
+				// after the watch is removed along with its parent.
+				_, readErr = lstat(event.Name)
+				if os.IsNotExist(readErr) {
+					// Send it as a Remove, which also removes the watch.
+					// Don't keep the Write: that's about the entries in a
+					// directory, which are reported by their own watches,
+					// and it would make it impossible to tell "the path is
+					// gone" apart from "something changed".
+					event.Op = Remove
 				}
 			}
 
 			if event.Op&Rename == Rename || event.Op&Remove == Remove {
-				w.Remove(event.Name)
+				w.remove(event.Name)
 				w.mu.Lock()
-				delete(w.fileExists, event.Name)
+				w.fileExists.remove(event.Name)
 				w.mu.Unlock()
 			}
 
 			if path.isDir && event.Op&Write == Write && !(event.Op&Remove == Remove) {
-				w.sendDirectoryChangeEvents(event.Name)
+				if readErr == nil {
+					w.queueRescan(event.Name)
+				} else {
+					if !w.sendError(watchError("lstat", event.Name, readErr)) {
+						closed = true
+						continue
+					}
+				}
+
+				// The Write is reported as events for the entries, but the
+				// same kevent can have other changes to the directory
+				// itself, which shouldn't get lost.
+				if !w.opts.dirWrites {
+					event.Op &^= Write
+				}
+				if event.Op != 0 {
+					if !w.sendEvent(event) {
+						closed = true
+						continue
+					}
+				}
 			} else {
+				if w.opts.sizeTracking && !path.isDir {
+					w.pipeline.sizes.update(&event)
+				}
+
 				// Send the event on the Events channel.
-				select {
-				case w.Events <- event:
-				case <-w.done:
+				if !w.sendEvent(event) {
 					closed = true
 					continue
 				}
@@ -357,8 +1512,13 @@ func (w *Watcher) readEvents() {
 			if event.Op&Remove == Remove {
 				// Look for a file that may have overwritten this.
 				// For example, mv f1 f2 will delete f2, then create f2.
+				//
+				// The Create is always sent after the Remove: f2 is in
+				// fileExists until the kevent for the Remove is handled
+				// above, so a re-read of the directory for a Write that's
+				// handled first doesn't send a Create for it.
 				if path.isDir {
-					fileDir := filepath.Clean(event.Name)
+					fileDir := w.cleanPath(event.Name)
 					w.mu.Lock()
 					_, found := w.watches[fileDir]
 					w.mu.Unlock()
@@ -367,121 +1527,730 @@ func (w *Watcher) readEvents() {
 						// do a recursive watch and perform rm -fr, the parent directory might
 						// have gone missing, ignore the missing directory and let the
 						// upcoming delete event remove the watch from the parent directory.
-						if _, err := os.Lstat(fileDir); err == nil {
-							w.sendDirectoryChangeEvents(fileDir)
-						}
+						w.sendDirectoryChangeEvents(fileDir, false)
 					}
 				} else {
-					filePath := filepath.Clean(event.Name)
-					if fileInfo, err := os.Lstat(filePath); err == nil {
-						w.sendFileCreatedEventIfNew(filePath, fileInfo)
+					filePath := w.cleanPath(event.Name)
+					if fileInfo, err := lstat(filePath); err == nil {
+						w.sendFileCreatedEventIfNew(filePath, fileInfo.IsDir(), 0)
 					}
 				}
 			}
+			if watched && event.Op&(Remove|Rename) != 0 && w.watchLost(event.Name) {
+				if !w.sendError(watchError("watch", event.Name, ErrWatchLost)) {
+					closed = true
+					continue
+				}
+			}
+		}
+
+		// With WithRescanDelay this may be before the kevents for the
+		// directories were read, if kevent returned on the timeout.
+		if !closed && len(w.rescans) > 0 && !time.Now().Before(w.rescanAt) {
+			w.flushRescans()
+		}
+		if !closed && !w.flushRequested() {
+			closed = true
+		}
+		if !closed && w.opts.pollInterval > 0 && !time.Now().Before(w.pollAt) {
+			if !w.poll() {
+				closed = true
+			}
+		}
+		if !closed && w.opts.atomicSaves > 0 {
+			for _, e := range w.pipeline.saves.expired(time.Now()) {
+				if !w.deliverEvent(e) {
+					closed = true
+					break
+				}
+			}
+		}
+		if w.opts.readTimeout > 0 {
+			w.pruneState()
+		}
+
+		if reopen && !closed {
+			req := <-w.reopen
+			err := w.reopenKqueue()
+			if err == ErrClosed {
+				closed = true
+			}
+			req <- err
+		}
+	}
+}
+
+// reopenKqueue replaces the kqueue and closepipe with new ones, and registers
+// all watches on the new kqueue. It must be called from the readEvents
+// goroutine.
+func (w *Watcher) reopenKqueue() error {
+	kq, closepipe, err := kqueue()
+	if err != nil {
+		// Keep using the current kqueue, but the closepipe was registered
+		// with EV_ONESHOT so that needs to be re-armed.
+		if err2 := registerClosepipe(w.kq, w.closepipe[0]); err2 != nil {
+			return err2
+		}
+		return err
+	}
+	closeNew := func() {
+		unix.Close(kq)
+		unix.Close(closepipe[0])
+		unix.Close(closepipe[1])
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed {
+		closeNew()
+		return ErrClosed
+	}
+	for watchfd, path := range w.paths {
+		err := register(kq, []int{watchfd}, unix.EV_ADD|unix.EV_CLEAR|unix.EV_ENABLE, path.flags)
+		if err != nil {
+			closeNew()
+			if err2 := registerClosepipe(w.kq, w.closepipe[0]); err2 != nil {
+				return err2
+			}
+			return err
 		}
 	}
+
+	unix.Close(w.kq)
+	unix.Close(w.closepipe[0])
+	unix.Close(w.closepipe[1])
+	w.kq, w.closepipe = kq, closepipe
+	w.logf("re-armed %d watches on a new kqueue", len(w.paths))
+	return nil
 }
 
-// newEvent returns an platform-independent Event based on kqueue Fflags.
-func newEvent(name string, mask uint32) Event {
-	e := Event{Name: name}
-	if mask&unix.NOTE_DELETE == unix.NOTE_DELETE {
+// DefaultEventMapper returns a platform-independent Event based on kqueue
+// Fflags; see WithEventMapper.
+func DefaultEventMapper(name string, mask uint32) Event {
+	e := Event{Name: name, RawOp: mask}
+	if mask&unix.NOTE_DELETE == unix.NOTE_DELETE || mask&unix.NOTE_REVOKE == unix.NOTE_REVOKE {
 		e.Op |= Remove
 	}
-	if mask&unix.NOTE_WRITE == unix.NOTE_WRITE {
+	if mask&unix.NOTE_WRITE == unix.NOTE_WRITE || mask&unix.NOTE_EXTEND == unix.NOTE_EXTEND {
 		e.Op |= Write
 	}
 	if mask&unix.NOTE_RENAME == unix.NOTE_RENAME {
 		e.Op |= Rename
 	}
-	if mask&unix.NOTE_ATTRIB == unix.NOTE_ATTRIB {
+	// NOTE_LINK is a change in the link count, which is reported as an
+	// attribute change by inotify.
+	if mask&unix.NOTE_ATTRIB == unix.NOTE_ATTRIB || mask&unix.NOTE_LINK == unix.NOTE_LINK {
 		e.Op |= Chmod
 	}
 	return e
 }
 
+// hasRemoval reports if any of the kevents is for a file that was deleted or
+// revoked.
+func hasRemoval(kevents []unix.Kevent_t) bool {
+	for _, kev := range kevents {
+		if kev.Fflags&(unix.NOTE_DELETE|unix.NOTE_REVOKE) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// needsExistCheck reports if readEvents has to check that the path of an event
+// with op for the watch p still exists. A directory is always checked, as the
+// result is needed to read it for a Write. Any other file is only checked if a
+// file was deleted or revoked in the same read (removing), as only then can
+// the kevent be for a path that's already gone without a delete of its own;
+// this keeps a stat off the path of every Write to a file. A file added with
+// AddFile may not have a path to check.
+func needsExistCheck(p pathInfo, op Op, removing bool) bool {
+	if op&(Remove|Rename) != 0 {
+		return false
+	}
+	if p.isDir {
+		return true
+	}
+	return removing && !p.byFd
+}
+
+// sendEvent sends the event on the Events channel, following the backpressure
+// policy. It returns false if the watcher was closed.
+func (w *Watcher) sendEvent(e Event) bool {
+	e.Seq = atomic.AddUint64(&w.seq, 1)
+	if w.opts.attrDetail {
+		w.attrs.update(&e)
+	}
+	events := w.prepareEvents(e)
+	if w.opts.initialScan {
+		w.scans.wait(w.done)
+	}
+	for _, e := range events {
+		if !w.deliverEvent(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// deliverEvent is sendEvent without waiting for WithInitialScan.
+func (w *Watcher) deliverEvent(e Event) bool {
+	if e.Seq == 0 {
+		// From WithInitialScan.
+		e.Seq = atomic.AddUint64(&w.seq, 1)
+	}
+	if w.skipEvent(e) {
+		return true
+	}
+	if w.opts.origNames {
+		if events := w.links.events(e); events != nil {
+			for _, e := range events {
+				if !w.deliverOne(e) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return w.deliverOne(e)
+}
+
+// deliverOne does the work for deliverEvent.
+func (w *Watcher) deliverOne(e Event) bool {
+	if !w.filterEvent(&e) {
+		return true
+	}
+	if w.callEvent(e) {
+		return true
+	}
+	if atomic.LoadInt32(&w.draining) == 1 {
+		// CloseAndDrain receives until Events is closed, so this can't
+		// block forever, and no event that was already read is lost.
+		w.Events <- e
+		return true
+	}
+	if w.opts.backpressure.trySend(w.Events, w.Errors, &w.drops, e) {
+		return true
+	}
+	timeout, stop := sendTimer(w.opts.sendTimeout)
+	defer stop()
+	select {
+	case w.Events <- e:
+		return true
+	case <-timeout:
+		w.drops.drop(w.Errors)
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// sendError sends err on the Errors channel, or discards it with
+// WithDropErrors if it can't be sent right away. It returns false if the
+// watcher was closed.
+func (w *Watcher) sendError(err error) bool {
+	draining := atomic.LoadInt32(&w.draining) == 1
+	if w.opts.dropErrors {
+		trySendError(w.Errors, &w.errDrops, err)
+		select {
+		case <-w.done:
+			return draining
+		default:
+			return true
+		}
+	}
+	if draining {
+		// Like deliverOne: keep going until everything that was read is
+		// sent.
+		w.Errors <- err
+		return true
+	}
+	select {
+	case w.Errors <- err:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
 func newCreateEvent(name string) Event {
 	return Event{Name: name, Op: Create}
 }
 
 // watchDirectoryFiles to mimic inotify when adding a watch on a directory
+//
+// A file that can't be watched doesn't fail the whole directory: files that
+// were removed in the meantime are skipped, and any other errors are sent on
+// the Errors channel.
+//
+// The directory must already be registered, so that a file that isn't in the
+// entries read here always gets a Create event from the kevent for the
+// directory. The entries are recorded in fileExists before anything else, so
+// that a file that is in them never gets one, even if the kevent for another
+// file is handled while we're still watching the files.
 func (w *Watcher) watchDirectoryFiles(dirPath string) error {
-	// Get all files
-	files, err := ioutil.ReadDir(dirPath)
+	// Read the files in batches, so that the entries of a huge directory
+	// don't all have to be in memory.
+	var errs []error
+	err := readDirBatches(dirPath, dirBatchSize, func(entries []fs.DirEntry) bool {
+		errs = append(errs, w.watchFiles(dirPath, entries)...)
+		return true
+	})
 	if err != nil {
 		return err
 	}
 
-	for _, fileInfo := range files {
-		filePath := filepath.Join(dirPath, fileInfo.Name())
-		filePath, err = w.internalWatch(filePath, fileInfo)
+	w.sendErrors(errs)
+	return nil
+}
+
+// watchFiles watches the files for the entries in dirPath, for
+// watchDirectoryFiles.
+func (w *Watcher) watchFiles(dirPath string, entries []fs.DirEntry) []error {
+	files := make([]fs.DirEntry, 0, len(entries))
+	w.mu.Lock()
+	for _, entry := range entries {
+		filePath := filepath.Join(dirPath, entry.Name())
+		if w.excluded[filePath] || w.removed.has(filePath) || w.opts.ignoreHidden && isHidden(entry.Name()) {
+			continue
+		}
+		w.fileExists.add(filePath)
+		files = append(files, entry)
+	}
+	w.mu.Unlock()
+
+	var errs []error
+	for _, entry := range files {
+		filePath := filepath.Join(dirPath, entry.Name())
+		realPath, err := w.internalWatch(filePath, entry.IsDir())
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			// Removed in the meantime, without a watch to report it; a new
+			// file with this name should get a Create event.
+			w.mu.Lock()
+			w.fileExists.remove(filePath)
+			w.mu.Unlock()
+			continue
+		case errors.Is(err, ErrUnsupported):
+			// A socket; that's only an error if it's added with Add.
+		case err != nil:
+			errs = append(errs, watchError("watch", filePath, err))
+		default:
+			filePath = realPath
+		}
+
+		w.mu.Lock()
+		w.fileExists.add(filePath)
+		w.mu.Unlock()
+	}
+	return errs
+}
+
+// sendErrors sends errs on the Errors channel from a new goroutine, as the
+// caller may be Add, and nothing may be receiving from Errors until it
+// returns.
+func (w *Watcher) sendErrors(errs []error) {
+	if len(errs) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed {
+		return
+	}
+	w.errSenders.Add(1)
+	go func() {
+		defer w.errSenders.Done()
+		for _, err := range errs {
+			if !w.sendError(err) {
+				return
+			}
+		}
+	}()
+}
+
+// queueRescan reads the directory dirPath for new files once all kevents that
+// were read with it are handled, or after the delay set with WithRescanDelay.
+// Writes to the same directory in the meantime don't cause another read, which
+// would make extracting many files in to a directory quadratic.
+func (w *Watcher) queueRescan(dirPath string) {
+	if len(w.rescans) == 0 {
+		w.rescans = make(map[string]struct{})
+		w.rescanAt = time.Now().Add(w.opts.rescanDelay)
+	}
+	w.rescans[dirPath] = struct{}{}
+}
+
+// readTimeout returns the timeout for reading the kqueue: the time until the
+// queued directories should be read, the watches should be polled, or the
+// events held back for WithAtomicSaveDetection should be sent, but no
+// longer than the WithReadTimeout. It returns nil if there's nothing to do but
+// wait for kevents.
+func (w *Watcher) readTimeout() *unix.Timespec {
+	d, ok := w.opts.readTimeout, w.opts.readTimeout > 0
+	if len(w.rescans) > 0 {
+		if until := time.Until(w.rescanAt); !ok || until < d {
+			d, ok = until, true
+		}
+	}
+	if w.opts.pollInterval > 0 {
+		if until := time.Until(w.pollAt); !ok || until < d {
+			d, ok = until, true
+		}
+	}
+	if at, pending := w.pipeline.saves.next(); pending {
+		if until := time.Until(at); !ok || until < d {
+			d, ok = until, true
+		}
+	}
+	if !ok {
+		return nil
+	}
+	if d < 0 {
+		d = 0
+	}
+	ts := unix.NsecToTimespec(d.Nanoseconds())
+	return &ts
+}
+
+// pruneState forgets the state for WithRateLimit and WithDedup that's no
+// longer needed. Normally that only happens when events are sent.
+func (w *Watcher) pruneState() {
+	now := time.Now()
+	if n, window := w.rateLimit(); n > 0 {
+		w.pipeline.limiter.mu.Lock()
+		w.pipeline.limiter.prune(now, window)
+		w.pipeline.limiter.mu.Unlock()
+	}
+	if w.opts.dedupWindow > 0 {
+		w.pipeline.dedup.mu.Lock()
+		w.pipeline.dedup.prune(now, w.opts.dedupWindow)
+		w.pipeline.dedup.mu.Unlock()
+	}
+}
+
+// pollState is what was last seen for a watch with WithPollFallback.
+type pollState struct {
+	fi      os.FileInfo
+	isDir   bool
+	fired   bool // A kevent was read since the last poll.
+	suspect bool // Changed without a kevent at the last poll.
+	dead    bool // Polled instead of relying on kevents.
+}
+
+// poll stats every watched path for WithPollFallback. A watch is considered
+// dead if the file changed without a kevent for two polls in a row, after
+// which the events for it are synthesized from the changes in the stat. It
+// returns false if the watcher was closed.
+func (w *Watcher) poll() bool {
+	w.pollAt = time.Now().Add(w.opts.pollInterval)
+
+	w.mu.Lock()
+	paths := make(map[string]bool, len(w.watches))
+	for name, fd := range w.watches {
+		paths[name] = w.paths[fd].isDir
+	}
+	w.mu.Unlock()
+
+	if w.polls == nil {
+		w.polls = make(map[string]*pollState)
+	}
+	for name := range w.polls {
+		if _, ok := paths[name]; !ok {
+			delete(w.polls, name)
+		}
+	}
+
+	for name, isDir := range paths {
+		fi, err := lstat(name)
+		p, ok := w.polls[name]
+		if !ok {
+			if err == nil {
+				w.polls[name] = &pollState{fi: fi, isDir: isDir}
+			}
+			continue
+		}
+
 		if err != nil {
-			return err
+			if !os.IsNotExist(err) || !p.dead {
+				continue
+			}
+			delete(w.polls, name)
+			w.remove(name)
+			w.mu.Lock()
+			w.fileExists.remove(name)
+			w.mu.Unlock()
+			if !w.sendEvent(Event{Name: name, Op: Remove}) {
+				return false
+			}
+			continue
+		}
+
+		modeChanged := fi.Mode() != p.fi.Mode()
+		written := !fi.ModTime().Equal(p.fi.ModTime()) || fi.Size() != p.fi.Size()
+		switch {
+		case p.fired || !(modeChanged || written):
+			p.suspect = false
+		case !p.dead && !p.suspect:
+			// The kevent may not have been read yet; check again at the
+			// next poll, without forgetting about this change.
+			p.suspect, p.fired = true, false
+			continue
+		default:
+			p.dead = true
+		}
+		p.fi, p.fired = fi, false
+		if !p.dead {
+			continue
+		}
+
+		if modeChanged {
+			if !w.sendEvent(Event{Name: name, Op: Chmod}) {
+				return false
+			}
+		}
+		if written {
+			if isDir {
+				w.queueRescan(name)
+			} else if !w.sendEvent(Event{Name: name, Op: Write}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// flushRescans reads the directories queued with queueRescan and sends the
+// events for them.
+func (w *Watcher) flushRescans() {
+	dirs := w.rescans
+	w.rescans = nil
+	for dirPath := range dirs {
+		w.mu.Lock()
+		_, watching := w.watches[dirPath]
+		w.mu.Unlock()
+		if !watching {
+			continue
+		}
+
+		err := w.sendDirectoryChangeEvents(dirPath, false)
+		// Removed in the meantime; there will be a kevent for that.
+		if err != nil && !os.IsNotExist(err) {
+			if !w.sendError(watchError("readdir", dirPath, err)) {
+				return
+			}
 		}
+	}
+}
 
+// sendDirectoryChangeEvents reads the directory dirPath and sends a Create
+// event for the files that are new. This functionality is to have the BSD
+// version of fsnotify match Linux inotify which provides a create event for
+// files created in a watched directory. With removed, or with WithDirOnly where
+// there is no NOTE_DELETE for the files, it also sends a Remove event for the
+// files that have gone missing.
+//
+// The directory is read in batches, so that the entries of a huge directory
+// don't all have to be in memory: only the new files are kept until it's read
+// to the end, to send the events for them in creationOrder. The error is the
+// one from reading the directory.
+func (w *Watcher) sendDirectoryChangeEvents(dirPath string, removed bool) error {
+	w.logf("rescanning directory %s", dirPath)
+
+	var (
+		created []fs.DirEntry
+		found   map[string]struct{}
+		n       int
+		stopped bool
+	)
+	if removed || w.opts.dirOnly {
+		found = make(map[string]struct{})
+	}
+	err := readDirBatches(dirPath, dirBatchSize, func(entries []fs.DirEntry) bool {
+		n += len(entries)
+		var unwatched []fs.DirEntry
 		w.mu.Lock()
-		w.fileExists[filePath] = true
+		for _, entry := range entries {
+			if found != nil {
+				found[entry.Name()] = struct{}{}
+			}
+			filePath := filepath.Join(dirPath, entry.Name())
+			if w.excluded[filePath] || w.removed.has(filePath) || w.opts.ignoreHidden && isHidden(entry.Name()) {
+				// Never watched, so they don't need to be stat'd for
+				// creationOrder.
+				continue
+			}
+			if !w.fileExists.has(filePath) {
+				created = append(created, entry)
+				continue
+			}
+			if _, ok := w.watches[filePath]; !ok && !w.opts.dirOnly {
+				unwatched = append(unwatched, entry)
+			}
+		}
 		w.mu.Unlock()
+
+		// The files that are already known don't get an event, but the ones
+		// without a watch are watched again in case that failed before.
+		stopped = !w.watchNewFiles(dirPath, unwatched, 0)
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
 	}
 
+	if !w.watchNewFiles(dirPath, w.creationOrder(dirPath, created), n) {
+		return nil
+	}
+	if found != nil {
+		w.sendFileRemovedEvents(dirPath, found, n)
+	}
 	return nil
 }
 
-// sendDirectoryEvents searches the directory for newly created files
-// and sends them over the event channel. This functionality is to have
-// the BSD version of fsnotify match Linux inotify which provides a
-// create event for files created in a watched directory.
-func (w *Watcher) sendDirectoryChangeEvents(dirPath string) {
-	// Get all files
-	files, err := ioutil.ReadDir(dirPath)
-	if err != nil {
-		select {
-		case w.Errors <- err:
-		case <-w.done:
-			return
+// watchNewFiles calls sendFileCreatedEventIfNew for the entries in dirPath,
+// which has n entries. It returns false if it stopped because the directory
+// isn't watched anymore or a file couldn't be watched.
+func (w *Watcher) watchNewFiles(dirPath string, entries []fs.DirEntry, n int) bool {
+	for _, entry := range entries {
+		// The watch may have been removed while sending the events, when it
+		// was only needed for WithDeferredCreate.
+		w.mu.Lock()
+		_, watching := w.watches[dirPath]
+		w.mu.Unlock()
+		if !watching {
+			return false
+		}
+		if w.opts.ignoreHidden && isHidden(entry.Name()) {
+			continue
+		}
+
+		filePath := filepath.Join(dirPath, entry.Name())
+		if err := w.sendFileCreatedEventIfNew(filePath, entry.IsDir(), n); err != nil {
+			w.sendError(watchError("watch", filePath, err))
+			return false
 		}
 	}
+	return true
+}
 
-	// Search for new files
-	for _, fileInfo := range files {
-		filePath := filepath.Join(dirPath, fileInfo.Name())
-		err := w.sendFileCreatedEventIfNew(filePath, fileInfo)
+// creationOrder sorts the entries for new files in dirPath by the time their
+// inode last changed, which for a new file is when it was created, so that the
+// Create events are sent in the order the files were created, as far as that
+// can be told: the kevent only says that the directory changed, and entries
+// are in directory order. Files with the same change time are sorted by name.
+func (w *Watcher) creationOrder(dirPath string, entries []fs.DirEntry) []fs.DirEntry {
+	if len(entries) < 2 {
+		return entries
+	}
 
-		if err != nil {
+	ctimes := make(map[string]int64, len(entries))
+	for _, entry := range entries {
+		if fi, err := lstat(filepath.Join(dirPath, entry.Name())); err == nil {
+			if c, ok := ctime(fi); ok {
+				ctimes[entry.Name()] = c
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		ci, cj := ctimes[entries[i].Name()], ctimes[entries[j].Name()]
+		if ci != cj {
+			return ci < cj
+		}
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+// sendFileRemovedEvents sends a remove event for every file in dirPath that
+// we know exists but which is no longer in found, the names of the n entries
+// in it.
+func (w *Watcher) sendFileRemovedEvents(dirPath string, found map[string]struct{}, n int) {
+	var removed []string
+	w.mu.Lock()
+	for file := range w.fileExists.in(dirPath) {
+		if _, ok := found[file]; !ok {
+			removed = append(removed, filepath.Join(dirPath, file))
+		}
+	}
+	for _, filePath := range removed {
+		w.fileExists.remove(filePath)
+	}
+	w.mu.Unlock()
+
+	for _, filePath := range removed {
+		if !w.sendEvent(Event{Name: filePath, Op: Remove, DirEntries: n}) {
 			return
 		}
 	}
 }
 
+// existingFileEvents returns a Create event for every file that we know
+// exists in dirPath, for WithInitialScan. These are the files recorded by
+// watchDirectoryFiles, which are the ones that sendFileCreatedEventIfNew
+// won't send a Create event for.
+func (w *Watcher) existingFileEvents(dirPath string) []Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.dirFlags[dirPath]; !ok {
+		return nil
+	}
+
+	files := w.fileExists.in(dirPath)
+	events := make([]Event, 0, len(files))
+	for file := range files {
+		events = append(events, newCreateEvent(filepath.Join(dirPath, file)))
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
+
 // sendFileCreatedEvent sends a create event if the file isn't already being tracked.
-func (w *Watcher) sendFileCreatedEventIfNew(filePath string, fileInfo os.FileInfo) (err error) {
+// dirEntries is the number of entries in the directory, for Event.DirEntries.
+func (w *Watcher) sendFileCreatedEventIfNew(filePath string, isDir bool, dirEntries int) (err error) {
 	w.mu.Lock()
-	_, doesExist := w.fileExists[filePath]
+	doesExist := w.fileExists.has(filePath)
+	excluded := w.excluded[filePath] || w.removed.has(filePath)
 	w.mu.Unlock()
+	if excluded {
+		return nil
+	}
 	if !doesExist {
 		// Send create event
-		select {
-		case w.Events <- newCreateEvent(filePath):
-		case <-w.done:
+		e := newCreateEvent(filePath)
+		e.DirEntries = dirEntries
+		if !w.sendEvent(e) {
 			return
 		}
 	}
 
 	// like watchDirectoryFiles (but without doing another ReadDir)
-	filePath, err = w.internalWatch(filePath, fileInfo)
+	realPath, err := w.internalWatch(filePath, isDir)
+	if errors.Is(err, ErrUnsupported) {
+		// A socket; that's only an error if it's added with Add.
+		realPath, err = filePath, nil
+	}
+	if errors.Is(err, errRemovedPrefix) {
+		// RemovePrefix was called after it was checked above.
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	filePath = realPath
 
 	w.mu.Lock()
-	w.fileExists[filePath] = true
+	w.fileExists.add(filePath)
 	w.mu.Unlock()
 
 	return nil
 }
 
-func (w *Watcher) internalWatch(name string, fileInfo os.FileInfo) (string, error) {
-	if fileInfo.IsDir() {
+func (w *Watcher) internalWatch(name string, isDir bool) (string, error) {
+	if w.opts.dirOnly {
+		return name, nil
+	}
+
+	if isDir {
 		// mimic Linux providing delete events for subdirectories
 		// but preserve the flags used if currently watching subdirectory
 		w.mu.Lock()
@@ -493,7 +2262,7 @@ func (w *Watcher) internalWatch(name string, fileInfo os.FileInfo) (string, erro
 	}
 
 	// watch file to mimic Linux inotify
-	return w.addWatch(name, noteAllEvents)
+	return w.addWatch(name, w.noteFlags())
 }
 
 // kqueue creates a new kernel event queue and returns a descriptor.
@@ -514,21 +2283,39 @@ func kqueue() (kq int, closepipe [2]int, err error) {
 		unix.Close(kq)
 		return kq, closepipe, err
 	}
+	// Rescan and Reopen write to it while holding w.mu, which readEvents may
+	// be waiting for before it can read from the pipe again. If the pipe is
+	// full the write fails with EAGAIN rather than blocking; readEvents will
+	// still be woken up by the bytes that are already there.
+	if err := unix.SetNonblock(closepipe[1], true); err != nil {
+		unix.Close(kq)
+		unix.Close(closepipe[0])
+		unix.Close(closepipe[1])
+		return kq, closepipe, err
+	}
 
 	// Register changes to listen on the closepipe.
+	if err := registerClosepipe(kq, closepipe[0]); err != nil {
+		unix.Close(kq)
+		unix.Close(closepipe[0])
+		unix.Close(closepipe[1])
+		return kq, closepipe, err
+	}
+	return kq, closepipe, nil
+}
+
+// registerClosepipe registers the read end of the closepipe with the queue.
+func registerClosepipe(kq, fd int) error {
 	changes := make([]unix.Kevent_t, 1)
 	// SetKevent converts int to the platform-specific types.
-	unix.SetKevent(&changes[0], closepipe[0], unix.EVFILT_READ,
+	unix.SetKevent(&changes[0], fd, unix.EVFILT_READ,
 		unix.EV_ADD|unix.EV_ENABLE|unix.EV_ONESHOT)
 
 	ok, err := unix.Kevent(kq, changes, nil, nil)
 	if ok == -1 {
-		unix.Close(kq)
-		unix.Close(closepipe[0])
-		unix.Close(closepipe[1])
-		return kq, closepipe, err
+		return err
 	}
-	return kq, closepipe, nil
+	return nil
 }
 
 // Register events with the queue.
@@ -550,8 +2337,8 @@ func register(kq int, fds []int, flags int, fflags uint32) error {
 
 // read retrieves pending events, or waits until an event occurs.
 // A timeout of nil blocks indefinitely, while 0 polls the queue.
-func read(kq int, events []unix.Kevent_t) ([]unix.Kevent_t, error) {
-	n, err := unix.Kevent(kq, nil, events, nil)
+func read(kq int, events []unix.Kevent_t, timeout *unix.Timespec) ([]unix.Kevent_t, error) {
+	n, err := unix.Kevent(kq, nil, events, timeout)
 	if err != nil {
 		return nil, err
 	}
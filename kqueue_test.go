@@ -0,0 +1,845 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build freebsd || openbsd || netbsd || dragonfly || darwin
+// +build freebsd openbsd netbsd dragonfly darwin
+
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestKqueueRemoveChild(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "a", noWait)
+	touch(t, tmp, "b", noWait)
+
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	if err := w.w.Remove(filepath.Join(tmp, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	cat(t, "data", tmp, "a")
+	cat(t, "data", tmp, "b")
+	rm(t, tmp, "a")
+	touch(t, tmp, "a") // Recreated files shouldn't be watched either.
+	cat(t, "data", tmp, "a")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write  /b
+	`))
+}
+
+// A file in a directory that can't be watched doesn't fail the directory.
+func TestKqueueWatchDirectoryFilesError(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "a", noWait)
+	touch(t, tmp, "b", noWait)
+	touch(t, tmp, "c", noWait)
+
+	// The directory and two of the files.
+	w, err := NewWatcher(WithMaxWatches(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.Add(tmp); err != nil {
+		t.Fatalf("Add failed for the directory: %s", err)
+	}
+	select {
+	case err := <-w.Errors:
+		if !errors.Is(err, ErrMaxWatchesExceeded) {
+			t.Errorf("expected ErrMaxWatchesExceeded, got: %v", err)
+		}
+		var watchErr *WatchError
+		if !errors.As(err, &watchErr) || filepath.Dir(watchErr.Path) != tmp {
+			t.Errorf("expected *WatchError for a file in %q, got: %#v", tmp, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no error sent for the file that couldn't be watched")
+	}
+	if n := w.Count(); n != 3 {
+		t.Errorf("Count: have %d, want 3", n)
+	}
+}
+
+func TestKqueueReopen(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file", noWait)
+
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	if err := w.w.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+
+	cat(t, "data", tmp, "file")
+	touch(t, tmp, "new")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write   /file
+		create  /new
+	`))
+}
+
+func TestKqueueExtendedEvents(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	cat(t, "data", file)
+
+	w := newCollector(t, WithExtendedEvents())
+	w.collect(t)
+	addWatch(t, w.w, file)
+
+	cat(t, "more data", file)
+	if err := os.Link(file, filepath.Join(tmp, "link")); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write  /file
+		chmod  /file
+	`))
+}
+
+func TestKqueueAddNarrowerFlags(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	// This is what internalWatch does for subdirectories; it shouldn't
+	// remove the NOTE_WRITE from the Add.
+	if _, err := w.w.addWatch(tmp, unix.NOTE_DELETE|unix.NOTE_RENAME); err != nil {
+		t.Fatal(err)
+	}
+
+	touch(t, tmp, "file")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /file
+	`))
+}
+
+// A Chmod for a directory that arrives in the same kevent as a Write for its
+// entries isn't lost.
+func TestKqueueDirCoalesced(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "dir")
+	mkdir(t, dir, noWait)
+
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, dir)
+
+	chmod(t, 0o700, dir, noWait)
+	touch(t, dir, "file", noWait)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		chmod   /dir
+		create  /dir/file
+	`))
+}
+
+func TestKqueueDevice(t *testing.T) {
+	t.Parallel()
+
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, "/dev/null")
+
+	// Writing to the device isn't a change.
+	if err := os.WriteFile("/dev/null", []byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+
+	cmpEvents(t, "", w.stop(t), newEvents(t, ``))
+}
+
+func TestKqueueSpecialFiles(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	fifo := filepath.Join(tmp, "fifo")
+	if err := unix.Mkfifo(fifo, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Silently skipped without the option.
+	w := newWatcher(t, fifo)
+	if n := w.Count(); n != 0 {
+		t.Errorf("Count: have %d, want 0", n)
+	}
+	w.Close()
+
+	w2 := newCollector(t, WithWatchSpecialFiles())
+	w2.collect(t)
+	addWatch(t, w2.w, fifo)
+
+	// Use a short path, as the length of socket paths is limited.
+	dir, err := os.MkdirTemp("", "fsnotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := w2.w.Add(filepath.Join(dir, "sock")); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported for a socket, got: %v", err)
+	}
+
+	chmod(t, 0o644, fifo)
+	rm(t, fifo)
+
+	cmpEvents(t, tmp, w2.stop(t), newEvents(t, `
+		chmod   /fifo
+		remove  /fifo
+	`))
+}
+
+func TestKqueueRescanDelay(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+
+	w := newCollector(t, WithRescanDelay(100*time.Millisecond))
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	// Every file must be reported once, even though the directory is only
+	// read once for most of them.
+	var want string
+	for i := 0; i < 20; i++ {
+		touch(t, tmp, fmt.Sprintf("file-%02d", i), noWait)
+		want += fmt.Sprintf("create /file-%02d\n", i)
+	}
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, want))
+}
+
+func TestKqueuePollFallback(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	touch(t, file, noWait)
+
+	w := newCollector(t, WithPollFallback(20*time.Millisecond))
+	w.collect(t)
+	addWatch(t, w.w, file)
+	eventSeparator()
+
+	// Pretend this is a filesystem that never sends kevents.
+	w.w.mu.Lock()
+	fd := w.w.watches[file]
+	w.w.mu.Unlock()
+	if err := register(w.w.kq, []int{fd}, unix.EV_DELETE, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	cat(t, "data", file)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write  /file
+	`))
+}
+
+func TestKqueueReadTimeout(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file", noWait)
+
+	w := newCollector(t, WithReadTimeout(10*time.Millisecond), WithDedup(10*time.Millisecond))
+	w.collect(t)
+	addWatch(t, w.w, tmp, "file")
+
+	cat(t, "data", tmp, "file")
+	waitForEvents()
+
+	// Waking up without kevents shouldn't send any errors, and the entry
+	// for the Write should be gone without any more events.
+	w.w.pipeline.dedup.mu.Lock()
+	n := len(w.w.pipeline.dedup.sent)
+	w.w.pipeline.dedup.mu.Unlock()
+	if n != 0 {
+		t.Errorf("dedup entries: have %d, want 0", n)
+	}
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write  /file
+	`))
+}
+
+// BenchmarkKqueueDirChurn measures how long it takes to get a Create event in a
+// directory with many files, for which kqueue has to re-read the directory.
+func BenchmarkKqueueDirChurn(b *testing.B) {
+	tmp := b.TempDir()
+	for i := 0; i < 10000; i++ {
+		fp, err := os.Create(filepath.Join(tmp, fmt.Sprintf("file-%d", i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		fp.Close()
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Add(tmp); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		name := filepath.Join(tmp, fmt.Sprintf("new-%d", i))
+		fp, err := os.Create(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		fp.Close()
+
+		for e := range w.Events {
+			if e.Name == name && e.Op&Create == Create {
+				break
+			}
+		}
+
+		// Remove it again, so that the number of watches stays the same.
+		b.StopTimer()
+		if err := os.Remove(name); err != nil {
+			b.Fatal(err)
+		}
+		for e := range w.Events {
+			if e.Name == name && e.Op&Remove == Remove {
+				break
+			}
+		}
+		b.StartTimer()
+	}
+}
+
+// BenchmarkKqueueDirChurnBulk is like BenchmarkKqueueDirChurn, but creates and
+// removes 100 files at a time in the directory with 10,000 files, as in a bulk
+// operation, so that most directory events are read while files are changing.
+func BenchmarkKqueueDirChurnBulk(b *testing.B) {
+	const bulk = 100
+
+	tmp := b.TempDir()
+	for i := 0; i < 10000; i++ {
+		fp, err := os.Create(filepath.Join(tmp, fmt.Sprintf("file-%d", i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		fp.Close()
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Add(tmp); err != nil {
+		b.Fatal(err)
+	}
+
+	// waitFor reads events until there was one with op for every name.
+	waitFor := func(op Op, names map[string]bool) {
+		for len(names) > 0 {
+			select {
+			case e := <-w.Events:
+				if e.Op&op == op {
+					delete(names, e.Name)
+				}
+			case err := <-w.Errors:
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		names := make([]string, bulk)
+		pending := make(map[string]bool, bulk)
+		for j := range names {
+			names[j] = filepath.Join(tmp, fmt.Sprintf("new-%d-%d", i, j))
+			pending[names[j]] = true
+			fp, err := os.Create(names[j])
+			if err != nil {
+				b.Fatal(err)
+			}
+			fp.Close()
+		}
+		waitFor(Create, pending)
+
+		for _, name := range names {
+			pending[name] = true
+			if err := os.Remove(name); err != nil {
+				b.Fatal(err)
+			}
+		}
+		waitFor(Remove, pending)
+	}
+}
+
+// BenchmarkKqueueLargeDir measures adding a directory with many files, and
+// getting a Create event in it, for which kqueue has to read the directory.
+// Without WithDirOnly every file has a watch, so there are fewer files to stay
+// below the limit on open files.
+func BenchmarkKqueueLargeDir(b *testing.B) {
+	for _, bb := range []struct {
+		name  string
+		files int
+		opts  []Option
+	}{
+		{"files", 20000, nil},
+		{"dirOnly", 100000, []Option{WithDirOnly()}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			tmp := b.TempDir()
+			for i := 0; i < bb.files; i++ {
+				fp, err := os.Create(filepath.Join(tmp, fmt.Sprintf("file-%d", i)))
+				if err != nil {
+					b.Fatal(err)
+				}
+				fp.Close()
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w, err := NewWatcher(bb.opts...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Add(tmp); err != nil {
+					b.Fatal(err)
+				}
+
+				name := filepath.Join(tmp, fmt.Sprintf("new-%d", i))
+				fp, err := os.Create(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				fp.Close()
+				for e := range w.Events {
+					if e.Name == name && e.Op&Create == Create {
+						break
+					}
+				}
+				w.Close()
+			}
+		})
+	}
+}
+
+// The Remove for a file that's overwritten by a rename must always be sent
+// before the Create for the new file, no matter in which order the kevents for
+// the file and the directory are read.
+func TestKqueueOverwriteOrder(t *testing.T) {
+	t.Parallel()
+
+	for i := 0; i < 5; i++ {
+		tmp := t.TempDir()
+		touch(t, tmp, "f1", noWait)
+		touch(t, tmp, "f2", noWait)
+
+		w := newCollector(t)
+		w.collect(t)
+		addWatch(t, w.w, tmp)
+
+		mv(t, filepath.Join(tmp, "f1"), tmp, "f2")
+
+		have := w.stop(t)
+		removeAt, createAt := -1, -1
+		for j, e := range have {
+			if e.Name != filepath.Join(tmp, "f2") {
+				continue
+			}
+			if e.Op&Remove == Remove && removeAt == -1 {
+				removeAt = j
+			}
+			if e.Op&Create == Create && createAt == -1 {
+				createAt = j
+			}
+		}
+		if removeAt == -1 || createAt == -1 || createAt < removeAt {
+			t.Fatalf("want Remove before Create for f2:\n%s", indent(have))
+		}
+	}
+}
+
+func TestKqueueOriginalNames(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	symlink(t, filepath.Join(tmp, "dir"), tmp, "link")
+
+	w := newCollector(t, WithOriginalNames())
+	w.collect(t)
+	addWatch(t, w.w, tmp, "link")
+
+	touch(t, tmp, "dir", "file")
+	rm(t, tmp, "dir", "file")
+
+	have := w.stop(t)
+	if len(have) == 0 {
+		t.Fatal("no events")
+	}
+	for _, e := range have {
+		if e.Name != filepath.Join(tmp, "link", "file") {
+			t.Errorf("wrong name: %s\n%s", e.Name, indent(have))
+		}
+	}
+
+	// Removing the link removes the watch for the directory.
+	w2, err := NewWatcher(WithOriginalNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	addWatch(t, w2, tmp, "link")
+	if err := w2.Remove(filepath.Join(tmp, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if n := w2.WatchCount(); n != 0 {
+		t.Errorf("WatchCount = %d after Remove", n)
+	}
+}
+
+func TestKqueueRawOp(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	cat(t, "data", file)
+
+	w, err := NewWatcher(WithExtendedEvents())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, file)
+
+	// Appending to a file sets NOTE_EXTEND as well as NOTE_WRITE; both are
+	// reported as Write, but RawOp has the fflags as kevent returned them.
+	cat(t, "more", file)
+	select {
+	case e := <-w.Events:
+		if e.Op&Write != Write {
+			t.Errorf("want Write, have %s", e)
+		}
+		if e.RawOp&unix.NOTE_EXTEND != unix.NOTE_EXTEND {
+			t.Errorf("NOTE_EXTEND not set in RawOp: %#x", e.RawOp)
+		}
+	case err := <-w.Errors:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for write event")
+	}
+}
+
+func TestKqueueAddRaw(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "lock")
+	touch(t, file, noWait)
+
+	w := newCollector(t)
+	w.collect(t)
+	if err := w.w.AddRaw(file, unix.NOTE_DELETE|unix.NOTE_RENAME); err != nil {
+		t.Fatal(err)
+	}
+
+	cat(t, "data", file)
+	chmod(t, 0o600, file)
+	rm(t, file)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		remove  /lock
+	`))
+}
+
+func TestKqueueAddRawExtend(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "log")
+	cat(t, "data", file)
+
+	w := newCollector(t)
+	w.collect(t)
+	if err := w.w.AddRaw(file, unix.NOTE_EXTEND); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwriting the data without growing the file isn't reported.
+	fp, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt([]byte("DATA"), 0); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	eventSeparator()
+
+	cat(t, "more data", file)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write  /log
+	`))
+}
+
+func TestKqueueReadFailures(t *testing.T) {
+	t.Parallel()
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, t.TempDir())
+
+	// Replace the kqueue with something that isn't one, so that every
+	// kevent call fails.
+	null, err := unix.Open("/dev/null", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(null)
+	if err := unix.Dup2(null, w.kq); err != nil {
+		t.Fatal(err)
+	}
+
+	var errs int
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-w.Errors:
+			if ok {
+				errs++
+				continue
+			}
+		case <-w.Events:
+			continue
+		case <-timeout:
+			t.Fatalf("watcher not closed after %d errors", errs)
+		}
+		break
+	}
+	if errs != maxReadFailures {
+		t.Errorf("have %d errors, want %d", errs, maxReadFailures)
+	}
+	if !w.Closed() {
+		t.Error("Closed() = false after giving up")
+	}
+}
+
+func TestKqueueReadBackoff(t *testing.T) {
+	for _, tt := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Millisecond},
+		{2, 2 * time.Millisecond},
+		{10, 512 * time.Millisecond},
+		{11, time.Second},
+		{100, time.Second},
+	} {
+		if have := readBackoff(tt.failures); have != tt.want {
+			t.Errorf("readBackoff(%d) = %s, want %s", tt.failures, have, tt.want)
+		}
+	}
+}
+
+func TestKqueueNeedsExistCheck(t *testing.T) {
+	var (
+		dir  = pathInfo{name: "/dir", isDir: true}
+		file = pathInfo{name: "/dir/file"}
+		byFd = pathInfo{name: "file", byFd: true}
+	)
+	for _, tt := range []struct {
+		p        pathInfo
+		op       Op
+		removing bool
+		want     bool
+	}{
+		{dir, Write, false, true},
+		{dir, Chmod, true, true},
+		{dir, Remove, true, false},
+		{file, Write, false, false},
+		{file, Chmod, false, false},
+		{file, Write, true, true},
+		{file, Rename, true, false},
+		{byFd, Write, true, false},
+	} {
+		if have := needsExistCheck(tt.p, tt.op, tt.removing); have != tt.want {
+			t.Errorf("needsExistCheck(%+v, %s, %t) = %t, want %t", tt.p, tt.op, tt.removing, have, tt.want)
+		}
+	}
+
+	removal := []unix.Kevent_t{{Fflags: unix.NOTE_WRITE}, {Fflags: unix.NOTE_DELETE}}
+	if !hasRemoval(removal) {
+		t.Error("hasRemoval = false for a NOTE_DELETE")
+	}
+	if hasRemoval(removal[:1]) {
+		t.Error("hasRemoval = true for only a NOTE_WRITE")
+	}
+}
+
+// Rescan writes to the closepipe while holding w.mu, so it must not block
+// when the pipe is full.
+func TestKqueueRescanPipeFull(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	flags, err := unix.FcntlInt(uintptr(w.w.closepipe[1]), unix.F_GETFL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&unix.O_NONBLOCK == 0 {
+		t.Error("the write end of the closepipe is blocking")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// More than fits in the pipe.
+		for i := 0; i < 200000; i++ {
+			if err := w.w.Rescan(tmp); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Rescan blocked")
+	}
+	w.stop(t)
+}
+
+func TestKqueueDirEntries(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "a", noWait)
+
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+
+	touch(t, tmp, "b")
+	touch(t, tmp, "c")
+
+	events := w.stop(t)
+	var have []string
+	for _, e := range events {
+		if e.Op&Create == Create {
+			have = append(have, fmt.Sprintf("%s=%d", filepath.Base(e.Name), e.DirEntries))
+		}
+	}
+	if want := "[b=2 c=3]"; fmt.Sprint(have) != want {
+		t.Errorf("DirEntries:\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestKqueueAddFileFd(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	touch(t, file, noWait)
+
+	fd, err := unix.Open(file, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fd), "fd-name")
+
+	w := newCollector(t)
+	w.collect(t)
+	err = w.w.AddFile(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cat(t, "data", file)
+	events := w.stop(t)
+	if len(events) == 0 || events[0].Name != "fd-name" || events[0].Op&Write == 0 {
+		t.Errorf("wrong events:\n%s", events)
+	}
+}
+
+// A file below two symlinks that were added gets the name of the closest one,
+// regardless of the map order.
+func TestKqueueLinkNamesNested(t *testing.T) {
+	var l linkNames
+	l.add("/real", "/link")
+	l.add("/real/sub", "/sublink")
+
+	for i := 0; i < 20; i++ {
+		have := l.events(Event{Name: "/real/sub/file", Op: Create})
+		if len(have) != 1 || have[0].Name != "/sublink/file" {
+			t.Fatalf("have %v, want /sublink/file", have)
+		}
+	}
+	if have := l.events(Event{Name: "/real/file", Op: Create}); len(have) != 1 || have[0].Name != "/link/file" {
+		t.Errorf("have %v, want /link/file", have)
+	}
+	if have := l.events(Event{Name: "/other/file", Op: Create}); have != nil {
+		t.Errorf("have %v, want nil", have)
+	}
+}
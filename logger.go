@@ -0,0 +1,64 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || solaris || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd solaris windows
+
+package fsnotify
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// SetLogger sets a function that's called with diagnostic messages about the
+// decisions the Watcher makes internally, such as following a symlink,
+// skipping a special file, rescanning a directory, or re-arming a watch. This
+// is useful to find out why an event was or wasn't sent. Pass nil to stop
+// logging, which is the default.
+//
+// The messages are meant for humans and may change between versions. The
+// function may be called from any goroutine, and must not call back into the
+// Watcher.
+func (w *Watcher) SetLogger(f func(format string, args ...interface{})) {
+	w.logger.Store(&f)
+}
+
+// logf calls the function set with SetLogger, if any.
+func (w *Watcher) logf(format string, args ...interface{}) {
+	if f := w.loggerFunc(); f != nil {
+		f(format, args...)
+	}
+}
+
+func (w *Watcher) loggerFunc() func(string, ...interface{}) {
+	if f, _ := w.logger.Load().(*func(string, ...interface{})); f != nil {
+		return *f
+	}
+	return nil
+}
+
+// logAdded logs how name, which was just added, is watched on the platforms
+// where the kernel decides that (inotify and ReadDirectoryChangesW): a symlink
+// is followed, and sockets and named pipes are watched like any other file.
+// kqueue logs this itself when it opens the path.
+func (w *Watcher) logAdded(name string) {
+	if w.loggerFunc() == nil {
+		return
+	}
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
+		if target, err := filepath.EvalSymlinks(name); err == nil {
+			w.logf("following symlink %s to %s", name, target)
+		}
+	case fi.Mode()&os.ModeSocket == os.ModeSocket:
+		w.logf("watching socket %s", name)
+	case fi.Mode()&os.ModeNamedPipe == os.ModeNamedPipe:
+		w.logf("watching named pipe %s", name)
+	}
+}
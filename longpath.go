@@ -0,0 +1,190 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd
+// +build darwin dragonfly freebsd openbsd linux netbsd
+
+package fsnotify
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Paths that are longer than PATH_MAX can't be passed to system calls, but
+// they can still be reached by opening every directory on the way with
+// openat(), as long as every component fits in NAME_MAX. The functions here
+// fall back to that when the system call fails with ENAMETOOLONG.
+
+// lstat is os.Lstat, for paths of any length.
+func lstat(name string) (os.FileInfo, error) {
+	fi, err := os.Lstat(name)
+	if !errors.Is(err, unix.ENAMETOOLONG) {
+		return fi, err
+	}
+
+	dirfd, base, err := openParent(name)
+	if err != nil {
+		return nil, longPathError("lstat", name, err)
+	}
+	defer unix.Close(dirfd)
+
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirfd, base, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, longPathError("lstat", name, err)
+	}
+	return &statInfo{name: base, st: st}, nil
+}
+
+// readDir is like os.ReadDir, for paths of any length, but returns the entries
+// in directory order: sorting them by name is too slow for huge directories,
+// and the order doesn't matter for reading the changes.
+func readDir(name string) ([]fs.DirEntry, error) {
+	f, err := openDir(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.ReadDir(-1)
+}
+
+// dirBatchSize is the number of entries readDirBatches reads at a time.
+const dirBatchSize = 1024
+
+// readDirBatches calls fn with the entries in the directory name, at most n at a
+// time, in directory order, until fn returns false. This avoids having all
+// entries of a huge directory in memory at once.
+func readDirBatches(name string, n int, fn func([]fs.DirEntry) bool) error {
+	f, err := openDir(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		entries, err := f.ReadDir(n)
+		if len(entries) > 0 && !fn(entries) {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// openDir opens the directory name for reading, for paths of any length.
+func openDir(name string) (*os.File, error) {
+	f, err := os.Open(name)
+	if !errors.Is(err, unix.ENAMETOOLONG) {
+		return f, err
+	}
+	fd, err := openLong(name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// openLong opens name with openat() from its parent directory, for a name
+// that's too long for open().
+func openLong(name string, mode int) (int, error) {
+	dirfd, base, err := openParent(name)
+	if err != nil {
+		return -1, longPathError("open", name, err)
+	}
+	defer unix.Close(dirfd)
+
+	fd, err := unix.Openat(dirfd, base, mode, 0)
+	if err != nil {
+		return -1, longPathError("open", name, err)
+	}
+	return fd, nil
+}
+
+// openParent opens the parent directory of name one component at a time,
+// and returns it along with the last component of name.
+func openParent(name string) (int, string, error) {
+	const mode = unix.O_RDONLY | unix.O_DIRECTORY | unix.O_CLOEXEC
+
+	dir, base := filepath.Split(filepath.Clean(name))
+	start := "."
+	if filepath.IsAbs(dir) {
+		start = "/"
+	}
+	fd, err := unix.Open(start, mode, 0)
+	if err != nil {
+		return -1, "", err
+	}
+	for _, c := range strings.Split(dir, "/") {
+		if c == "" || c == "." {
+			continue
+		}
+		next, err := unix.Openat(fd, c, mode, 0)
+		unix.Close(fd)
+		if err != nil {
+			return -1, "", err
+		}
+		fd = next
+	}
+	return fd, base, nil
+}
+
+// longPathError returns an *os.PathError for err. ENAMETOOLONG is replaced with
+// ErrPathTooLong, as that means a single component of name is too long.
+func longPathError(op, name string, err error) error {
+	if errors.Is(err, unix.ENAMETOOLONG) {
+		err = ErrPathTooLong
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// statInfo is an os.FileInfo for a unix.Stat_t.
+type statInfo struct {
+	name string
+	st   unix.Stat_t
+}
+
+func (fi *statInfo) Name() string       { return fi.name }
+func (fi *statInfo) Size() int64        { return fi.st.Size }
+func (fi *statInfo) ModTime() time.Time { return time.Unix(fi.st.Mtim.Unix()) }
+func (fi *statInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *statInfo) Sys() interface{}   { return &fi.st }
+
+func (fi *statInfo) Mode() fs.FileMode {
+	m := uint32(fi.st.Mode)
+	mode := fs.FileMode(m & 0o777)
+	switch m & unix.S_IFMT {
+	case unix.S_IFDIR:
+		mode |= fs.ModeDir
+	case unix.S_IFLNK:
+		mode |= fs.ModeSymlink
+	case unix.S_IFIFO:
+		mode |= fs.ModeNamedPipe
+	case unix.S_IFSOCK:
+		mode |= fs.ModeSocket
+	case unix.S_IFCHR:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case unix.S_IFBLK:
+		mode |= fs.ModeDevice
+	}
+	if m&unix.S_ISUID != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&unix.S_ISGID != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&unix.S_ISVTX != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd
+// +build darwin dragonfly freebsd openbsd linux netbsd
+
+package fsnotify
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWatchLongPath(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Longer than PATH_MAX everywhere, but every component fits in NAME_MAX.
+	long := tmp
+	comp := strings.Repeat("x", 200)
+	for len(long) < 5000 {
+		dirfd, _, err := openParent(filepath.Join(long, comp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = unix.Mkdirat(dirfd, comp, 0o755)
+		unix.Close(dirfd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		long = filepath.Join(long, comp)
+	}
+
+	w := newCollector(t)
+	w.collect(t)
+	if err := w.w.Add(long); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := openLong(filepath.Join(long, "file"), unix.O_WRONLY|unix.O_CREAT|unix.O_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(fd)
+
+	cmpEvents(t, long, w.stop(t), newEvents(t, `
+		create  /file
+	`))
+
+	w2 := newWatcher(t)
+	defer w2.Close()
+	err = w2.Add(filepath.Join(long, strings.Repeat("y", 300)))
+	if !errors.Is(err, ErrPathTooLong) {
+		t.Errorf("Add with a component longer than NAME_MAX: have %v, want ErrPathTooLong", err)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+// SetEventMapper sets the EventMapper that's used instead of the one set with
+// WithEventMapper, for the events read after it returns. Pass nil to use
+// DefaultEventMapper.
+//
+// m is called from the goroutine that reads the events from the kernel, so it
+// must return quickly and must not call back into the Watcher.
+func (w *Watcher) SetEventMapper(m EventMapper) {
+	w.mapper.Store(&m)
+}
+
+// mapEvent converts mask to an Event with the EventMapper set with
+// SetEventMapper or WithEventMapper, or DefaultEventMapper.
+func (w *Watcher) mapEvent(name string, mask uint32) Event {
+	m := w.opts.eventMapper
+	if f, ok := w.mapper.Load().(*EventMapper); ok {
+		m = *f
+	}
+	if m != nil {
+		return m(name, mask)
+	}
+	return DefaultEventMapper(name, mask)
+}
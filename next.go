@@ -0,0 +1,21 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import "context"
+
+// Next waits for the next event. If an error is sent on the Errors channel
+// first it's returned instead, and the context's error is returned if it's
+// done first. ErrClosed is returned once the watcher is closed and all events
+// are received.
+//
+// This can be mixed with receiving from the Events and Errors channels
+// directly; every event or error is received only once.
+func (w *Watcher) Next(ctx context.Context) (Event, error) {
+	return next(ctx, w.Events, w.Errors)
+}
@@ -0,0 +1,36 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || solaris || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd solaris windows
+
+package fsnotify
+
+import "path/filepath"
+
+// SetPathNormalizer sets the function that's used instead of filepath.Clean to
+// normalize the paths passed to Add, Remove, and the other methods that take a
+// path. The normalized path is used to look up the watch, and is the Name of
+// the events for it; the Name of an event for a file in a watched directory is
+// the normalized directory joined with the file name. Pass nil to use
+// filepath.Clean again.
+//
+// It must be set before anything is added, and f must always return the same
+// path for the same file: Remove may not find a watch that was added with a
+// path that was normalized differently, and return ErrNonExistentWatch.
+//
+// f may be called while the Watcher holds its internal locks, so it must not
+// call back into the Watcher.
+func (w *Watcher) SetPathNormalizer(f func(string) string) {
+	w.normalizer.Store(&f)
+}
+
+// cleanPath normalizes name with the function set with SetPathNormalizer, or
+// filepath.Clean.
+func (w *Watcher) cleanPath(name string) string {
+	if f, _ := w.normalizer.Load().(*func(string) string); f != nil && *f != nil {
+		return (*f)(name)
+	}
+	return filepath.Clean(name)
+}
@@ -0,0 +1,487 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fsnotify
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// Option configures a Watcher; options are passed to NewWatcher.
+type Option func(*withOpts)
+
+type withOpts struct {
+	sizeTracking   bool
+	bufferSize     int
+	backpressure   Backpressure
+	closeWrite     bool
+	dirOnly        bool
+	access         bool
+	moveEvents     bool
+	extendedEvents bool
+	initialScan    bool
+	deferredCreate bool
+	maxWatches     int
+	attrDetail     bool
+	followReplace  bool
+	replaceWrite   bool
+	sendTimeout    time.Duration
+	followLinks    bool
+	dropErrors     bool
+	errorsBuffer   int
+	followDirs     bool
+	rootRemoved    bool
+	watchLost      bool
+	fileID         bool
+	rateLimit      int
+	rateWindow     time.Duration
+	dedupWindow    time.Duration
+	atomicSaves    time.Duration
+	dirWrites      bool
+	origNames      bool
+	rescanDelay    time.Duration
+	pollInterval   time.Duration
+	readTimeout    time.Duration
+	eventMapper    EventMapper
+	relativeRoot   string
+	specialFiles   bool
+	childrenOnly   bool
+	ignoreHidden   bool
+}
+
+func getOptions(opts ...Option) withOpts {
+	with := withOpts{bufferSize: -1}
+	for _, o := range opts {
+		o(&with)
+	}
+	return with
+}
+
+// eventsBuffer returns the size of the Events buffer to use, which is def unless
+// it was set with WithBufferSize.
+func (o withOpts) eventsBuffer(def int) int {
+	if o.bufferSize < 0 {
+		return def
+	}
+	return o.bufferSize
+}
+
+// WithSizeTracking sets Event.Size on Write events to the size of the file
+// after the change, and Event.Truncated if it became smaller, so that a
+// truncation can be told apart from an append.
+//
+// This adds a stat call for every Write event.
+func WithSizeTracking() Option {
+	return func(opt *withOpts) { opt.sizeTracking = true }
+}
+
+// Backpressure is the policy used when an event can't be delivered because the
+// Events channel is full, which happens when the consumer isn't keeping up.
+type Backpressure uint8
+
+const (
+	// Block waits until the consumer reads from the Events channel. This is
+	// the default.
+	Block Backpressure = iota
+
+	// DropOldest discards the oldest event in the Events buffer to make room
+	// for the new one. On an unbuffered channel this behaves like DropNewest.
+	DropOldest
+
+	// DropNewest discards the new event.
+	DropNewest
+)
+
+// WithBackpressure sets the policy for delivering events when the Events
+// channel is full.
+//
+// The first discarded event after a second without any is reported by sending
+// ErrEventDropped on the Errors channel, if it's ready to receive; the reader
+// never blocks on this. Watcher.Dropped returns the total number of discarded
+// events. The drop policies are mostly useful in combination with
+// WithBufferSize.
+func WithBackpressure(p Backpressure) Option {
+	return func(opt *withOpts) { opt.backpressure = p }
+}
+
+// WithSendTimeout discards an event if sending it on the Events channel
+// blocks for longer than d, so that a consumer that stopped reading without
+// calling Close doesn't block the Watcher forever. Discarded events are
+// reported and counted in Watcher.Dropped like those discarded by
+// WithBackpressure.
+//
+// This only applies to the Block policy; every event still waits up to d, so
+// d should be well above the time it normally takes to handle an event.
+func WithSendTimeout(d time.Duration) Option {
+	return func(opt *withOpts) { opt.sendTimeout = d }
+}
+
+// WithDropErrors gives the Errors channel a buffer of n, and discards errors
+// that don't fit in it instead of waiting for them to be received; without
+// this, a consumer that doesn't receive from Errors stops all events from
+// being sent. Watcher.DroppedErrors returns the number of discarded errors.
+//
+// Discarded errors are lost for good, and some of them, such as
+// ErrEventOverflow, mean that events were missed; so only use this if the
+// errors are purely informational to you, or check DroppedErrors.
+func WithDropErrors(n uint) Option {
+	return func(opt *withOpts) { opt.dropErrors, opt.errorsBuffer = true, int(n) }
+}
+
+// WithBufferSize sets the buffer size of the Events channel. The default is
+// an unbuffered channel on most platforms, and a buffer of 50 on Windows.
+func WithBufferSize(n uint) Option {
+	return func(opt *withOpts) { opt.bufferSize = int(n) }
+}
+
+// WithCloseWrite enables the CloseWrite op, which is sent when a writer closes
+// a file. This is a more reliable signal that a file is ready to be read than
+// Write.
+//
+// This is only supported on Linux; on other platforms it's a no-op.
+func WithCloseWrite() Option {
+	return func(opt *withOpts) { opt.closeWrite = true }
+}
+
+// WithDirOnly only reports structural changes of watched directories: files
+// being created, removed, or renamed. Write and Chmod events for the files in
+// the directory are not sent.
+//
+// With kqueue this means the files in the directory aren't opened and watched
+// individually, which greatly reduces the number of file descriptors used for
+// large directories. Create and Remove events for the entries are detected by
+// re-reading the directory when it changes.
+func WithDirOnly() Option {
+	return func(opt *withOpts) { opt.dirOnly = true }
+}
+
+// WithRescanDelay waits for d after a directory changes before reading it to
+// find the new files with kqueue, so that all changes within d cause only one
+// read. This reduces the work for bulk operations such as extracting an
+// archive, at the cost of sending the Create events up to d later.
+//
+// Without this option, changes are only combined if kqueue reports them
+// together. On other platforms this is a no-op.
+func WithRescanDelay(d time.Duration) Option {
+	return func(opt *withOpts) { opt.rescanDelay = d }
+}
+
+// WithPollFallback checks all watched paths every interval with kqueue, to
+// find watches that don't get any kevents, as happens on some FUSE
+// filesystems. If a path changes without a kevent for two checks in a row it's
+// polled from then on, and Write, Chmod, and Remove events are sent for the
+// changes that are seen; for directories the Create events are found by
+// reading the directory, as usual.
+//
+// This stats every watched path at every interval. On other platforms this is
+// a no-op.
+func WithPollFallback(interval time.Duration) Option {
+	return func(opt *withOpts) { opt.pollInterval = interval }
+}
+
+// WithReadTimeout wakes up the goroutine that reads the kqueue at least every
+// d, even if there are no kevents, to forget state that's no longer needed for
+// WithRateLimit and WithDedup. Without this option it only wakes up for
+// kevents, Close, and the other options that need a timer.
+//
+// On other platforms this is a no-op.
+func WithReadTimeout(d time.Duration) Option {
+	return func(opt *withOpts) { opt.readTimeout = d }
+}
+
+// WithDirWriteEvents also sends a Write event for a watched directory when a
+// file is created, removed, or renamed in it, in addition to the event for the
+// file itself.
+//
+// Without this option the changes to a directory are only reported as the
+// events for the files in it, on all platforms.
+func WithDirWriteEvents() Option {
+	return func(opt *withOpts) { opt.dirWrites = true }
+}
+
+// WithOriginalNames sends events for a path that was added through a symlink
+// with the name that was passed to Add, rather than the path the symlink
+// resolves to.
+//
+// This only affects kqueue; inotify and ReadDirectoryChangesW already use the
+// name that was passed to Add.
+func WithOriginalNames() Option {
+	return func(opt *withOpts) { opt.origNames = true }
+}
+
+// WithAccessEvents enables the Open and Access ops, which are sent when a file
+// is opened or read. This can generate a very large number of events.
+//
+// This is only supported on Linux; on other platforms it's a no-op.
+func WithAccessEvents() Option {
+	return func(opt *withOpts) { opt.access = true }
+}
+
+// WithMoveEvents adds the MovedFrom and MovedTo ops to rename events, to tell
+// apart a file being moved out of a directory from one being moved in to it.
+func WithMoveEvents() Option {
+	return func(opt *withOpts) { opt.moveEvents = true }
+}
+
+// WithExtendedEvents also watches files for NOTE_EXTEND, NOTE_LINK, and
+// NOTE_REVOKE with kqueue. NOTE_EXTEND (the file grew) is sent as Write,
+// NOTE_LINK (the link count changed) as Chmod, and NOTE_REVOKE (access was
+// revoked, for example because the filesystem was unmounted) as Remove.
+//
+// NOTE_EXTEND isn't always accompanied by NOTE_WRITE, so this can be useful to
+// follow files that are appended to. Event.RawOp has NOTE_EXTEND if the file
+// grew, to tell an append apart from other writes; use Watcher.AddRaw with
+// only NOTE_EXTEND to watch for nothing but appends. This is a no-op on other
+// platforms.
+func WithExtendedEvents() Option {
+	return func(opt *withOpts) { opt.extendedEvents = true }
+}
+
+// WithInitialScan sends a Create event for every entry that already exists in
+// a directory when it's added, so that files present at startup can be handled
+// the same way as files created later.
+//
+// The directory is read after the watch is added, so no file is missed between
+// the two. These events are sent before any events for changes after the watch
+// was added. A file that's created while Add is running may be reported twice.
+func WithInitialScan() Option {
+	return func(opt *withOpts) { opt.initialScan = true }
+}
+
+// WithDeferredCreate makes Add succeed for a path that doesn't exist yet.
+// Instead, the nearest existing parent directory is watched, and the path is
+// added as soon as it's created, which is reported with a Create event.
+// After that the events for the path are sent as usual.
+//
+// This is useful for a file that may not exist when the program starts, such
+// as a configuration file: add it once, and reload it on every Create and
+// Write, without waiting for it to appear first.
+//
+// Events for the parent directories that are watched this way aren't sent,
+// unless they were also added with Add. Removing the path with Remove stops
+// waiting for it.
+func WithDeferredCreate() Option {
+	return func(opt *withOpts) { opt.deferredCreate = true }
+}
+
+// WithMaxWatches limits the number of watches to n; adding more watches fails
+// with ErrMaxWatchesExceeded. There is no limit if n <= 0, which is the
+// default.
+//
+// With kqueue every watched file and directory uses a file descriptor,
+// including the files in a watched directory, so this can be used to make
+// sure the process doesn't run out of file descriptors. Watcher.Count
+// returns the current number of watches, and Watcher.SetMaxWatches changes the
+// limit later.
+func WithMaxWatches(n int) Option {
+	return func(opt *withOpts) { opt.maxWatches = n }
+}
+
+// WithAttrDetail sets Event.Attr on Chmod events, to tell a change of the
+// permissions apart from a change of the owner or modification time, which
+// are all reported as Chmod. To only act on permission changes, check for
+// AttrMode; a change of only the access time is reported as AttrOther.
+//
+// This stats every watched file when it's added and after every Chmod event,
+// and keeps the attributes in memory to compare against. This is only
+// supported on Linux, BSD, and macOS; on other platforms it's a no-op.
+func WithAttrDetail() Option {
+	return func(opt *withOpts) { opt.attrDetail = true }
+}
+
+// WithFollowReplace keeps watching a file that was added with Add after it's
+// replaced by a new file at the same path, as editors do when saving a file by
+// writing a temporary file and renaming it over the original.
+//
+// The Remove or Rename event for the original file is followed by a Create
+// event once there is a new file at the path, after which events for the new
+// file are sent as usual. Until then the parent directory is watched, as with
+// WithDeferredCreate.
+func WithFollowReplace() Option {
+	return func(opt *withOpts) { opt.followReplace = true }
+}
+
+// WithFollowSymlinks also watches the targets of the symlinks in watched
+// directories, and the symlinks in those if they're directories, so that
+// changes to the targets are reported. Events for a target have the path the
+// symlink resolves to as the Name. A target is only watched once, so symlink
+// loops are safe; broken symlinks are ignored.
+//
+// kqueue always follows the symlinks in watched directories, as it watches
+// every file in them; on other platforms this is opt-in.
+func WithFollowSymlinks() Option {
+	return func(opt *withOpts) { opt.followLinks = true }
+}
+
+// WithReplaceAsWrite sends a single Write event instead of the Remove or
+// Rename and Create events when a file followed with WithFollowReplace is
+// replaced, so that an editor saving the file looks the same as writing to it.
+//
+// This only applies if the new file is already there when the event for the
+// old file is read, as is the case when it's renamed over the old file; if
+// the path is briefly missing the events are sent as usual.
+func WithReplaceAsWrite() Option {
+	return func(opt *withOpts) { opt.replaceWrite = true }
+}
+
+// WithFollowDirReplace is like WithFollowReplace, but for directories: a
+// directory that was added with Add keeps being watched after it's removed
+// or renamed and a new directory is created or moved to the same path, as
+// installers do when atomically replacing a directory.
+//
+// The Create event for the new directory signals that the watch was moved to
+// it. Events for the entries in the new directory are sent as usual.
+func WithFollowDirReplace() Option {
+	return func(opt *withOpts) { opt.followDirs = true }
+}
+
+// WithRootRemoved adds the RootRemoved op to the Remove or Rename event for a
+// path that was passed to Add, when that path no longer exists. This gives a
+// single signal that a watched file or directory is gone, regardless of the
+// sequence of events the platform sends when it's removed.
+func WithRootRemoved() Option {
+	return func(opt *withOpts) { opt.rootRemoved = true }
+}
+
+// WithWatchLost sends ErrWatchLost on the Errors channel after the event for
+// a path that was passed to Add, when the watch on it is removed because the
+// path was removed, so that it can be added again. With kqueue that's also
+// done when it's renamed; inotify and ReadDirectoryChangesW keep watching a
+// renamed file, under the old name. It's not sent if a new file at the path
+// is watched right away, or with WithFollowReplace and WithFollowDirReplace,
+// which wait for a new file themselves.
+//
+// Files and directories that are only watched because they're in a watched
+// directory aren't reported.
+func WithWatchLost() Option {
+	return func(opt *withOpts) { opt.watchLost = true }
+}
+
+// WithFileID sets Event.Ino and Event.Dev to the inode and device number of
+// the file, so that hard links to the same file can be recognized.
+//
+// This adds a stat call for every event. This is only supported on Linux, BSD,
+// and macOS; on other platforms it's a no-op.
+func WithFileID() Option {
+	return func(opt *withOpts) { opt.fileID = true }
+}
+
+// WithRateLimit delivers at most n events for the same path within every
+// window; any more events for that path are discarded until the window is
+// over. Unlike debouncing this doesn't delay the events up to the limit.
+//
+// Discarded events are reported and counted in Watcher.Dropped like those
+// discarded by WithBackpressure. Watcher.SetRateLimit changes the limit later.
+func WithRateLimit(n uint, window time.Duration) Option {
+	return func(opt *withOpts) { opt.rateLimit, opt.rateWindow = int(n), window }
+}
+
+// WithDedup discards an event if an event with the same Name and Op was sent
+// within window, such as the two Write events some platforms send for a single
+// write. Unlike debouncing this doesn't delay the first event.
+//
+// Discarded duplicates aren't reported as dropped. The default is 0, which
+// doesn't discard anything.
+func WithDedup(window time.Duration) Option {
+	return func(opt *withOpts) { opt.dedupWindow = window }
+}
+
+// WithAtomicSaveDetection sends a single Write for a file that's saved
+// atomically: written to a new temporary file that's then renamed over it, as
+// many editors and tools do. The Create, Write, and Rename events for the
+// temporary file, and the Remove and Create for the file it's renamed to, are
+// replaced by a Write for the new path if the rename happens within window.
+//
+// The events for every new file are held back for up to window to detect this,
+// and so are the Remove events in its directory; they may be sent after events
+// for other files that happened later. The default is 0, which doesn't hold
+// back anything.
+func WithAtomicSaveDetection(window time.Duration) Option {
+	return func(opt *withOpts) { opt.atomicSaves = window }
+}
+
+// WithWatchSpecialFiles also watches named pipes with kqueue, for Chmod,
+// Remove, and Rename. Adding a socket fails with ErrUnsupported, as sockets
+// can't be watched with kqueue; sockets in a watched directory are skipped.
+//
+// Without this option, named pipes and sockets are silently skipped with
+// kqueue. On other platforms this is a no-op, as they're always watched.
+func WithWatchSpecialFiles() Option {
+	return func(opt *withOpts) { opt.specialFiles = true }
+}
+
+// WithChildrenOnly only sends events for the paths in a watched directory,
+// and not for the directory itself, such as a Chmod when its mode changes or,
+// with WithDirWriteEvents, a Write when its entries change. Events for a
+// watched file are sent as usual.
+//
+// This also drops the Remove or Rename event for a watched directory;
+// WithWatchLost can be used to find out when it's gone.
+func WithChildrenOnly() Option {
+	return func(opt *withOpts) { opt.childrenOnly = true }
+}
+
+// WithIgnoreHidden drops the events for hidden files and directories in a
+// watched directory: those whose name starts with a dot, such as .git or
+// .DS_Store. A hidden path that's passed to Add is still watched, and the
+// files in it are reported as usual.
+//
+// With kqueue the hidden files aren't opened and watched at all, which saves
+// file descriptors.
+func WithIgnoreHidden() Option {
+	return func(opt *withOpts) { opt.ignoreHidden = true }
+}
+
+// WithRelativePaths sets Event.Name to the path relative to root, rather than
+// the path that was passed to Add (or a path in it). An event for root itself
+// has the Name ".", and an event for a path outside root starts with "..".
+func WithRelativePaths(root string) Option {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	return func(opt *withOpts) { opt.relativeRoot = filepath.Clean(root) }
+}
+
+// EventMapper converts the platform-specific mask of an event to an Event;
+// see Event.RawOp for what the mask is on every platform.
+type EventMapper func(name string, raw uint32) Event
+
+// WithEventMapper uses m instead of DefaultEventMapper to convert the events
+// read from the operating system, for example to report a change of the
+// attributes as Write. m can wrap DefaultEventMapper and adjust its result,
+// but must not change the Name.
+//
+// Fields that are set by other options, such as Size and Attr, are set after
+// m is called, and ops that are added by options, such as MovedFrom and
+// RootRemoved, are added to the Op that m returns.
+//
+// Watcher.SetEventMapper changes the EventMapper later.
+func WithEventMapper(m EventMapper) Option {
+	return func(opt *withOpts) { opt.eventMapper = m }
+}
+
+// AddOption configures a single watch; options are passed to Watcher.AddWith.
+type AddOption func(*addOpts)
+
+type addOpts struct {
+	access bool
+}
+
+func getAddOptions(opts ...AddOption) addOpts {
+	var with addOpts
+	for _, o := range opts {
+		o(&with)
+	}
+	return with
+}
+
+// WithAccess enables the Open and Access ops for this watch only, rather than
+// for all watches like WithAccessEvents.
+//
+// This is only supported on Linux; on other platforms AddWith fails with
+// ErrUnsupported.
+func WithAccess() AddOption {
+	return func(opt *addOpts) { opt.access = true }
+}
@@ -0,0 +1,41 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+// Pause stops sending events until Resume is called, for example to not react
+// to changes the program makes itself. The kernel is still read while paused,
+// so it doesn't overflow, but the events are discarded instead of sent. Errors
+// are still sent.
+//
+// Calling Pause while already paused does nothing.
+func (w *Watcher) Pause() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused = true
+}
+
+// Resume sends events again after Pause, and returns the number of events that
+// were discarded while paused; it returns 0 if the Watcher wasn't paused.
+func (w *Watcher) Resume() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := w.suppressed
+	w.paused, w.suppressed = false, 0
+	return n
+}
+
+// suppress reports if an event should be discarded because the Watcher is
+// paused, and counts it if so.
+func (w *Watcher) suppress() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.paused {
+		w.suppressed++
+	}
+	return w.paused
+}
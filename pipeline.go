@@ -0,0 +1,101 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import "path/filepath"
+
+// eventPipeline is the state for the options that change, hold back, or drop
+// the events after a backend created them. The work is the same for every
+// backend, and is done in three stages:
+//
+//   - prepareEvents, from sendEvent, adds RootRemoved, replaces the events for
+//     WithDeferredCreate, and holds back the events for
+//     WithAtomicSaveDetection;
+//   - skipEvent, from deliverEvent, drops the events for WithIgnoreHidden and
+//     WithChildrenOnly, which only depend on the path;
+//   - filterEvent, just before an event is sent, drops the events for Pause,
+//     WithDedup, and WithRateLimit, and sets the fields for WithFileID and
+//     WithRelativePaths.
+//
+// Every backend calls the stages itself, as what happens between them
+// differs: with kqueue and WithOriginalNames an event is split in to one event
+// for every name of the file after skipEvent, and filterEvent is done for
+// each of them. What happens before and after the stages, such as reading the
+// kernel events and sending them on the Events channel, is up to the backend.
+type eventPipeline struct {
+	deferred deferredWatches // Paths for WithDeferredCreate.
+	roots    rootWatches     // Paths passed to Add, for WithRootRemoved.
+	sizes    sizeCache       // File sizes for WithSizeTracking.
+	saves    atomicSaves     // Events held back for WithAtomicSaveDetection.
+	dedup    dedupFilter     // Events sent recently, for WithDedup.
+	limiter  rateLimiter     // Events per path, for WithRateLimit.
+}
+
+// prepareEvents is the first stage of eventPipeline. It returns the events to
+// send for e, which may be none.
+func (w *Watcher) prepareEvents(e Event) []Event {
+	if w.opts.rootRemoved {
+		w.pipeline.roots.update(&e)
+	}
+	events := []Event{e}
+	if w.opts.deferred() {
+		events = w.deferredEvents(e)
+	}
+	if w.opts.atomicSaves > 0 {
+		events = w.pipeline.saves.update(events, w.opts.atomicSaves)
+	}
+	return events
+}
+
+// skipEvent is the second stage of eventPipeline. It reports if e is dropped
+// for WithIgnoreHidden or WithChildrenOnly.
+func (w *Watcher) skipEvent(e Event) bool {
+	return w.ignoreHidden(e) || w.childrenOnly(e)
+}
+
+// filterEvent is the last stage of eventPipeline. It returns false if e should
+// be dropped, and otherwise sets the fields of e that are filled in just before
+// it's sent.
+func (w *Watcher) filterEvent(e *Event) bool {
+	if w.suppress() {
+		return false
+	}
+	if w.opts.dedupWindow > 0 && !w.pipeline.dedup.allow(*e, w.opts.dedupWindow) {
+		return false
+	}
+	if n, window := w.rateLimit(); n > 0 && !w.pipeline.limiter.allow(e.Name, n, window) {
+		w.drops.drop(w.Errors)
+		return false
+	}
+	if w.opts.fileID {
+		e.Ino, e.Dev = fileID(e.Name)
+	}
+	if w.opts.relativeRoot != "" {
+		e.Name = relativeName(w.opts.relativeRoot, e.Name)
+	}
+	return true
+}
+
+// relativeName returns name relative to root, for WithRelativePaths.
+func relativeName(root, name string) string {
+	if name == "" {
+		return name
+	}
+	if !filepath.IsAbs(name) {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return name
+		}
+		name = abs
+	}
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return name
+	}
+	return rel
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import (
+	"sync"
+	"time"
+)
+
+// SetRateLimit changes the rate limit set with WithRateLimit: at most n events
+// for the same path are delivered within every window. 0 removes the limit.
+//
+// The events that were already counted in the current window of a path still
+// count against the new limit.
+func (w *Watcher) SetRateLimit(n uint, window time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.opts.rateLimit, w.opts.rateWindow = int(n), window
+}
+
+// rateLimit returns the limit set with WithRateLimit or SetRateLimit.
+func (w *Watcher) rateLimit() (int, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.opts.rateLimit, w.opts.rateWindow
+}
+
+// rateLimiter counts the events for every path, for WithRateLimit.
+type rateLimiter struct {
+	mu    sync.Mutex
+	paths map[string]*rateWindow
+	sweep time.Time // When the expired windows were last removed.
+}
+
+type rateWindow struct {
+	start time.Time
+	n     int
+}
+
+// allow reports if another event for name can be sent: that is, if fewer
+// than n events were sent for it in the current window.
+func (l *rateLimiter) allow(name string, n int, window time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now, window)
+
+	if l.paths == nil {
+		l.paths = make(map[string]*rateWindow)
+	}
+	rw, ok := l.paths[name]
+	if !ok || now.Sub(rw.start) > window {
+		rw = &rateWindow{start: now}
+		l.paths[name] = rw
+	}
+	if rw.n >= n {
+		return false
+	}
+	rw.n++
+	return true
+}
+
+// prune removes the windows that are over, at most once per window.
+//
+// The caller must hold l.mu.
+func (l *rateLimiter) prune(now time.Time, window time.Duration) {
+	if now.Sub(l.sweep) <= window {
+		return
+	}
+	for p, rw := range l.paths {
+		if now.Sub(rw.start) > window {
+			delete(l.paths, p)
+		}
+	}
+	l.sweep = now
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// rootWatches keeps track of the paths passed to Add, for WithRootRemoved,
+// and the directories among them, for WithChildrenOnly.
+type rootWatches struct {
+	mu    sync.Mutex
+	names map[string]bool
+	dirs  map[string]bool
+}
+
+func (r *rootWatches) add(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names == nil {
+		r.names = make(map[string]bool)
+	}
+	r.names[name] = true
+}
+
+// addDir records name if it's a directory. It's still recorded after the
+// directory is removed, so that the events for that are recognized.
+func (r *rootWatches) addDir(name string) {
+	if fi, err := os.Stat(name); err != nil || !fi.IsDir() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dirs == nil {
+		r.dirs = make(map[string]bool)
+	}
+	r.dirs[name] = true
+}
+
+func (r *rootWatches) remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.names, name)
+	delete(r.dirs, name)
+}
+
+// isDir reports if name is a directory that was passed to Add.
+func (r *rootWatches) isDir(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dirs[name]
+}
+
+// isHidden reports if the file name starts with a dot, for WithIgnoreHidden.
+func isHidden(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), ".")
+}
+
+// ignoreHidden reports if e should be dropped for WithIgnoreHidden, as it's
+// for a hidden file in a watched directory.
+func (w *Watcher) ignoreHidden(e Event) bool {
+	return w.opts.ignoreHidden && !e.Watched && isHidden(e.Name)
+}
+
+// childrenOnly reports if e should be dropped for WithChildrenOnly, as it's
+// for a watched directory itself rather than for a path in it.
+func (w *Watcher) childrenOnly(e Event) bool {
+	return w.opts.childrenOnly && e.Watched && w.pipeline.roots.isDir(e.Name)
+}
+
+// watchLost reports if ErrWatchLost should be sent for name, which was passed
+// to Add and whose watch was removed along with the path.
+func (w *Watcher) watchLost(name string) bool {
+	return w.opts.watchLost && !w.IsWatching(name) && !w.deferredWatching(name)
+}
+
+// update adds RootRemoved to a Remove or Rename event for a path that was
+// passed to Add and no longer exists. This is only done once for every path;
+// it has to be added again to be reported again.
+func (r *rootWatches) update(e *Event) {
+	if e.Op&(Remove|Rename) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.names[e.Name] {
+		return
+	}
+	if _, err := os.Lstat(e.Name); !os.IsNotExist(err) {
+		return
+	}
+	delete(r.names, e.Name)
+	e.Op |= RootRemoved
+}
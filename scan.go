@@ -0,0 +1,97 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// initialScanEvents returns a Create event for every entry in the directory
+// name, or nil if it's not a directory.
+func initialScanEvents(name string) []Event {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil
+	}
+	events := make([]Event, 0, len(entries))
+	for _, e := range entries {
+		events = append(events, Event{Name: filepath.Join(name, e.Name()), Op: Create})
+	}
+	return events
+}
+
+// scanQueue sends the events for WithInitialScan from a new goroutine, while
+// making sure they're sent before any events that happen after the watch was
+// added.
+type scanQueue struct {
+	mu   sync.Mutex
+	wg   sync.WaitGroup // Running scans; the Events channel can't be closed before these finish.
+	last chan struct{}  // Closed when the last queued scan is sent.
+}
+
+// add queues a new scan, which must be done before the watch is added so that
+// no events can be sent before it. The returned function starts sending
+// events, and must always be called (events can be nil).
+func (q *scanQueue) add(send func(Event) bool, done <-chan struct{}) func(events []Event) {
+	q.mu.Lock()
+	prev, next := q.last, make(chan struct{})
+	q.last = next
+	q.mu.Unlock()
+
+	q.wg.Add(1)
+	return func(events []Event) {
+		go func() {
+			defer q.wg.Done()
+			defer close(next)
+			if prev != nil {
+				select {
+				case <-prev:
+				case <-done:
+					return
+				}
+			}
+			for _, e := range events {
+				if !send(e) {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// idle reports if all queued scans are sent.
+func (q *scanQueue) idle() bool {
+	q.mu.Lock()
+	last := q.last
+	q.mu.Unlock()
+	if last == nil {
+		return true
+	}
+	select {
+	case <-last:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait blocks until all queued scans are sent, or done is closed.
+func (q *scanQueue) wait(done <-chan struct{}) {
+	q.mu.Lock()
+	last := q.last
+	q.mu.Unlock()
+	if last == nil {
+		return
+	}
+	select {
+	case <-last:
+	case <-done:
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import (
+	"os"
+	"sync"
+)
+
+// sizeCache remembers the size of every file at the last Write, for
+// WithSizeTracking.
+type sizeCache struct {
+	mu    sync.Mutex
+	sizes map[string]int64
+}
+
+// update sets Size and Truncated for a Write, and forgets the size of files
+// that are removed or renamed.
+func (c *sizeCache) update(e *Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e.Op&(Remove|Rename) != 0 {
+		delete(c.sizes, e.Name)
+		return
+	}
+	if e.Op&Write != Write {
+		return
+	}
+
+	// Leave it at 0 if the file is already removed again; the Remove will
+	// forget about it.
+	fi, err := os.Lstat(e.Name)
+	if err != nil || fi.IsDir() {
+		return
+	}
+	e.Size = fi.Size()
+	last, ok := c.sizes[e.Name]
+	e.Truncated = e.Size < last || !ok && e.Size == 0
+	if c.sizes == nil {
+		c.sizes = make(map[string]int64)
+	}
+	c.sizes[e.Name] = e.Size
+}
+
+// len returns the number of sizes kept, for MemStats.
+func (c *sizeCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sizes)
+}
@@ -0,0 +1,177 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || windows
+// +build linux windows
+
+package fsnotify
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// followedLinks keeps track of the symlinks in watched directories that are
+// followed with WithFollowSymlinks. The target of every symlink is watched,
+// and if it's a directory the symlinks in that are followed as well.
+//
+// A target is only watched once, no matter how many symlinks resolve to it,
+// and the symlinks in a directory are only followed when the directory is
+// first watched; that's what stops a symlink loop.
+//
+// kqueue already follows the symlinks in directories when watching their
+// files, so this is only used for inotify and ReadDirectoryChangesW.
+type followedLinks struct {
+	mu      sync.Mutex
+	targets map[string]string // Symlink → path it resolves to.
+	owned   map[string]int    // Targets not watched by the user → number of symlinks.
+}
+
+// followAdded is called when the user adds name, so that it's no longer removed
+// when no symlink resolves to it. If it's a directory, the symlinks in it are
+// followed.
+func (w *Watcher) followAdded(name string) {
+	l := &w.links
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.owned, name)
+	w.claimWatch(name)
+	w.followDirLinks(name, map[string]bool{name: true})
+}
+
+// unfollowDir stops following the symlinks in dir, which is being removed by
+// the user.
+func (w *Watcher) unfollowDir(dir string) {
+	l := &w.links
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for link := range l.targets {
+		if filepath.Dir(link) == dir {
+			w.unfollowLink(link)
+		}
+	}
+}
+
+// resetLinks forgets all symlinks, for Close.
+func (w *Watcher) resetLinks() {
+	l := &w.links
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.targets, l.owned = nil, nil
+}
+
+// isFollowedTarget reports if name is only watched because a symlink resolves
+// to it.
+func (w *Watcher) isFollowedTarget(name string) bool {
+	l := &w.links
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.owned[name] > 0
+}
+
+// followEvent starts following a symlink that was created in a watched
+// directory, and stops following one that was removed or renamed.
+func (w *Watcher) followEvent(e Event) {
+	l := &w.links
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case e.Op&Create == Create:
+		fi, err := os.Lstat(e.Name)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return
+		}
+		w.followLink(e.Name, map[string]bool{filepath.Dir(e.Name): true})
+	case e.Op&(Remove|Rename) != 0:
+		if _, ok := l.targets[e.Name]; ok {
+			w.unfollowLink(e.Name)
+		}
+	}
+}
+
+// followDirLinks follows every symlink in dir. Paths in seen were already
+// visited while following the current symlink, and aren't followed again.
+//
+// The caller must hold l.mu.
+func (w *Watcher) followDirLinks(dir string, seen map[string]bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink != 0 {
+			w.followLink(filepath.Join(dir, entry.Name()), seen)
+		}
+	}
+}
+
+// followLink watches the target of link. Targets that don't exist are
+// ignored, as with a symlink passed to Add.
+//
+// The caller must hold l.mu.
+func (w *Watcher) followLink(link string, seen map[string]bool) {
+	l := &w.links
+	if _, ok := l.targets[link]; ok {
+		return
+	}
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return
+	}
+	if target, err = filepath.Abs(target); err != nil || seen[target] {
+		return
+	}
+	seen[target] = true
+	w.logf("following symlink %s to %s", link, target)
+
+	if l.targets == nil {
+		l.targets = make(map[string]string)
+		l.owned = make(map[string]int)
+	}
+	if l.owned[target] > 0 {
+		l.targets[link] = target
+		l.owned[target]++
+		return
+	}
+	held, err := w.holdWatch(target)
+	if err != nil {
+		return
+	}
+	l.targets[link] = target
+	if !held {
+		// Watched by the user.
+		return
+	}
+	l.owned[target] = 1
+
+	if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+		w.followDirLinks(target, seen)
+	}
+}
+
+// unfollowLink stops following link, and removes the watch on its target if
+// no other symlink resolves to it.
+//
+// The caller must hold l.mu.
+func (w *Watcher) unfollowLink(link string) {
+	l := &w.links
+	target := l.targets[link]
+	delete(l.targets, link)
+	if l.owned[target] == 0 {
+		return
+	}
+	l.owned[target]--
+	if l.owned[target] > 0 {
+		return
+	}
+	delete(l.owned, target)
+	w.releaseWatch(target)
+	for link := range l.targets {
+		if filepath.Dir(link) == target {
+			w.unfollowLink(link)
+		}
+	}
+}
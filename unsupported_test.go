@@ -0,0 +1,46 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build solaris || (!darwin && !dragonfly && !freebsd && !openbsd && !linux && !netbsd && !windows)
+// +build solaris !darwin,!dragonfly,!freebsd,!openbsd,!linux,!netbsd,!windows
+
+package fsnotify
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestNewWatcherUnsupported(t *testing.T) {
+	w, err := NewWatcher()
+	if w != nil {
+		t.Errorf("expected a nil Watcher, got: %#v", w)
+	}
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported, got: %v", err)
+	}
+}
+
+func TestWatcherUnsupported(t *testing.T) {
+	w := &Watcher{}
+	for name, err := range map[string]error{
+		"Add":     w.Add("/dir"),
+		"AddWith": w.AddWith("/dir"),
+		"AddAll":  w.AddAll([]string{"/dir"})[0],
+		"AddMany": w.AddMany("/dir"),
+		"Remove":  w.Remove("/dir"),
+		"Rescan":  w.Rescan("/dir"),
+	} {
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s: expected ErrUnsupported, got: %v", name, err)
+		}
+	}
+	if _, err := w.Plan("/dir"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Plan: expected ErrUnsupported, got: %v", err)
+	}
+	if _, err := w.Next(context.Background()); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Next: expected ErrUnsupported, got: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd windows
+
+package fsnotify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Update changes the set of watched paths to paths: paths that are already
+// watched are left alone, paths that aren't in paths are removed, and new
+// paths are added. This avoids the spurious events and missed changes from
+// removing all watches and adding them again.
+//
+// Unlike Add and Remove it doesn't stop at the first error; all paths are
+// attempted, and the returned error lists every path that failed.
+func (w *Watcher) Update(paths []string) error {
+	if w.Closed() {
+		return ErrClosed
+	}
+
+	want := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		want[w.cleanPath(p)] = true
+	}
+
+	var errs multiError
+	have := make(map[string]bool)
+	for _, name := range w.userWatchList() {
+		have[name] = true
+		if want[name] {
+			continue
+		}
+		if err := w.Remove(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, p := range paths {
+		name := w.cleanPath(p)
+		if have[name] {
+			continue
+		}
+		have[name] = true
+		if err := w.Add(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// RemovePrefix stops watching dir and every path below it, such as the
+// directories added with AddFS and the files in them that are watched
+// internally. All of these are removed at once, and until dir (or a path
+// below it) is added again with Add, no new watches are added below dir:
+// directories that are scanned for new files, WithDeferredCreate, and
+// WithFollowSymlinks won't watch them again. No more events are sent for
+// anything below dir.
+//
+// Unlike Remove it doesn't stop at the first error; all paths are attempted,
+// and the returned error lists every path that failed. It's not an error if
+// nothing is watched below dir.
+func (w *Watcher) RemovePrefix(dir string) error {
+	if w.Closed() {
+		return ErrClosed
+	}
+
+	// Mark it before removing anything: a watch that's added concurrently is
+	// either removed below, or sees the mark and isn't added at all.
+	dir = w.cleanPath(dir)
+	w.removed.add(dir)
+	return w.removePrefix(dir)
+}
+
+// userWatchesBelow returns the paths from userWatchList that are dir or below
+// it, with the ones deepest in the tree first; this way a path that's pending
+// for WithDeferredCreate releases its ancestor before the ancestor is removed.
+func (w *Watcher) userWatchesBelow(dir string) []string {
+	var names []string
+	for _, name := range w.userWatchList() {
+		if hasPathPrefix(name, dir) {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names
+}
+
+// errRemovedPrefix is returned for a watch that isn't added because it's below
+// a directory that was removed with RemovePrefix. It's an os.ErrNotExist, so
+// that it's skipped like a file that was removed while reading a directory.
+var errRemovedPrefix = fmt.Errorf("%w: below a path removed with RemovePrefix", os.ErrNotExist)
+
+// removedPrefixes records the directories removed with RemovePrefix, so that
+// no new watches are added below them.
+type removedPrefixes struct {
+	mu   sync.Mutex
+	dirs map[string]struct{}
+}
+
+func (r *removedPrefixes) add(dir string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dirs == nil {
+		r.dirs = make(map[string]struct{})
+	}
+	r.dirs[dir] = struct{}{}
+}
+
+// clear is called when name is added: it forgets the directories that name is
+// in, as well as the ones below name.
+func (r *removedPrefixes) clear(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for dir := range r.dirs {
+		if hasPathPrefix(name, dir) || hasPathPrefix(dir, name) {
+			delete(r.dirs, dir)
+		}
+	}
+}
+
+// has reports if name is a removed directory or below one.
+func (r *removedPrefixes) has(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for dir := range r.dirs {
+		if hasPathPrefix(name, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix reports if name is dir or a path below it.
+func hasPathPrefix(name, dir string) bool {
+	if name == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return strings.HasPrefix(name, dir)
+}
+
+// userWatchList returns the paths that were added with Add: unlike WatchList
+// this leaves out the watches that are added internally, and includes the
+// paths that are waiting to be created with WithDeferredCreate.
+func (w *Watcher) userWatchList() []string {
+	d := &w.pipeline.deferred
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var names []string
+	for _, name := range w.WatchList() {
+		if !w.heldWatch(name) && w.isUserWatch(name) {
+			names = append(names, name)
+		}
+	}
+	for target := range d.targets {
+		names = append(names, target)
+	}
+	return names
+}
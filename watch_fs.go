@@ -0,0 +1,207 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || solaris || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd solaris windows
+
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FSWatcher watches files in an fs.FS that is backed by a directory on the
+// operating system, such as one returned by os.DirFS. All paths are
+// slash-separated and relative to the root of the fs.FS, as with fs.ValidPath.
+type FSWatcher struct {
+	// Events sends the filesystem change events. The Name is relative to the
+	// root of the fs.FS; "." is the root itself. Events for paths outside the
+	// root aren't sent.
+	Events chan Event
+
+	// Errors sends any errors.
+	Errors chan error
+
+	w         *Watcher
+	root      string
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// WatchFS creates a new FSWatcher for fsys, which must be backed by the
+// directory root. Nothing is watched until Add is called.
+//
+// The options are passed on to NewWatcher.
+func WatchFS(fsys fs.FS, root string, opts ...Option) (*FSWatcher, error) {
+	if err := checkFSRoot(fsys, root); err != nil {
+		return nil, err
+	}
+
+	w, err := NewWatcher(opts...)
+	if err != nil {
+		return nil, err
+	}
+	fw := &FSWatcher{
+		Events:  make(chan Event),
+		Errors:  make(chan error),
+		w:       w,
+		root:    filepath.Clean(root),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go fw.readEvents()
+	return fw, nil
+}
+
+// AddFS starts watching every directory in fsys, which must be backed by the
+// directory root, as with WatchFS. The directories are found with fs.WalkDir,
+// and the watches are added for the paths below root; the events have the
+// operating system path as the Name.
+//
+// Directories that are created later aren't watched; use WatchTree for that.
+// Directories that are removed while walking are skipped.
+func (w *Watcher) AddFS(fsys fs.FS, root string) error {
+	if err := checkFSRoot(fsys, root); err != nil {
+		return err
+	}
+	root = filepath.Clean(root)
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && name != "." {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return w.Add(filepath.Join(root, filepath.FromSlash(name)))
+	})
+}
+
+// checkFSRoot returns an error if fsys isn't backed by the directory root.
+func checkFSRoot(fsys fs.FS, root string) error {
+	fi, err := fs.Stat(fsys, ".")
+	if err != nil {
+		return err
+	}
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(fi, rootInfo) {
+		return fmt.Errorf("fsnotify: fs.FS is not backed by %q", root)
+	}
+	return nil
+}
+
+// Add starts watching the named file or directory (non-recursively).
+func (fw *FSWatcher) Add(name string) error {
+	path, err := fw.osPath("add", name)
+	if err != nil {
+		return err
+	}
+	return fw.pathError("add", name, fw.w.Add(path))
+}
+
+// Remove stops watching the named file or directory.
+func (fw *FSWatcher) Remove(name string) error {
+	path, err := fw.osPath("remove", name)
+	if err != nil {
+		return err
+	}
+	return fw.pathError("remove", name, fw.w.Remove(path))
+}
+
+// Close removes all watches and closes the Events and Errors channels.
+func (fw *FSWatcher) Close() error {
+	fw.closeOnce.Do(func() { close(fw.done) })
+	return fw.w.Close()
+}
+
+// Done returns a channel that's closed once the FSWatcher and the Watcher it
+// uses have fully stopped after Close, and the Events and Errors channels are
+// closed.
+func (fw *FSWatcher) Done() <-chan struct{} {
+	return fw.stopped
+}
+
+// osPath converts the fs-relative name to a path on the operating system.
+func (fw *FSWatcher) osPath(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(fw.root, filepath.FromSlash(name)), nil
+}
+
+// pathError replaces the operating system path in err with name, so that the
+// error doesn't leak the root.
+func (fw *FSWatcher) pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// fsName converts the path on the operating system to an fs-relative name. It
+// returns false if path isn't below the root.
+func (fw *FSWatcher) fsName(path string) (string, bool) {
+	rel, err := filepath.Rel(fw.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func (fw *FSWatcher) readEvents() {
+	defer func() {
+		<-fw.w.Done()
+		close(fw.stopped)
+	}()
+	defer close(fw.Errors)
+	defer close(fw.Events)
+
+	errs := fw.w.Errors
+	for {
+		select {
+		case <-fw.done:
+			return
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case fw.Errors <- err:
+			case <-fw.done:
+				return
+			}
+		case e, ok := <-fw.w.Events:
+			if !ok {
+				return
+			}
+			name, ok := fw.fsName(e.Name)
+			if !ok {
+				continue
+			}
+			e.Name = name
+			select {
+			case fw.Events <- e:
+			case <-fw.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || solaris || windows
+// +build darwin dragonfly freebsd openbsd linux netbsd solaris windows
+
+package fsnotify
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WatchTree watches root and all directories below it, and sends all events
+// that happen within settle of each other as one batch.
+//
+// Directories that are created after WatchTree is called are watched as well;
+// a Create event is added to the batch for everything that's already in a new
+// directory by the time the watch for it is added.
+//
+// Errors are sent on the second channel. Both channels are closed and the
+// underlying Watcher is closed when ctx is canceled. The batch that's still
+// waiting for settle to pass is sent if the receiver is ready for it at that
+// point, and dropped otherwise.
+func WatchTree(ctx context.Context, root string, settle time.Duration) (<-chan []Event, <-chan error, error) {
+	w, err := NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := addTree(w, root, false); err != nil {
+		w.Close()
+		return nil, nil, err
+	}
+
+	var (
+		batches = make(chan []Event)
+		errs    = make(chan error)
+	)
+	go func() {
+		defer close(errs)
+		defer close(batches)
+		defer w.Close()
+
+		var (
+			batch   []Event
+			timer   = time.NewTimer(settle)
+			timeout <-chan time.Time
+		)
+		timer.Stop()
+		sendErr := func(err error) bool {
+			select {
+			case errs <- err:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		// Best-effort: don't block on a receiver that stopped reading because
+		// ctx was canceled.
+		flush := func() {
+			if len(batch) > 0 {
+				select {
+				case batches <- batch:
+				default:
+				}
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				flush()
+				return
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				if !sendErr(err) {
+					return
+				}
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				batch = append(batch, e)
+				if e.Op&Create == Create {
+					if fi, err := os.Lstat(e.Name); err == nil && fi.IsDir() {
+						created, err := addTree(w, e.Name, true)
+						batch = append(batch, created...)
+						if err != nil && !sendErr(err) {
+							return
+						}
+					}
+				}
+
+				if !timer.Stop() && timeout != nil {
+					<-timer.C
+				}
+				timer.Reset(settle)
+				timeout = timer.C
+			case <-timeout:
+				timeout = nil
+				select {
+				case batches <- batch:
+					batch = nil
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return batches, errs, nil
+}
+
+// addTree adds a watch for root and every directory below it. If events is
+// true it returns a Create event for every path below root.
+func addTree(w *Watcher, root string, events bool) ([]Event, error) {
+	var created []Event
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Removed while we're walking it; that's fine.
+			if os.IsNotExist(err) && path != root {
+				return nil
+			}
+			return err
+		}
+		if events && path != root {
+			created = append(created, Event{Name: path, Op: Create})
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return w.Add(path)
+	})
+	return created, err
+}
@@ -14,25 +14,46 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
 // Watcher watches a set of files, delivering events to a channel.
 type Watcher struct {
-	Events   chan Event
-	Errors   chan error
-	isClosed bool           // Set to true when Close() is first called
-	mu       sync.Mutex     // Map access
-	port     syscall.Handle // Handle to completion port
-	watches  watchMap       // Map of watches (key: i-number)
-	input    chan *input    // Inputs to the reader are sent on this channel
-	quit     chan chan<- error
+	Events     chan Event
+	Errors     chan error
+	isClosed   bool           // Set to true when Close() is first called
+	mu         sync.Mutex     // Map access
+	port       syscall.Handle // Handle to completion port
+	watches    watchMap       // Map of watches (key: i-number)
+	input      chan *input    // Inputs to the reader are sent on this channel
+	quit       chan chan<- error
+	closed     chan struct{}   // Closed when the reader goroutine has stopped
+	done       chan struct{}   // Closed when Close is called
+	opts       withOpts        // Options passed to NewWatcher
+	pipeline   eventPipeline   // Options that change or drop events; see eventPipeline
+	links      followedLinks   // Symlinks for WithFollowSymlinks
+	internal   internalWatches // Watches for WithDeferredCreate and WithFollowSymlinks
+	drops      dropCounter     // Events discarded by the backpressure policy
+	scans      scanQueue       // Events for WithInitialScan
+	removed    removedPrefixes // Directories removed with RemovePrefix
+	paused     bool            // Set by Pause; guarded by mu
+	suppressed int             // Events discarded while paused; guarded by mu
+	draining   int32           // Set by CloseAndDrain; accessed atomically
+	errDrops   uint64          // Errors discarded for WithDropErrors; accessed atomically
+	seq        uint64          // Last Event.Seq; accessed atomically
+	onEvent    atomic.Value    // Function set with OnEvent
+	logger     atomic.Value    // Function set with SetLogger
+	normalizer atomic.Value    // Function set with SetPathNormalizer
+	mapper     atomic.Value    // EventMapper set with SetEventMapper
 }
 
 // NewWatcher establishes a new watcher with the underlying OS and begins waiting for events.
-func NewWatcher() (*Watcher, error) {
+func NewWatcher(opts ...Option) (*Watcher, error) {
 	port, e := syscall.CreateIoCompletionPort(syscall.InvalidHandle, 0, 0, 0)
 	if e != nil {
 		return nil, os.NewSyscallError("CreateIoCompletionPort", e)
@@ -41,14 +62,30 @@ func NewWatcher() (*Watcher, error) {
 		port:    port,
 		watches: make(watchMap),
 		input:   make(chan *input, 1),
-		Events:  make(chan Event, 50),
-		Errors:  make(chan error),
 		quit:    make(chan chan<- error, 1),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+		opts:    getOptions(opts...),
 	}
+	w.Events = make(chan Event, w.opts.eventsBuffer(50))
+	w.Errors = make(chan error, w.opts.errorsBuffer)
 	go w.readEvents()
 	return w, nil
 }
 
+// Closed reports if Close was called.
+func (w *Watcher) Closed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.isClosed
+}
+
+// Done returns a channel that's closed once the watcher has fully stopped
+// after Close, and the Events and Errors channels are closed.
+func (w *Watcher) Done() <-chan struct{} {
+	return w.closed
+}
+
 // Close removes all watches and closes the events channel.
 func (w *Watcher) Close() error {
 	w.mu.Lock()
@@ -57,6 +94,7 @@ func (w *Watcher) Close() error {
 		return nil
 	}
 	w.isClosed = true
+	close(w.done)
 	w.mu.Unlock()
 
 	// Send "quit" message to the reader goroutine
@@ -69,16 +107,19 @@ func (w *Watcher) Close() error {
 }
 
 // Add starts watching the named file or directory (non-recursively).
+//
+// The watch is active when Add returns: any change made after that is
+// reported.
 func (w *Watcher) Add(name string) error {
 	w.mu.Lock()
 	if w.isClosed {
 		w.mu.Unlock()
-		return errors.New("watcher already closed")
+		return ErrClosed
 	}
 	w.mu.Unlock()
 	in := &input{
 		op:    opAddWatch,
-		path:  filepath.Clean(name),
+		path:  w.cleanPath(name),
 		flags: sysFSALLEVENTS,
 		reply: make(chan error),
 	}
@@ -89,11 +130,43 @@ func (w *Watcher) Add(name string) error {
 	return <-in.reply
 }
 
+// AddWith is like Add, but with options for this watch.
+//
+// WithAccess isn't supported and fails with ErrUnsupported.
+func (w *Watcher) AddWith(name string, opts ...AddOption) error {
+	if getAddOptions(opts...).access {
+		return fmt.Errorf("%w: WithAccess: %s", ErrUnsupported, name)
+	}
+	return w.Add(name)
+}
+
+// AddAll starts watching all the named files or directories
+// (non-recursively).
+//
+// The returned slice has an error (or nil) for every name, in the same order.
+func (w *Watcher) AddAll(names []string) []error {
+	errs := make([]error, len(names))
+	for i, name := range names {
+		errs[i] = w.Add(name)
+	}
+	return errs
+}
+
 // Remove stops watching the the named file or directory (non-recursively).
+//
+// The error is ErrNonExistentWatch (check with errors.Is) if name isn't
+// watched, including when it was already removed by a concurrent call to
+// Remove, so that this can be ignored during teardown.
 func (w *Watcher) Remove(name string) error {
+	w.mu.Lock()
+	if w.isClosed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.mu.Unlock()
 	in := &input{
 		op:    opRemoveWatch,
-		path:  filepath.Clean(name),
+		path:  w.cleanPath(name),
 		reply: make(chan error),
 	}
 	w.input <- in
@@ -103,21 +176,216 @@ func (w *Watcher) Remove(name string) error {
 	return <-in.reply
 }
 
+// removePrefix is RemovePrefix; the watches are removed by the I/O thread, so
+// that no watch is added while they're removed.
+func (w *Watcher) removePrefix(dir string) error {
+	in := &input{
+		op:    opRemovePrefix,
+		path:  dir,
+		reply: make(chan error),
+	}
+	w.input <- in
+	if err := w.wakeupReader(); err != nil {
+		return err
+	}
+	return <-in.reply
+}
+
+// Rescan reads the watched directory name again, and sends a Create event for
+// every file in it. ReadDirectoryChangesW doesn't keep track of the files, so
+// there's no way to tell which ones are new, or to send Remove events for the
+// ones that are gone. This can be used to get back in sync after
+// ErrEventOverflow. It does nothing for a watched file.
+//
+// The error is ErrNonExistentWatch if name isn't watched.
+func (w *Watcher) Rescan(name string) error {
+	w.mu.Lock()
+	if w.isClosed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.mu.Unlock()
+	in := &input{
+		op:    opRescan,
+		path:  w.cleanPath(name),
+		reply: make(chan error),
+	}
+	w.input <- in
+	if err := w.wakeupReader(); err != nil {
+		return err
+	}
+	return <-in.reply
+}
+
+// Dropped returns the number of events that were discarded because of the
+// backpressure policy or the rate limit; see WithBackpressure and
+// WithRateLimit.
+func (w *Watcher) Dropped() uint64 {
+	return w.drops.count()
+}
+
+// DroppedErrors returns the number of errors that were discarded because
+// nobody received them; see WithDropErrors.
+func (w *Watcher) DroppedErrors() uint64 {
+	return atomic.LoadUint64(&w.errDrops)
+}
+
+// Interrupted returns the number of times reading events was interrupted by a
+// signal. This is always 0 on Windows, where there are no signals to interrupt
+// GetQueuedCompletionStatus.
+func (w *Watcher) Interrupted() uint64 {
+	return 0
+}
+
+// Backend returns the name of the mechanism the Watcher uses to watch files,
+// for diagnostics: "ReadDirectoryChangesW" on this platform.
+func (w *Watcher) Backend() string {
+	return "ReadDirectoryChangesW"
+}
+
+// Count returns the number of watches. Files are watched through the directory
+// they're in, so all watched files in one directory count as one watch.
+func (w *Watcher) Count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count()
+}
+
+func (w *Watcher) count() int {
+	n := 0
+	for _, index := range w.watches {
+		n += len(index)
+	}
+	return n
+}
+
+// MemStats returns the size of the state kept for the watched files. Watches
+// is the number of directory handles, and Paths the number of watched paths,
+// as returned by WatchCount.
+func (w *Watcher) MemStats() MemStats {
+	s := MemStats{Paths: w.WatchCount(), Sizes: w.pipeline.sizes.len()}
+	w.mu.Lock()
+	s.Watches = w.count()
+	w.mu.Unlock()
+	return s
+}
+
+// SetMaxWatches changes the limit on the number of watches set with
+// WithMaxWatches; n <= 0 removes the limit. Watches that are already there
+// are kept if there are more than n, but adding more fails with
+// ErrMaxWatchesExceeded until there are fewer.
+func (w *Watcher) SetMaxWatches(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.opts.maxWatches = n
+}
+
+// WatchCount returns the number of paths that WatchList would return, without
+// allocating the list. Unlike Count this is the number of watched paths rather
+// than directory handles, as the files in one directory share a handle; on
+// other platforms every path has its own watch, so the two are the same.
+//
+// Returns 0 if the watcher is closed.
+func (w *Watcher) WatchCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed {
+		return 0
+	}
+
+	n := 0
+	for _, entry := range w.watches {
+		for _, watchEntry := range entry {
+			if watchEntry.mask != 0 {
+				n++
+			}
+			n += len(watchEntry.names)
+		}
+	}
+	return n
+}
+
 // WatchList returns the directories and files that are being monitered.
+//
+// Returns nil if the watcher is closed.
 func (w *Watcher) WatchList() []string {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if w.isClosed {
+		return nil
+	}
 
 	entries := make([]string, 0, len(w.watches))
 	for _, entry := range w.watches {
 		for _, watchEntry := range entry {
-			entries = append(entries, watchEntry.path)
+			if watchEntry.mask != 0 {
+				entries = append(entries, watchEntry.path)
+			}
+			for name := range watchEntry.names {
+				entries = append(entries, filepath.Join(watchEntry.path, name))
+			}
 		}
 	}
 
 	return entries
 }
 
+// IsWatching reports if name is watched, as it would be listed by WatchList.
+// name is cleaned the same way as with Remove.
+//
+// Returns false if the watcher is closed.
+func (w *Watcher) IsWatching(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed {
+		return false
+	}
+
+	name = w.cleanPath(name)
+	dir, base := filepath.Split(name)
+	dir = filepath.Clean(dir)
+	for _, entry := range w.watches {
+		for _, watchEntry := range entry {
+			if watchEntry.path == name && watchEntry.mask != 0 {
+				return true
+			}
+			if watchEntry.path == dir {
+				if _, ok := watchEntry.names[base]; ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// AddFile starts watching the file or directory f, which is already open.
+//
+// Not supported with ReadDirectoryChangesW, which needs a handle that's opened
+// for it; this always fails with ErrUnsupported.
+func (w *Watcher) AddFile(f *os.File) error {
+	return fmt.Errorf("%w: AddFile: %s", ErrUnsupported, f.Name())
+}
+
+// Plan returns the paths that Add would watch for name, without watching
+// anything. With ReadDirectoryChangesW that's only name, as a directory is
+// watched as a whole.
+//
+// The error is the one Add would return if name can't be watched.
+func (w *Watcher) Plan(name string) ([]string, error) {
+	w.mu.Lock()
+	closed := w.isClosed
+	w.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	name = w.cleanPath(name)
+	if _, err := os.Stat(name); err != nil {
+		return nil, err
+	}
+	return []string{name}, nil
+}
+
 const (
 	// Options for AddWatch
 	sysFSONESHOT = 0x80000000
@@ -142,8 +410,11 @@ const (
 	sysFSQOVERFLOW = 0x4000
 )
 
-func newEvent(name string, mask uint32) Event {
-	e := Event{Name: name}
+// DefaultEventMapper returns a platform-independent Event based on the
+// inotify-style mask that the Windows actions are translated to; see
+// WithEventMapper.
+func DefaultEventMapper(name string, mask uint32) Event {
+	e := Event{Name: name, RawOp: mask}
 	if mask&sysFSCREATE == sysFSCREATE || mask&sysFSMOVEDTO == sysFSMOVEDTO {
 		e.Op |= Create
 	}
@@ -165,6 +436,8 @@ func newEvent(name string, mask uint32) Event {
 const (
 	opAddWatch = iota
 	opRemoveWatch
+	opRemovePrefix
+	opRescan
 )
 
 const (
@@ -205,10 +478,30 @@ func (w *Watcher) wakeupReader() error {
 	return nil
 }
 
+// longPath returns path in the extended-length form with the \\?\ prefix if
+// it's too long for MAX_PATH, so that it can be passed to system calls:
+// \\?\C:\dir for a path on a drive, and \\?\UNC\server\share\dir for a network
+// share. Paths in the events are always in the form they were passed to Add.
+func longPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) || strings.HasPrefix(path, `\\.\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	// Directories can't be longer than MAX_PATH minus room for an 8.3 file
+	// name; this is the same limit the os package uses.
+	if err != nil || len(abs) < 248 {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
 func getDir(pathname string) (dir string, err error) {
-	attr, e := syscall.GetFileAttributes(syscall.StringToUTF16Ptr(pathname))
+	attr, e := syscall.GetFileAttributes(syscall.StringToUTF16Ptr(longPath(pathname)))
 	if e != nil {
-		return "", os.NewSyscallError("GetFileAttributes", e)
+		return "", &os.PathError{Op: "GetFileAttributes", Path: pathname, Err: e}
 	}
 	if attr&syscall.FILE_ATTRIBUTE_DIRECTORY != 0 {
 		dir = pathname
@@ -220,18 +513,18 @@ func getDir(pathname string) (dir string, err error) {
 }
 
 func getIno(path string) (ino *inode, err error) {
-	h, e := syscall.CreateFile(syscall.StringToUTF16Ptr(path),
+	h, e := syscall.CreateFile(syscall.StringToUTF16Ptr(longPath(path)),
 		syscall.FILE_LIST_DIRECTORY,
 		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
 		nil, syscall.OPEN_EXISTING,
 		syscall.FILE_FLAG_BACKUP_SEMANTICS|syscall.FILE_FLAG_OVERLAPPED, 0)
 	if e != nil {
-		return nil, os.NewSyscallError("CreateFile", e)
+		return nil, &os.PathError{Op: "CreateFile", Path: path, Err: e}
 	}
 	var fi syscall.ByHandleFileInformation
 	if e = syscall.GetFileInformationByHandle(h, &fi); e != nil {
 		syscall.CloseHandle(h)
-		return nil, os.NewSyscallError("GetFileInformationByHandle", e)
+		return nil, &os.PathError{Op: "GetFileInformationByHandle", Path: path, Err: e}
 	}
 	ino = &inode{
 		handle: h,
@@ -268,13 +561,21 @@ func (w *Watcher) addWatch(pathname string, flags uint64) error {
 	if flags&sysFSONLYDIR != 0 && pathname != dir {
 		return nil
 	}
+	if w.opts.dirOnly && pathname == dir {
+		flags &^= sysFSMODIFY | sysFSATTRIB
+	}
 	ino, err := getIno(dir)
 	if err != nil {
 		return err
 	}
 	w.mu.Lock()
 	watchEntry := w.watches.get(ino)
+	tooMany := watchEntry == nil && w.opts.maxWatches > 0 && w.count() >= w.opts.maxWatches
 	w.mu.Unlock()
+	if tooMany {
+		syscall.CloseHandle(ino.handle)
+		return fmt.Errorf("%w: %s", ErrMaxWatchesExceeded, pathname)
+	}
 	if watchEntry == nil {
 		if _, e := syscall.CreateIoCompletionPort(ino.handle, w.port, 0, 0); e != nil {
 			syscall.CloseHandle(ino.handle)
@@ -325,27 +626,119 @@ func (w *Watcher) remWatch(pathname string) error {
 		return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
 	}
 	if pathname == dir {
-		w.sendEvent(watch.path, watch.mask&sysFSIGNORED)
+		if watch.mask == 0 {
+			// Only files in it are watched.
+			return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
+		}
+		w.sendEvent(watch.path, watch.mask&sysFSIGNORED, true)
 		watch.mask = 0
 	} else {
 		name := filepath.Base(pathname)
-		w.sendEvent(filepath.Join(watch.path, name), watch.names[name]&sysFSIGNORED)
+		if _, ok := watch.names[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
+		}
+		w.sendEvent(filepath.Join(watch.path, name), watch.names[name]&sysFSIGNORED, true)
 		delete(watch.names, name)
 	}
 	return w.startRead(watch)
 }
 
+// remPrefix removes the watches for dir and every path below it.
+//
+// Must run within the I/O thread.
+func (w *Watcher) remPrefix(dir string) error {
+	var errs multiError
+	for _, name := range w.userWatchesBelow(dir) {
+		if w.opts.rootRemoved || w.opts.childrenOnly {
+			w.pipeline.roots.remove(name)
+		}
+		if w.opts.followLinks {
+			w.unfollowDir(name)
+		}
+		if w.opts.deferred() {
+			if _, err := w.unwatchDeferred(name); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	var watches []*watch
+	w.mu.Lock()
+	for _, index := range w.watches {
+		for _, watch := range index {
+			watches = append(watches, watch)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, watch := range watches {
+		changed := false
+		if watch.mask != 0 && hasPathPrefix(watch.path, dir) {
+			w.sendEvent(watch.path, watch.mask&sysFSIGNORED, true)
+			watch.mask = 0
+			changed = true
+		}
+		for name, mask := range watch.names {
+			if fullname := filepath.Join(watch.path, name); hasPathPrefix(fullname, dir) {
+				w.sendEvent(fullname, mask&sysFSIGNORED, true)
+				delete(watch.names, name)
+				changed = true
+			}
+		}
+		if changed {
+			if err := w.startRead(watch); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// addDeferredWatch, removeDeferredWatch, and isUserWatch manage the watches
+// for WithDeferredCreate; see deferredWatches.
+//
+// Must run within the I/O thread.
+func (w *Watcher) addDeferredWatch(name string, target bool) error {
+	if w.removed.has(name) {
+		return errRemovedPrefix
+	}
+	return w.addWatch(name, sysFSALLEVENTS)
+}
+
+// Must run within the I/O thread.
+func (w *Watcher) removeDeferredWatch(name string) { w.remWatch(name) }
+
+func (w *Watcher) isUserWatch(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, index := range w.watches {
+		for _, watch := range index {
+			if watch.path == name && watch.mask != 0 {
+				return true
+			}
+			if _, ok := watch.names[filepath.Base(name)]; ok && watch.path == filepath.Dir(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Must run within the I/O thread.
 func (w *Watcher) deleteWatch(watch *watch) {
 	for name, mask := range watch.names {
 		if mask&provisional == 0 {
-			w.sendEvent(filepath.Join(watch.path, name), mask&sysFSIGNORED)
+			w.sendEvent(filepath.Join(watch.path, name), mask&sysFSIGNORED, true)
 		}
 		delete(watch.names, name)
 	}
 	if watch.mask != 0 {
 		if watch.mask&provisional == 0 {
-			w.sendEvent(watch.path, watch.mask&sysFSIGNORED)
+			w.sendEvent(watch.path, watch.mask&sysFSIGNORED, true)
 		}
 		watch.mask = 0
 	}
@@ -354,7 +747,7 @@ func (w *Watcher) deleteWatch(watch *watch) {
 // Must run within the I/O thread.
 func (w *Watcher) startRead(watch *watch) error {
 	if e := syscall.CancelIo(watch.ino.handle); e != nil {
-		w.Errors <- os.NewSyscallError("CancelIo", e)
+		w.sendError(os.NewSyscallError("CancelIo", e))
 		w.deleteWatch(watch)
 	}
 	mask := toWindowsFlags(watch.mask)
@@ -363,7 +756,7 @@ func (w *Watcher) startRead(watch *watch) error {
 	}
 	if mask == 0 {
 		if e := syscall.CloseHandle(watch.ino.handle); e != nil {
-			w.Errors <- os.NewSyscallError("CloseHandle", e)
+			w.sendError(&WatchError{Op: "CloseHandle", Path: watch.path, Err: e})
 		}
 		w.mu.Lock()
 		delete(w.watches[watch.ino.volume], watch.ino.index)
@@ -373,10 +766,10 @@ func (w *Watcher) startRead(watch *watch) error {
 	e := syscall.ReadDirectoryChanges(watch.ino.handle, &watch.buf[0],
 		uint32(unsafe.Sizeof(watch.buf)), false, mask, nil, &watch.ov, 0)
 	if e != nil {
-		err := os.NewSyscallError("ReadDirectoryChanges", e)
+		err := &os.PathError{Op: "ReadDirectoryChanges", Path: watch.path, Err: e}
 		if e == syscall.ERROR_ACCESS_DENIED && watch.mask&provisional == 0 {
 			// Watched directory was probably removed
-			if w.sendEvent(watch.path, watch.mask&sysFSDELETESELF) {
+			if w.sendEvent(watch.path, watch.mask&sysFSDELETESELF, true) {
 				if watch.mask&sysFSONESHOT != 0 {
 					watch.mask = 0
 				}
@@ -419,30 +812,104 @@ func (w *Watcher) readEvents() {
 						w.startRead(watch)
 					}
 				}
+				w.resetDeferred()
+				w.resetLinks()
+				w.pipeline.saves.reset()
 				var err error
 				if e := syscall.CloseHandle(w.port); e != nil {
 					err = os.NewSyscallError("CloseHandle", e)
 				}
+				w.scans.wg.Wait()
 				close(w.Events)
 				close(w.Errors)
+				close(w.closed)
 				ch <- err
 				return
 			case in := <-w.input:
 				switch in.op {
 				case opAddWatch:
-					in.reply <- w.addWatch(in.path, uint64(in.flags))
+					if w.opts.deferred() {
+						w.claimDeferred(in.path, 0)
+					}
+					w.removed.clear(in.path)
+					err := w.addWatch(in.path, uint64(in.flags))
+					if w.opts.deferredCreate && errors.Is(err, os.ErrNotExist) {
+						var exists bool
+						if exists, err = w.deferWatch(in.path); exists {
+							err = w.addWatch(in.path, uint64(in.flags))
+						}
+					}
+					if err == nil {
+						w.logAdded(in.path)
+					}
+					if err == nil && w.opts.rootRemoved {
+						w.pipeline.roots.add(in.path)
+					}
+					if err == nil && w.opts.childrenOnly {
+						w.pipeline.roots.addDir(in.path)
+					}
+					if err == nil && w.opts.followLinks {
+						w.followAdded(in.path)
+					}
+					if err != nil || !w.opts.initialScan {
+						in.reply <- err
+						break
+					}
+					// Queued before any other event can be sent; the
+					// events are sent from a new goroutine, as Add may be
+					// called again before anything reads them.
+					scan := w.scans.add(w.deliverEvent, w.done)
+					in.reply <- nil
+					var events []Event
+					for _, e := range initialScanEvents(in.path) {
+						events = append(events, w.makeEvents(e.Name, sysFSCREATE, false)...)
+					}
+					scan(events)
 				case opRemoveWatch:
+					if w.opts.rootRemoved || w.opts.childrenOnly {
+						w.pipeline.roots.remove(in.path)
+					}
+					if w.opts.followLinks {
+						w.unfollowDir(in.path)
+					}
+					if w.opts.deferred() {
+						if ok, err := w.unwatchDeferred(in.path); ok {
+							in.reply <- err
+							break
+						}
+					}
 					in.reply <- w.remWatch(in.path)
+				case opRemovePrefix:
+					in.reply <- w.remPrefix(in.path)
+				case opRescan:
+					if !w.IsWatching(in.path) {
+						in.reply <- fmt.Errorf("%w: %s", ErrNonExistentWatch, in.path)
+						break
+					}
+					scan := w.scans.add(w.deliverEvent, w.done)
+					in.reply <- nil
+					w.logf("rescanning directory %s", in.path)
+					var events []Event
+					for _, e := range initialScanEvents(in.path) {
+						events = append(events, w.makeEvents(e.Name, sysFSCREATE, false)...)
+					}
+					scan(events)
 				}
 			default:
 			}
+			if w.opts.atomicSaves > 0 {
+				// Woken up by the timer set in sendEvent, or something
+				// else; either way send the events that waited long enough.
+				w.deliverEvents(w.pipeline.saves.expired(time.Now()))
+				w.pipeline.saves.schedule(func() { w.wakeupReader() })
+			}
 			continue
 		}
 
 		switch e {
 		case syscall.ERROR_MORE_DATA:
 			if watch == nil {
-				w.Errors <- errors.New("ERROR_MORE_DATA has unexpectedly null lpOverlapped buffer")
+				w.sendError(errors.New("ERROR_MORE_DATA has unexpectedly null lpOverlapped buffer"))
 			} else {
 				// The i/o succeeded but the buffer is full.
 				// In theory we should be building up a full packet.
@@ -451,15 +918,19 @@ func (w *Watcher) readEvents() {
 			}
 		case syscall.ERROR_ACCESS_DENIED:
 			// Watched directory was probably removed
-			w.sendEvent(watch.path, watch.mask&sysFSDELETESELF)
+			w.sendEvent(watch.path, watch.mask&sysFSDELETESELF, true)
+			lost := watch.mask != 0
 			w.deleteWatch(watch)
 			w.startRead(watch)
+			if lost && w.watchLost(watch.path) {
+				w.sendError(watchError("watch", watch.path, ErrWatchLost))
+			}
 			continue
 		case syscall.ERROR_OPERATION_ABORTED:
 			// CancelIo was called on this handle
 			continue
 		default:
-			w.Errors <- os.NewSyscallError("GetQueuedCompletionPort", e)
+			w.sendError(os.NewSyscallError("GetQueuedCompletionPort", e))
 			continue
 		case nil:
 		}
@@ -467,8 +938,12 @@ func (w *Watcher) readEvents() {
 		var offset uint32
 		for {
 			if n == 0 {
-				w.Events <- newEvent("", sysFSQOVERFLOW)
-				w.Errors <- errors.New("short read in readEvents()")
+				// Not for a path, so only the filters and the backpressure
+				// policy apply, as for any other event.
+				e := w.mapEvent("", sysFSQOVERFLOW)
+				e.Seq = atomic.AddUint64(&w.seq, 1)
+				w.deliverEvents([]Event{e})
+				w.sendError(errors.New("short read in readEvents()"))
 				break
 			}
 
@@ -503,7 +978,7 @@ func (w *Watcher) readEvents() {
 			}
 
 			sendNameEvent := func() {
-				if w.sendEvent(fullname, watch.names[name]&mask) {
+				if w.sendEvent(fullname, watch.names[name]&mask, true) {
 					if watch.names[name]&sysFSONESHOT != 0 {
 						delete(watch.names, name)
 					}
@@ -513,14 +988,24 @@ func (w *Watcher) readEvents() {
 				sendNameEvent()
 			}
 			if raw.Action == syscall.FILE_ACTION_REMOVED {
-				w.sendEvent(fullname, watch.names[name]&sysFSIGNORED)
+				w.sendEvent(fullname, watch.names[name]&sysFSIGNORED, true)
+				_, lost := watch.names[name]
 				delete(watch.names, name)
+				if lost && w.watchLost(fullname) {
+					w.sendError(watchError("watch", fullname, ErrWatchLost))
+				}
 			}
-			if w.sendEvent(fullname, watch.mask&toFSnotifyFlags(raw.Action)) {
+			if w.sendEvent(fullname, watch.mask&toFSnotifyFlags(raw.Action), false) {
 				if watch.mask&sysFSONESHOT != 0 {
 					watch.mask = 0
 				}
 			}
+			if w.opts.dirWrites && watch.mask != 0 {
+				switch raw.Action {
+				case syscall.FILE_ACTION_ADDED, syscall.FILE_ACTION_REMOVED, syscall.FILE_ACTION_RENAMED_NEW_NAME:
+					w.sendEvent(watch.path, sysFSMODIFY, true)
+				}
+			}
 			if raw.Action == syscall.FILE_ACTION_RENAMED_NEW_NAME {
 				fullname = filepath.Join(watch.path, watch.rename)
 				sendNameEvent()
@@ -534,28 +1019,124 @@ func (w *Watcher) readEvents() {
 
 			// Error!
 			if offset >= n {
-				w.Errors <- errors.New("Windows system assumed buffer larger than it is, events have likely been missed.")
+				w.sendError(errors.New("Windows system assumed buffer larger than it is, events have likely been missed."))
 				break
 			}
 		}
 
 		if err := w.startRead(watch); err != nil {
-			w.Errors <- err
+			w.sendError(watchError("ReadDirectoryChanges", watch.path, err))
 		}
 	}
 }
 
-func (w *Watcher) sendEvent(name string, mask uint64) bool {
+// sendEvent sends the event for mask. watched is set if it's for a path that
+// was passed to Add, rather than for a file in a watched directory.
+func (w *Watcher) sendEvent(name string, mask uint64, watched bool) bool {
 	if mask == 0 {
 		return false
 	}
-	event := newEvent(name, uint32(mask))
+	w.deliverEvents(w.makeEvents(name, mask, watched))
+	return true
+}
+
+// makeEvents creates the events for mask, without sending them.
+//
+// Must run within the I/O thread.
+func (w *Watcher) makeEvents(name string, mask uint64, watched bool) []Event {
+	event := w.mapEvent(name, uint32(mask))
+	event.Seq = atomic.AddUint64(&w.seq, 1)
+	event.Watched = watched && !(w.opts.followLinks && w.isFollowedTarget(name))
+	if w.opts.moveEvents {
+		if mask&sysFSMOVEDFROM == sysFSMOVEDFROM {
+			event.Op |= MovedFrom
+		}
+		if mask&sysFSMOVEDTO == sysFSMOVEDTO {
+			event.Op |= MovedTo
+		}
+	}
+	if w.opts.sizeTracking {
+		w.pipeline.sizes.update(&event)
+	}
+	if w.opts.followLinks {
+		w.followEvent(event)
+	}
+
+	events := w.prepareEvents(event)
+	if w.opts.atomicSaves > 0 {
+		w.pipeline.saves.schedule(func() { w.wakeupReader() })
+	}
+	return events
+}
+
+// deliverEvents sends events, after the work that makeEvents does to create
+// them.
+//
+// Must run within the I/O thread.
+func (w *Watcher) deliverEvents(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	if !w.scans.idle() {
+		// The I/O thread also handles Add, so it can't wait for the events
+		// for WithInitialScan to be read like the other backends do; queue
+		// these after them instead.
+		w.scans.add(w.deliverEvent, w.done)(events)
+		return
+	}
+	for _, e := range events {
+		if !w.deliverEvent(e) {
+			return
+		}
+	}
+}
+
+// deliverEvent sends e on the Events channel, following the backpressure
+// policy. It returns false if the watcher was closed.
+func (w *Watcher) deliverEvent(e Event) bool {
+	if w.skipEvent(e) || !w.filterEvent(&e) {
+		return true
+	}
+	if w.callEvent(e) {
+		return true
+	}
+	if atomic.LoadInt32(&w.draining) == 1 {
+		// CloseAndDrain receives until Events is closed, so this can't
+		// block forever, and no event that was already read is lost.
+		w.Events <- e
+		return true
+	}
+	if w.opts.backpressure.trySend(w.Events, w.Errors, &w.drops, e) {
+		return true
+	}
+	timeout, stop := sendTimer(w.opts.sendTimeout)
+	defer stop()
 	select {
-	case ch := <-w.quit:
-		w.quit <- ch
-	case w.Events <- event:
+	case w.Events <- e:
+		return true
+	case <-timeout:
+		w.drops.drop(w.Errors)
+		return true
+	case <-w.done:
+		return false
 	}
-	return true
+}
+
+// sendError sends err on the Errors channel, or discards it with
+// WithDropErrors if it can't be sent right away.
+//
+// Must run within the I/O thread.
+func (w *Watcher) sendError(err error) {
+	if w.opts.dropErrors {
+		trySendError(w.Errors, &w.errDrops, err)
+		return
+	}
+	w.Errors <- err
+}
+
+// fileID returns 0, 0, as WithFileID isn't supported on Windows.
+func fileID(name string) (ino, dev uint64) {
+	return 0, 0
 }
 
 func toWindowsFlags(mask uint64) uint32 {
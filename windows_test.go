@@ -0,0 +1,115 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package fsnotify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWindowsLongPath(t *testing.T) {
+	long := strings.Repeat(`\dir`, 70)
+
+	tests := []struct {
+		in, want string
+	}{
+		{`C:\dir`, `C:\dir`},
+		{`C:` + long, `\\?\C:` + long},
+		{`\\server\share` + long, `\\?\UNC\server\share` + long},
+		{`\\?\C:` + long, `\\?\C:` + long},
+	}
+	for _, tt := range tests {
+		if have := longPath(tt.in); have != tt.want {
+			t.Errorf("longPath(%q):\nhave: %q\nwant: %q", tt.in, have, tt.want)
+		}
+	}
+}
+
+func TestWatchWindowsLongPath(t *testing.T) {
+	t.Parallel()
+
+	tmp := filepath.Join(t.TempDir(), strings.Repeat("d", 100), strings.Repeat("d", 100), strings.Repeat("d", 100))
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newCollector(t)
+	w.collect(t)
+	addWatch(t, w.w, tmp)
+	touch(t, tmp, "file")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create /file
+	`))
+}
+
+// Adding directories with more entries than fit in the Events buffer doesn't
+// block before anything reads the events for WithInitialScan.
+func TestWindowsInitialScanLarge(t *testing.T) {
+	t.Parallel()
+
+	const n = 200
+	tmp := t.TempDir()
+	dirs := []string{filepath.Join(tmp, "a"), filepath.Join(tmp, "b")}
+	for _, d := range dirs {
+		mkdir(t, d, noWait)
+		for i := 0; i < n; i++ {
+			touch(t, d, fmt.Sprintf("file%d", i), noWait)
+		}
+	}
+
+	w, err := NewWatcher(WithInitialScan())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	added := make(chan error)
+	go func() {
+		for _, d := range dirs {
+			if err := w.Add(d); err != nil {
+				added <- err
+				return
+			}
+		}
+		added <- nil
+	}()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Add blocked on the events for WithInitialScan")
+	}
+
+	// All events for the first directory are sent before the second one.
+	for i := 0; i < 2*n; i++ {
+		select {
+		case e := <-w.Events:
+			if want := dirs[i/n]; filepath.Dir(e.Name) != want || e.Op&Create != Create {
+				t.Fatalf("event %d: want Create in %s, have %s", i, want, e)
+			}
+		case err := <-w.Errors:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout after %d events", i)
+		}
+	}
+}
+
+// mkfifo skips the test, as there are no named pipes in the file system on
+// Windows.
+func mkfifo(t *testing.T, path ...string) {
+	t.Helper()
+	t.Skip("no named pipes in the file system on Windows")
+}